@@ -38,6 +38,34 @@ func newCmd() *cobra.Command {
 	_ = viper.BindEnv("log-level", "LOG_LEVEL")
 	_ = viper.BindEnv("listen-address", "LISTEN_ADDRESS")
 	viper.SetDefault("listen-address", ":9188")
+	_ = viper.BindEnv("sample-interval", "SAMPLE_INTERVAL")
+	viper.SetDefault("sample-interval", "5s")
+	_ = viper.BindEnv("exclude-users", "EXCLUDE_USERS")
+	_ = viper.BindEnv("exclude-databases", "EXCLUDE_DATABASES")
+	_ = viper.BindEnv("exclude-application-names", "EXCLUDE_APPLICATION_NAMES")
+	_ = viper.BindEnv("exclude-client-cidrs", "EXCLUDE_CLIENT_CIDRS")
+	_ = viper.BindEnv("exclude-backend-types", "EXCLUDE_BACKEND_TYPES")
+	_ = viper.BindEnv("idle-session-timeout", "IDLE_SESSION_TIMEOUT")
+	_ = viper.BindEnv("terminate-idle-after", "TERMINATE_IDLE_AFTER")
+	_ = viper.BindEnv("activity-query-name", "ACTIVITY_QUERY_NAME")
+	_ = viper.BindEnv("activity-query", "ACTIVITY_QUERY")
+	_ = viper.BindEnv("activity-query-database", "ACTIVITY_QUERY_DATABASE")
+	_ = viper.BindEnv("activity-query-timeout", "ACTIVITY_QUERY_TIMEOUT")
+	_ = viper.BindEnv("application-user", "APPLICATION_USER")
+	_ = viper.BindEnv("application-password", "APPLICATION_PASSWORD")
+	_ = viper.BindEnv("activity-sources", "ACTIVITY_SOURCES")
+	_ = viper.BindEnv("postgres-port", "PGPORT")
+	_ = viper.BindEnv("hold-database", "HOLD_DATABASE")
+	_ = viper.BindEnv("tls-cert-dir", "TLS_CERT_DIR")
+	_ = viper.BindEnv("health-listen-address", "HEALTH_LISTEN_ADDRESS")
+	_ = viper.BindEnv("push-url", "PUSH_URL")
+	_ = viper.BindEnv("push-key", "PUSH_KEY")
+	_ = viper.BindEnv("push-interval", "PUSH_INTERVAL")
+	viper.SetDefault("push-interval", "60s")
+	_ = viper.BindEnv("pod-namespace", "POD_NAMESPACE")
+	_ = viper.BindEnv("pod-name", "POD_NAME")
+	_ = viper.BindEnv("cluster-name", "CLUSTER_NAME")
+	viper.SetDefault("activity-query-timeout", "1s")
 
 	return cmd
 }
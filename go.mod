@@ -3,6 +3,7 @@ module github.com/xataio/cnpg-i-scale-to-zero
 go 1.26.3
 
 require (
+	github.com/cloudnative-pg/api v1.25.1
 	github.com/cloudnative-pg/cloudnative-pg v1.26.1
 	github.com/cloudnative-pg/cnpg-i v0.2.1
 	github.com/cloudnative-pg/cnpg-i-machinery v0.4.0
@@ -29,7 +30,6 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/cloudnative-pg/api v1.25.1 // indirect
 	github.com/cloudnative-pg/barman-cloud v0.3.1 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/emicklei/go-restful/v3 v3.12.1 // indirect
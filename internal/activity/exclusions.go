@@ -0,0 +1,51 @@
+package activity
+
+import (
+	"slices"
+	"strings"
+)
+
+// Exclusions describe sessions that never count as activity, such as
+// monitoring agents and pooler health checks.
+type Exclusions struct {
+	Users     []string
+	Databases []string
+	// ApplicationNames are patterns where * matches any sequence of
+	// characters and ? matches a single character.
+	ApplicationNames []string
+	// ClientCIDRs match the client address of TCP sessions.
+	ClientCIDRs  []string
+	BackendTypes []string
+}
+
+// Merge returns the union of both exclusion lists.
+func (e Exclusions) Merge(other Exclusions) Exclusions {
+	return Exclusions{
+		Users:            union(e.Users, other.Users),
+		Databases:        union(e.Databases, other.Databases),
+		ApplicationNames: union(e.ApplicationNames, other.ApplicationNames),
+		ClientCIDRs:      union(e.ClientCIDRs, other.ClientCIDRs),
+		BackendTypes:     union(e.BackendTypes, other.BackendTypes),
+	}
+}
+
+// ParseList splits a comma-separated list, dropping empty entries.
+func ParseList(value string) []string {
+	var result []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func union(a, b []string) []string {
+	var result []string
+	for _, item := range slices.Concat(a, b) {
+		if !slices.Contains(result, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
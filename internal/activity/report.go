@@ -0,0 +1,277 @@
+// Package activity defines the activity report exchanged between the sidecar
+// and the central scraper.
+package activity
+
+import "time"
+
+// ReportVersion is the version of the report served by GET /activity. Fields
+// may be added within a version; removing or redefining a field requires a new
+// version.
+const ReportVersion = 1
+
+// Report describes the PostgreSQL activity observed by one sidecar.
+type Report struct {
+	Version int `json:"version"`
+	// Instance identifies the PostgreSQL instance that answered. It is unset
+	// in reports from sidecars that predate it.
+	Instance *Instance `json:"instance,omitempty"`
+	// Connections is the number of client sessions that count as activity.
+	Connections int `json:"connections"`
+	// Sessions breaks Connections down by session attributes.
+	Sessions []SessionGroup `json:"sessions,omitempty"`
+	// OldestStateChange is the earliest state_change of the counted sessions.
+	OldestStateChange *time.Time `json:"oldest_state_change,omitempty"`
+	// Maintenance lists the maintenance operations in progress. They are
+	// reported regardless of the session exclusions.
+	Maintenance []MaintenanceOperation `json:"maintenance,omitempty"`
+	// LogicalReplication counts the logical replication backends, which are
+	// not part of Connections.
+	LogicalReplication LogicalReplication `json:"logical_replication"`
+	// PreparedTransactions is the number of entries in pg_prepared_xacts.
+	PreparedTransactions int `json:"prepared_transactions"`
+	// ReplicationSlots lists the logical replication slots.
+	ReplicationSlots []ReplicationSlot `json:"replication_slots,omitempty"`
+	// CustomQuery is the result of the cluster's custom activity query, if it
+	// has one.
+	CustomQuery *CustomQueryResult `json:"custom_query,omitempty"`
+	// Sockets describes the TCP connections to PostgreSQL seen in the pod
+	// network namespace, when the sidecar inspects them.
+	Sockets *SocketActivity `json:"sockets,omitempty"`
+	// Holds lists the requests of applications to keep the cluster awake.
+	Holds []Hold `json:"holds,omitempty"`
+	// ScheduledJobs lists the active pg_cron jobs.
+	ScheduledJobs []ScheduledJob `json:"scheduled_jobs,omitempty"`
+	// Counters is unset in reports from sidecars that cannot read them.
+	Counters *Counters `json:"counters,omitempty"`
+	// GeneratedAt is the sidecar clock when the report was taken.
+	GeneratedAt time.Time `json:"generated_at"`
+	// LastActive is when the sidecar's own sampler last saw activity, by the
+	// sidecar clock. Consumers should compare it with GeneratedAt rather than
+	// their own clock.
+	LastActive *time.Time `json:"last_active,omitempty"`
+}
+
+// Instance identifies a PostgreSQL instance and its role.
+type Instance struct {
+	// InRecovery is the result of pg_is_in_recovery(), true on replicas.
+	InRecovery bool `json:"in_recovery"`
+	// Timeline is the timeline the instance writes on a primary, and the
+	// timeline of its latest restart point on a replica.
+	Timeline int64 `json:"timeline"`
+	// SystemIdentifier is the system identifier of pg_control_system(),
+	// shared by every instance of a cluster.
+	SystemIdentifier string `json:"system_identifier"`
+}
+
+// Counters are cumulative PostgreSQL counters. An advance between two reports
+// of the same instance means work happened, even when no session was open
+// when either report was taken.
+type Counters struct {
+	// XactCommit and XactRollback sum pg_stat_database over the application
+	// databases. The postgres and template databases are excluded because the
+	// sidecar and the CNPG instance manager run their own queries there.
+	XactCommit   int64 `json:"xact_commit"`
+	XactRollback int64 `json:"xact_rollback"`
+	// WALPosition is the WAL insert location on a primary and the replay
+	// location on a replica, in bytes.
+	WALPosition int64 `json:"wal_position"`
+}
+
+// AdvancedSince reports whether any counter moved since previous. Counters
+// going backwards mean a statistics reset or a new server, and are treated as
+// an advance because the work in between is unknown.
+func (c Counters) AdvancedSince(previous Counters) bool {
+	return c != previous
+}
+
+// IdleFor returns how long the sidecar has seen no activity, if it knows.
+func (r Report) IdleFor() (time.Duration, bool) {
+	if r.LastActive == nil || r.GeneratedAt.IsZero() {
+		return 0, false
+	}
+	return max(r.GeneratedAt.Sub(*r.LastActive), 0), true
+}
+
+// SessionGroup counts the sessions sharing the same attributes.
+type SessionGroup struct {
+	Database        string `json:"database"`
+	User            string `json:"user"`
+	ApplicationName string `json:"application_name"`
+	State           string `json:"state"`
+	BackendType     string `json:"backend_type"`
+	Count           int    `json:"count"`
+	// LastStateChange is the latest state_change of the sessions in the group.
+	LastStateChange *time.Time `json:"last_state_change,omitempty"`
+}
+
+// MaintenanceOperation counts the operations of one kind running in one
+// database. Kind is one of the Maintenance constants.
+type MaintenanceOperation struct {
+	Kind     string `json:"kind"`
+	Database string `json:"database"`
+	Count    int    `json:"count"`
+}
+
+// LogicalReplication classifies the logical replication backends of an
+// instance.
+type LogicalReplication struct {
+	// Walsenders are the walsenders streaming changes to subscribers of this
+	// instance.
+	Walsenders int `json:"walsenders"`
+	// Workers are the workers applying subscriptions of this instance, and
+	// ApplyingWorkers the ones applying changes when the report was taken.
+	Workers         int `json:"workers"`
+	ApplyingWorkers int `json:"applying_workers"`
+}
+
+// CustomQueryResult is the value returned by a custom activity query. Boolean
+// results are reported as 1 and 0, and a query returning no row or NULL as 0.
+type CustomQueryResult struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Active reports whether the query result means activity.
+func (r CustomQueryResult) Active() bool {
+	return r.Value > 0
+}
+
+// SocketActivity describes the established inbound TCP connections to the
+// PostgreSQL port.
+type SocketActivity struct {
+	Established int `json:"established"`
+	// Peers is the number of distinct client addresses.
+	Peers int `json:"peers"`
+	// Unattached counts the connections without a session in
+	// pg_stat_activity yet, such as those in the TLS or authentication
+	// handshake.
+	Unattached int `json:"unattached"`
+	// BytesSeen is the data the connections received and had acknowledged
+	// since the previous report, or since they were established for those
+	// that were not open then.
+	BytesSeen int64 `json:"bytes_seen"`
+	// UnattachedBytesSeen is the part of BytesSeen moved by the unattached
+	// connections.
+	UnattachedBytesSeen int64 `json:"unattached_bytes_seen"`
+}
+
+// Active reports whether connections are being established.
+func (s SocketActivity) Active() bool {
+	return s.Unattached > 0
+}
+
+// HoldAdvisoryLockKey is the advisory lock key applications hold, with
+// pg_advisory_lock(5999710924424105776), to keep the cluster awake. It spells
+// SCALETO0 in ASCII.
+const HoldAdvisoryLockKey int64 = 0x5343414c45544f30
+
+// Sources of holds.
+const (
+	HoldAdvisoryLock = "advisory_lock"
+	HoldTable        = "table"
+)
+
+// Hold is a request of an application to keep the cluster awake.
+type Hold struct {
+	Source   string `json:"source"`
+	Database string `json:"database"`
+	// Holder is the application name of the session holding the advisory
+	// lock, or the holder column of the hold table.
+	Holder    string     `json:"holder"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ScheduledJob describes a pg_cron job.
+type ScheduledJob struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// NextRun is when the job is next due, by the sidecar clock. It is unset
+	// when the schedule could not be interpreted, in which case the job
+	// should be considered due.
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+// NextScheduledRun returns when the next scheduled job is due, by the sidecar
+// clock, and whether any job is scheduled. A job whose next run is unknown is
+// due when the report was generated.
+func (r Report) NextScheduledRun() (time.Time, bool) {
+	var next time.Time
+	for _, job := range r.ScheduledJobs {
+		run := r.GeneratedAt
+		if job.NextRun != nil {
+			run = *job.NextRun
+		}
+		if next.IsZero() || run.Before(next) {
+			next = run
+		}
+	}
+	return next, len(r.ScheduledJobs) > 0
+}
+
+// ReplicationSlot describes a logical replication slot.
+type ReplicationSlot struct {
+	Name     string `json:"name"`
+	Database string `json:"database"`
+	Active   bool   `json:"active"`
+	// LagBytes is how far the confirmed flush location is behind the current
+	// WAL location.
+	LagBytes int64 `json:"lag_bytes"`
+}
+
+// HasConsumer reports whether a consumer is attached to the slot or has not
+// yet confirmed all WAL, meaning it still depends on the cluster.
+func (s ReplicationSlot) HasConsumer() bool {
+	return s.Active || s.LagBytes > 0
+}
+
+// Kinds of maintenance operations.
+const (
+	MaintenanceVacuum      = "vacuum"
+	MaintenanceAutovacuum  = "autovacuum"
+	MaintenanceAnalyze     = "analyze"
+	MaintenanceCreateIndex = "create_index"
+	MaintenanceCluster     = "cluster"
+	MaintenanceBaseBackup  = "base_backup"
+	MaintenanceDump        = "dump"
+)
+
+// Active reports whether the report contains any activity.
+func (r Report) Active() bool {
+	return r.Connections > 0
+}
+
+// ConsumedReplicationSlots returns the logical replication slots that still
+// have a consumer.
+func (r Report) ConsumedReplicationSlots() []ReplicationSlot {
+	var slots []ReplicationSlot
+	for _, slot := range r.ReplicationSlots {
+		if slot.HasConsumer() {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// CustomQueryActive reports whether the custom activity query, if any, found
+// activity.
+func (r Report) CustomQueryActive() bool {
+	return r.CustomQuery != nil && r.CustomQuery.Active()
+}
+
+// SocketsActive reports whether the socket inspection, if enabled, found
+// connections being established.
+func (r Report) SocketsActive() bool {
+	return r.Sockets != nil && r.Sockets.Active()
+}
+
+// Held reports whether an application holds the cluster awake.
+func (r Report) Held() bool {
+	return len(r.Holds) > 0
+}
+
+// InMaintenance reports whether any maintenance operation is in progress.
+func (r Report) InMaintenance() bool {
+	return len(r.Maintenance) > 0
+}
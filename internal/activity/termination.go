@@ -0,0 +1,50 @@
+package activity
+
+import (
+	"slices"
+	"time"
+)
+
+// TerminationRequest asks a sidecar to terminate the client sessions that have
+// been idle, or idle in transaction, for at least IdleSeconds. It is sent as
+// the body of POST /terminate.
+type TerminationRequest struct {
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// TerminationResult lists the sessions a sidecar terminated.
+type TerminationResult struct {
+	Sessions []TerminatedSession `json:"sessions"`
+}
+
+// TerminatedSession describes one terminated session.
+type TerminatedSession struct {
+	PID             int       `json:"pid"`
+	Database        string    `json:"database"`
+	User            string    `json:"user"`
+	ApplicationName string    `json:"application_name"`
+	State           string    `json:"state"`
+	StateChange     time.Time `json:"state_change"`
+}
+
+// IdleSessionStates are the session states that may be terminated.
+var IdleSessionStates = []string{"idle", "idle in transaction"}
+
+// OnlyIdleSessions reports whether every counted session had been idle, or
+// idle in transaction, for at least idleFor when the report was generated.
+// Reports without a session breakdown never qualify.
+func (r Report) OnlyIdleSessions(idleFor time.Duration) bool {
+	if r.GeneratedAt.IsZero() {
+		return false
+	}
+	count := 0
+	for _, group := range r.Sessions {
+		if !slices.Contains(IdleSessionStates, group.State) ||
+			group.LastStateChange == nil ||
+			r.GeneratedAt.Sub(*group.LastStateChange) < idleFor {
+			return false
+		}
+		count += group.Count
+	}
+	return count == r.Connections
+}
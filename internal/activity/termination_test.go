@@ -0,0 +1,60 @@
+package activity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportOnlyIdleSessions(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	stale := now.Add(-2 * time.Hour)
+	recent := now.Add(-time.Minute)
+	tests := []struct {
+		name   string
+		report Report
+		want   bool
+	}{
+		{
+			name: "stale idle sessions",
+			report: Report{Connections: 3, GeneratedAt: now, Sessions: []SessionGroup{
+				{State: "idle", Count: 2, LastStateChange: &stale},
+				{State: "idle in transaction", Count: 1, LastStateChange: &stale},
+			}},
+			want: true,
+		},
+		{
+			name: "recent idle session",
+			report: Report{Connections: 2, GeneratedAt: now, Sessions: []SessionGroup{
+				{State: "idle", Count: 1, LastStateChange: &stale},
+				{State: "idle", Count: 1, LastStateChange: &recent},
+			}},
+		},
+		{
+			name: "active session",
+			report: Report{Connections: 1, GeneratedAt: now, Sessions: []SessionGroup{
+				{State: "active", Count: 1, LastStateChange: &stale},
+			}},
+		},
+		{
+			name:   "legacy report",
+			report: Report{Connections: 1, GeneratedAt: now},
+		},
+		{
+			name: "unknown state change",
+			report: Report{Connections: 1, GeneratedAt: now, Sessions: []SessionGroup{
+				{State: "idle", Count: 1},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, tt.report.OnlyIdleSessions(time.Hour))
+		})
+	}
+}
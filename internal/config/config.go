@@ -7,6 +7,8 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 )
 
 // Config holds the configuration for the scale-to-zero plugin
@@ -17,7 +19,25 @@ type Config struct {
 	MetricsAddress string
 	// SidecarResources defines resource requirements for the sidecar container
 	SidecarResources *ResourceConfig
-	Scraper          ScraperConfig
+	// Sidecar holds the settings passed to every injected sidecar
+	Sidecar SidecarConfig
+	Scraper ScraperConfig
+}
+
+// SidecarConfig defines the runtime settings of the injected sidecar
+type SidecarConfig struct {
+	// SampleInterval is how often the sidecar samples PostgreSQL activity
+	SampleInterval time.Duration
+	// Exclusions apply to every cluster, in addition to the cluster's own
+	// exclusion annotations
+	Exclusions activity.Exclusions
+	// ActivityQueryTimeout is the statement timeout of custom activity queries
+	ActivityQueryTimeout time.Duration
+	// ActivitySources lists the sidecar activity sources enabled on clusters
+	// that do not choose their own. Empty enables all of them.
+	ActivitySources []string
+	TLS             TLSConfig
+	Push            PushConfig
 }
 
 type ScraperConfig struct {
@@ -25,6 +45,62 @@ type ScraperConfig struct {
 	Timeout           time.Duration
 	Concurrency       int
 	SidecarScrapePort int32
+	TLS               TLSConfig
+	Push              PushConfig
+	LeaderElection    LeaderElectionConfig
+	Sharding          ShardingConfig
+}
+
+// LeaderElectionConfig defines how plugin replicas elect the one running the
+// scraper. The gRPC server runs on every replica regardless.
+type LeaderElectionConfig struct {
+	Enabled bool
+	// Namespace holds the election Lease. It defaults to the namespace of the
+	// plugin when running in a cluster.
+	Namespace string
+}
+
+// ShardingConfig defines the partitioning of the clusters between the plugin
+// replicas, which replaces leader election when enabled.
+type ShardingConfig struct {
+	Enabled bool
+	// Namespace holds the member Leases of the replicas.
+	Namespace string
+	// Identity names this replica among the members.
+	Identity string
+}
+
+// TLSConfig defines the mutual TLS between the scraper and the sidecars. It
+// is disabled unless SidecarSecret is set.
+type TLSConfig struct {
+	// SidecarSecret is the name of the kubernetes.io/tls Secret, with a
+	// ca.crt key, mounted into the sidecars. It must exist in the namespace
+	// of every cluster.
+	SidecarSecret string
+	// ScraperCertDir is the directory of the scraper's client certificate,
+	// in the same layout.
+	ScraperCertDir string
+	// ServerName is the DNS name the scraper expects in sidecar certificates.
+	ServerName string
+	// SidecarHealthPort serves the sidecar probes in plain HTTP, because the
+	// kubelet cannot present a client certificate.
+	SidecarHealthPort int32
+}
+
+// PushConfig defines the push mode, where the sidecars push their activity
+// reports to the plugin instead of being polled. It is disabled unless URL is
+// set.
+type PushConfig struct {
+	// URL is the ingestion endpoint the sidecars push to, usually on the
+	// plugin Service.
+	URL string
+	// ListenAddress serves the ingestion endpoint on the plugin.
+	ListenAddress string
+	// Secret derives the key each cluster's sidecars sign their reports with.
+	Secret string
+	// Interval is how often the sidecars push. It defaults to the scraper
+	// interval.
+	Interval time.Duration
 }
 
 // ResourceConfig defines resource configuration for a container
@@ -43,37 +119,95 @@ const (
 	defaultCPULimit       = "200m"
 	// for memory the request and limit are set to the same value to prevent OOM
 	// issues
-	defaultMemoryRequest = "64Mi"
-	defaultMemoryLimit   = "64Mi"
-	defaultInterval      = 60 * time.Second
-	defaultTimeout       = 2 * time.Second
-	defaultConcurrency   = 200
-	defaultScrapePort    = int32(9188)
+	defaultMemoryRequest  = "64Mi"
+	defaultMemoryLimit    = "64Mi"
+	defaultInterval       = 60 * time.Second
+	defaultTimeout        = 2 * time.Second
+	defaultConcurrency    = 200
+	defaultScrapePort     = int32(9188)
+	defaultSampleInterval = 5 * time.Second
+
+	defaultActivityQueryTimeout = time.Second
+
+	defaultScraperCertDir    = "/etc/scale-to-zero/scraper-tls"
+	defaultTLSServerName     = "scale-to-zero-sidecar"
+	defaultSidecarHealthPort = int32(9189)
+
+	defaultPushListenAddress = ":9190"
+
+	defaultLeaderElection = true
 )
 
-// New creates a new Config instance with the provided parameters.
-// Environment variables are used to override defaults if the parameters are empty.
-func New(sidecarImage, logLevel, metricsAddress string, resourceConfig *ResourceConfig, scraperConfig ScraperConfig) *Config {
-	if sidecarImage == "" {
-		sidecarImage = defaultSidecarImage
+// Options holds the settings a Config is built from. Empty values take their
+// defaults, and the TLS and push settings are shared by the sidecar and the
+// scraper.
+type Options struct {
+	SidecarImage     string
+	LogLevel         string
+	MetricsAddress   string
+	SidecarResources *ResourceConfig
+	Sidecar          SidecarConfig
+	Scraper          ScraperConfig
+	TLS              TLSConfig
+	Push             PushConfig
+	LeaderElection   LeaderElectionConfig
+	Sharding         ShardingConfig
+}
+
+// New creates a new Config instance from opts, applying the defaults of the
+// settings left empty.
+func New(opts Options) *Config {
+	if opts.SidecarImage == "" {
+		opts.SidecarImage = defaultSidecarImage
 	}
 
-	if logLevel == "" {
-		logLevel = defaultLogLevel
+	if opts.LogLevel == "" {
+		opts.LogLevel = defaultLogLevel
 	}
-	if metricsAddress == "" {
-		metricsAddress = defaultMetricsAddress
+	if opts.MetricsAddress == "" {
+		opts.MetricsAddress = defaultMetricsAddress
 	}
 
+	sidecarConfig, scraperConfig := opts.Sidecar, opts.Scraper
+	sidecarConfig.TLS = opts.TLS.WithDefaults()
+	scraperConfig.TLS = opts.TLS.WithDefaults()
+	if opts.Push.Interval <= 0 {
+		opts.Push.Interval = scraperConfig.WithDefaults().Interval
+	}
+	sidecarConfig.Push = opts.Push.WithDefaults()
+	scraperConfig.Push = opts.Push.WithDefaults()
+	scraperConfig.LeaderElection = opts.LeaderElection
+	scraperConfig.Sharding = opts.Sharding
+
 	return &Config{
-		SidecarImage:     sidecarImage,
-		LogLevel:         logLevel,
-		MetricsAddress:   metricsAddress,
-		SidecarResources: resourceConfig,
+		SidecarImage:     opts.SidecarImage,
+		LogLevel:         opts.LogLevel,
+		MetricsAddress:   opts.MetricsAddress,
+		SidecarResources: opts.SidecarResources,
+		Sidecar:          sidecarConfig.WithDefaults(),
 		Scraper:          scraperConfig.WithDefaults(),
 	}
 }
 
+func NewSidecarConfig(sampleInterval, activityQueryTimeout string, exclusions activity.Exclusions, activitySources []string) SidecarConfig {
+	return SidecarConfig{
+		SampleInterval:       parseDuration(sampleInterval, defaultSampleInterval),
+		Exclusions:           exclusions,
+		ActivityQueryTimeout: parseDuration(activityQueryTimeout, defaultActivityQueryTimeout),
+		ActivitySources:      activitySources,
+	}.WithDefaults()
+}
+
+func (cfg SidecarConfig) WithDefaults() SidecarConfig {
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = defaultSampleInterval
+	}
+	if cfg.ActivityQueryTimeout <= 0 {
+		cfg.ActivityQueryTimeout = defaultActivityQueryTimeout
+	}
+	return cfg
+}
+
 func NewScraperConfig(interval, timeout, concurrency, sidecarScrapePort string) ScraperConfig {
 	return ScraperConfig{
 		Interval:          parseDuration(interval, defaultInterval),
@@ -99,6 +233,78 @@ func (cfg ScraperConfig) WithDefaults() ScraperConfig {
 	return cfg
 }
 
+func NewTLSConfig(sidecarSecret, scraperCertDir, serverName, sidecarHealthPort string) TLSConfig {
+	return TLSConfig{
+		SidecarSecret:     sidecarSecret,
+		ScraperCertDir:    scraperCertDir,
+		ServerName:        serverName,
+		SidecarHealthPort: int32(parseInt(sidecarHealthPort, int(defaultSidecarHealthPort))),
+	}.WithDefaults()
+}
+
+func (cfg TLSConfig) WithDefaults() TLSConfig {
+	if cfg.ScraperCertDir == "" {
+		cfg.ScraperCertDir = defaultScraperCertDir
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = defaultTLSServerName
+	}
+	if cfg.SidecarHealthPort <= 0 {
+		cfg.SidecarHealthPort = defaultSidecarHealthPort
+	}
+	return cfg
+}
+
+// Enabled reports whether the scraper and the sidecars use mutual TLS.
+func (cfg TLSConfig) Enabled() bool {
+	return cfg.SidecarSecret != ""
+}
+
+func NewPushConfig(url, listenAddress, secret, interval string) PushConfig {
+	return PushConfig{
+		URL:           url,
+		ListenAddress: listenAddress,
+		Secret:        secret,
+		Interval:      parseDuration(interval, 0),
+	}
+}
+
+func (cfg PushConfig) WithDefaults() PushConfig {
+	if cfg.ListenAddress == "" {
+		cfg.ListenAddress = defaultPushListenAddress
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	return cfg
+}
+
+// Enabled reports whether the sidecars push their reports.
+func (cfg PushConfig) Enabled() bool {
+	return cfg.URL != ""
+}
+
+// MaxAge is how long a pushed report is used for. A report older than two
+// push intervals means at least one push was missed.
+func (cfg PushConfig) MaxAge() time.Duration {
+	return 2 * cfg.Interval
+}
+
+func NewLeaderElectionConfig(enabled, namespace string) LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Enabled:   parseBool(enabled, defaultLeaderElection),
+		Namespace: namespace,
+	}
+}
+
+func NewShardingConfig(enabled, namespace, identity string) ShardingConfig {
+	return ShardingConfig{
+		Enabled:   parseBool(enabled, false),
+		Namespace: namespace,
+		Identity:  identity,
+	}
+}
+
 // ToResourceRequirements converts the SidecarResourceConfig to Kubernetes
 // ResourceRequirements, applying defaults if necessary.
 // Defaults to 50m CPU request, 200m CPU limit, and 64Mi memory request and memory limit.
@@ -148,3 +354,14 @@ func parseInt(value string, fallback int) int {
 	}
 	return parsed
 }
+
+func parseBool(value string, fallback bool) bool {
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 )
 
 func TestNew(t *testing.T) {
@@ -42,7 +44,7 @@ func TestNew(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			cfg := New(tt.sidecarImage, tt.logLevel, "", tt.resourceConfig, ScraperConfig{})
+			cfg := New(Options{SidecarImage: tt.sidecarImage, LogLevel: tt.logLevel, SidecarResources: tt.resourceConfig})
 			require.Equal(t, tt.expectedSidecarImage, cfg.SidecarImage)
 			require.Equal(t, tt.expectedLogLevel, cfg.LogLevel)
 			require.Equal(t, defaultMetricsAddress, cfg.MetricsAddress)
@@ -51,6 +53,9 @@ func TestNew(t *testing.T) {
 			require.Equal(t, defaultTimeout, cfg.Scraper.Timeout)
 			require.Equal(t, defaultConcurrency, cfg.Scraper.Concurrency)
 			require.Equal(t, defaultScrapePort, cfg.Scraper.SidecarScrapePort)
+			require.Equal(t, defaultSampleInterval, cfg.Sidecar.SampleInterval)
+			require.False(t, cfg.Scraper.TLS.Enabled())
+			require.Equal(t, cfg.Scraper.TLS, cfg.Sidecar.TLS)
 		})
 	}
 }
@@ -71,10 +76,77 @@ func TestNewScraperConfig(t *testing.T) {
 	require.Equal(t, defaultScrapePort, cfg.SidecarScrapePort)
 }
 
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := NewTLSConfig("sidecar-tls", "/tls", "sidecar.example", "9200")
+	require.True(t, cfg.Enabled())
+	require.Equal(t, TLSConfig{SidecarSecret: "sidecar-tls", ScraperCertDir: "/tls", ServerName: "sidecar.example", SidecarHealthPort: 9200}, cfg)
+
+	cfg = NewTLSConfig("", "", "", "invalid")
+	require.False(t, cfg.Enabled())
+	require.Equal(t, defaultScraperCertDir, cfg.ScraperCertDir)
+	require.Equal(t, defaultTLSServerName, cfg.ServerName)
+	require.Equal(t, defaultSidecarHealthPort, cfg.SidecarHealthPort)
+}
+
+func TestNewPushConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := New(Options{
+		Scraper: NewScraperConfig("30s", "", "", ""),
+		Push:    NewPushConfig("http://scale-to-zero.cnpg-system:9190/reports", "", "secret", ""),
+	})
+	require.True(t, cfg.Scraper.Push.Enabled())
+	require.Equal(t, defaultPushListenAddress, cfg.Scraper.Push.ListenAddress)
+	require.Equal(t, 30*time.Second, cfg.Scraper.Push.Interval)
+	require.Equal(t, time.Minute, cfg.Scraper.Push.MaxAge())
+	require.Equal(t, cfg.Scraper.Push, cfg.Sidecar.Push)
+
+	cfg = New(Options{Push: NewPushConfig("", ":9300", "", "10s")})
+	require.False(t, cfg.Scraper.Push.Enabled())
+	require.Equal(t, ":9300", cfg.Scraper.Push.ListenAddress)
+	require.Equal(t, 10*time.Second, cfg.Sidecar.Push.Interval)
+}
+
+func TestNewLeaderElectionConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := New(Options{LeaderElection: NewLeaderElectionConfig("false", "cnpg-system")})
+	require.Equal(t, LeaderElectionConfig{Namespace: "cnpg-system"}, cfg.Scraper.LeaderElection)
+
+	cfg = New(Options{LeaderElection: NewLeaderElectionConfig("invalid", "")})
+	require.True(t, cfg.Scraper.LeaderElection.Enabled)
+}
+
+func TestNewShardingConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := New(Options{Sharding: NewShardingConfig("true", "cnpg-system", "scale-to-zero-0")})
+	require.Equal(t, ShardingConfig{Enabled: true, Namespace: "cnpg-system", Identity: "scale-to-zero-0"}, cfg.Scraper.Sharding)
+
+	require.False(t, NewShardingConfig("", "", "").Enabled)
+}
+
+func TestNewSidecarConfig(t *testing.T) {
+	t.Parallel()
+
+	exclusions := activity.Exclusions{Users: []string{"monitoring"}}
+	cfg := NewSidecarConfig("10s", "500ms", exclusions, []string{"connections", "counters"})
+	require.Equal(t, 10*time.Second, cfg.SampleInterval)
+	require.Equal(t, 500*time.Millisecond, cfg.ActivityQueryTimeout)
+	require.Equal(t, exclusions, cfg.Exclusions)
+	require.Equal(t, []string{"connections", "counters"}, cfg.ActivitySources)
+
+	cfg = NewSidecarConfig("invalid", "", activity.Exclusions{}, nil)
+	require.Equal(t, defaultSampleInterval, cfg.SampleInterval)
+	require.Equal(t, defaultActivityQueryTimeout, cfg.ActivityQueryTimeout)
+}
+
 func TestNewMetricsAddress(t *testing.T) {
 	t.Parallel()
 
-	cfg := New("", "", ":9091", nil, ScraperConfig{})
+	cfg := New(Options{MetricsAddress: ":9091"})
 	require.Equal(t, ":9091", cfg.MetricsAddress)
 }
 
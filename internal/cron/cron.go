@@ -0,0 +1,223 @@
+// Package cron interprets pg_cron job schedules.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoRun is returned for schedules that never run at a predictable time,
+// such as @reboot.
+var ErrNoRun = errors.New("schedule has no next run")
+
+// searchLimit bounds the search for the next run, so schedules that can never
+// match, such as 30 February, end.
+const searchLimit = 5 * 366 * 24 * time.Hour
+
+// Schedule is a parsed pg_cron schedule.
+type Schedule struct {
+	// interval is set for the "N seconds" syntax.
+	interval time.Duration
+	reboot   bool
+
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// lastDay is set when the day of month field contains $.
+	lastDay bool
+	// Vixie cron runs a job when either the day of month or the day of week
+	// matches if both are restricted, and when both match otherwise.
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField  = field{min: 0, max: 59}
+	hourField    = field{min: 0, max: 23}
+	dayField     = field{min: 1, max: 31}
+	monthField   = field{min: 1, max: 12, names: names(1, "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec")}
+	weekdayField = field{min: 0, max: 7, names: names(0, "sun", "mon", "tue", "wed", "thu", "fri", "sat")}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a schedule in the syntax accepted by pg_cron: five cron fields
+// with names, ranges, lists, steps and $ for the last day of the month, the
+// @ macros, or an interval of 1 to 59 seconds.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "@reboot" {
+		return Schedule{reboot: true}, nil
+	}
+	if expanded, ok := macros[spec]; ok {
+		spec = expanded
+	}
+	if value, ok := strings.CutSuffix(spec, "seconds"); ok {
+		return parseInterval(spec, strings.TrimSpace(value))
+	}
+	if value, ok := strings.CutSuffix(spec, "second"); ok {
+		return parseInterval(spec, strings.TrimSpace(value))
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("schedule %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	var s Schedule
+	if err := minuteField.parse(fields[0], s.minutes[:]); err != nil {
+		return Schedule{}, fmt.Errorf("schedule %q: minute: %w", spec, err)
+	}
+	if err := hourField.parse(fields[1], s.hours[:]); err != nil {
+		return Schedule{}, fmt.Errorf("schedule %q: hour: %w", spec, err)
+	}
+	days := fields[2]
+	if strings.Contains(days, "$") {
+		s.lastDay = true
+		days = strings.Trim(strings.ReplaceAll(strings.ReplaceAll(days, "$", ""), ",,", ","), ",")
+	}
+	if days != "" {
+		if err := dayField.parse(days, s.days[:]); err != nil {
+			return Schedule{}, fmt.Errorf("schedule %q: day of month: %w", spec, err)
+		}
+	}
+	if err := monthField.parse(fields[3], s.months[:]); err != nil {
+		return Schedule{}, fmt.Errorf("schedule %q: month: %w", spec, err)
+	}
+	weekdays := make([]bool, 8)
+	if err := weekdayField.parse(fields[4], weekdays); err != nil {
+		return Schedule{}, fmt.Errorf("schedule %q: day of week: %w", spec, err)
+	}
+	// Both 0 and 7 are Sunday.
+	copy(s.weekdays[:], weekdays)
+	s.weekdays[0] = s.weekdays[0] || weekdays[7]
+	s.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	s.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return s, nil
+}
+
+func parseInterval(spec, value string) (Schedule, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 1 || seconds > 59 {
+		return Schedule{}, fmt.Errorf("schedule %q: interval must be between 1 and 59 seconds", spec)
+	}
+	return Schedule{interval: time.Duration(seconds) * time.Second}, nil
+}
+
+// Next returns the first run strictly after the given time, in the given
+// location. It returns ErrNoRun when there is none.
+func (s Schedule) Next(after time.Time, location *time.Location) (time.Time, error) {
+	if s.reboot {
+		return time.Time{}, ErrNoRun
+	}
+	if s.interval > 0 {
+		return after.Add(s.interval), nil
+	}
+
+	t := after.In(location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(searchLimit)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case !s.months[month]:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		case !s.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+		case !s.hours[t.Hour()]:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, location)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrNoRun
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	day := s.days[t.Day()] || (s.lastDay && t.AddDate(0, 0, 1).Day() == 1)
+	weekday := s.weekdays[t.Weekday()]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// parse sets the values of a comma-separated list of values, ranges and steps.
+func (f field) parse(value string, set []bool) error {
+	for item := range strings.SplitSeq(value, ",") {
+		rangeValue, stepValue, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepValue)
+			if err != nil || parsed < 1 {
+				return fmt.Errorf("invalid step %q", item)
+			}
+			step = parsed
+		}
+
+		first, last := f.min, f.max
+		if rangeValue != "*" {
+			lowValue, highValue, isRange := strings.Cut(rangeValue, "-")
+			low, err := f.value(lowValue)
+			if err != nil {
+				return err
+			}
+			first, last = low, low
+			if isRange {
+				if last, err = f.value(highValue); err != nil {
+					return err
+				}
+			} else if hasStep {
+				last = f.max
+			}
+			if first > last {
+				return fmt.Errorf("invalid range %q", item)
+			}
+		}
+
+		for i := first; i <= last; i += step {
+			set[i] = true
+		}
+	}
+	return nil
+}
+
+func (f field) value(value string) (int, error) {
+	if number, ok := f.names[value]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < f.min || number > f.max {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return number, nil
+}
+
+// names numbers the given names from first.
+func names(first int, values ...string) map[string]int {
+	result := make(map[string]int, len(values))
+	for i, value := range values {
+		result[value] = first + i
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleNext(t *testing.T) {
+	t.Parallel()
+
+	// A Wednesday.
+	after := time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		expected time.Time
+	}{
+		{name: "every minute", spec: "* * * * *", expected: time.Date(2025, 1, 15, 10, 21, 0, 0, time.UTC)},
+		{name: "nightly", spec: "0 3 * * *", expected: time.Date(2025, 1, 16, 3, 0, 0, 0, time.UTC)},
+		{name: "later today", spec: "30 10 * * *", expected: time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{name: "steps", spec: "*/15 * * * *", expected: time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{name: "step from value", spec: "5/20 * * * *", expected: time.Date(2025, 1, 15, 10, 25, 0, 0, time.UTC)},
+		{name: "lists and ranges", spec: "0 8-9,22 * * *", expected: time.Date(2025, 1, 15, 22, 0, 0, 0, time.UTC)},
+		{name: "weekday names", spec: "0 0 * * sat,sun", expected: time.Date(2025, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{name: "sunday as 7", spec: "0 0 * * 7", expected: time.Date(2025, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{name: "month names", spec: "0 0 1 mar *", expected: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month or week", spec: "0 0 20 * mon", expected: time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{name: "last day of month", spec: "0 12 $ * *", expected: time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)},
+		{name: "last day of february", spec: "0 12 $ feb *", expected: time.Date(2025, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{name: "leap day", spec: "0 0 29 2 *", expected: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "macro", spec: "@daily", expected: time.Date(2025, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{name: "interval", spec: "30 seconds", expected: after.Add(30 * time.Second)},
+		{name: "time zone", spec: "0 3 * * *", location: newYork, expected: time.Date(2025, 1, 16, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			schedule, err := Parse(tt.spec)
+			require.NoError(t, err)
+			location := tt.location
+			if location == nil {
+				location = time.UTC
+			}
+
+			next, err := schedule.Next(after, location)
+			require.NoError(t, err)
+			require.True(t, tt.expected.Equal(next), "expected %s, got %s", tt.expected, next)
+		})
+	}
+}
+
+func TestScheduleWithoutNextRun(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{"@reboot", "0 0 30 2 *"} {
+		schedule, err := Parse(spec)
+		require.NoError(t, err)
+
+		_, err = schedule.Next(time.Now(), time.UTC)
+		require.ErrorIs(t, err, ErrNoRun, spec)
+	}
+}
+
+func TestParseRejectsInvalidSchedules(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"10-5 * * * *",
+		"*/0 * * * *",
+		"0 seconds",
+		"60 seconds",
+		"@sometimes",
+	} {
+		_, err := Parse(spec)
+		require.Error(t, err, spec)
+	}
+}
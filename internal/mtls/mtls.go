@@ -0,0 +1,138 @@
+// Package mtls configures the mutual TLS between the central scraper and the
+// sidecars, with certificates read from files that are reloaded when they
+// change, such as a mounted Secret renewed by cert-manager.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Names of the files in a kubernetes.io/tls Secret issued by cert-manager.
+const (
+	CertificateFile = "tls.crt"
+	KeyFile         = "tls.key"
+	CAFile          = "ca.crt"
+)
+
+// Files holds a certificate, its key and the CA bundle used to verify peers.
+// The files are read again when any of them changes, so a renewed Secret is
+// picked up by the next handshake without a restart.
+type Files struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu          sync.Mutex
+	modified    [3]time.Time
+	certificate *tls.Certificate
+	pool        *x509.CertPool
+}
+
+// NewFiles returns the files of a Secret mounted in dir.
+func NewFiles(dir string) *Files {
+	return &Files{
+		certFile: filepath.Join(dir, CertificateFile),
+		keyFile:  filepath.Join(dir, KeyFile),
+		caFile:   filepath.Join(dir, CAFile),
+	}
+}
+
+// Load returns the current certificate and CA pool, reading the files again
+// when they changed since the previous call.
+func (f *Files) Load() (*tls.Certificate, *x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var modified [3]time.Time
+	for i, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		modified[i] = info.ModTime()
+	}
+	if f.certificate != nil && modified == f.modified {
+		return f.certificate, f.pool, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load certificate: %w", err)
+	}
+	ca, err := os.ReadFile(f.caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, nil, fmt.Errorf("no certificate found in %s", f.caFile)
+	}
+
+	f.certificate, f.pool, f.modified = &certificate, pool, modified
+	return f.certificate, f.pool, nil
+}
+
+// ServerConfig returns the TLS configuration of a server presenting the
+// certificate of files. Client certificates are verified against the CA
+// bundle when presented, and handlers decide whether they are required, so
+// probes that cannot present one still reach the health endpoints.
+func ServerConfig(files *Files) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, pool, err := files.Load()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*certificate},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration of a client presenting the
+// certificate of files. Servers are verified against the CA bundle for
+// serverName rather than the dialed address, because sidecars are reached
+// by pod IP.
+func ClientConfig(files *Files, serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _, err := files.Load()
+			return certificate, err
+		},
+		// The standard verification cannot follow a reloaded CA bundle, so
+		// VerifyConnection replaces it.
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool, err := files.Load()
+			if err != nil {
+				return err
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, certificate := range state.PeerCertificates[1:] {
+				intermediates.AddCert(certificate)
+			}
+			_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         pool,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
@@ -0,0 +1,236 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const serverName = "scale-to-zero-sidecar"
+
+func TestMutualTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name              string
+		serverName        string
+		clientCertificate bool
+		clientCA          bool
+		wantErr           bool
+		wantVerified      bool
+	}{
+		{
+			name:              "verified client",
+			serverName:        serverName,
+			clientCertificate: true,
+			wantVerified:      true,
+		},
+		{
+			name:       "client without certificate",
+			serverName: serverName,
+		},
+		{
+			name:              "unexpected server name",
+			serverName:        "other",
+			clientCertificate: true,
+			wantErr:           true,
+		},
+		{
+			name:              "untrusted server",
+			serverName:        serverName,
+			clientCertificate: true,
+			clientCA:          true,
+			wantErr:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ca := newCA(t)
+			serverDir := writeFiles(t, ca, ca.issue(t, serverName, x509.ExtKeyUsageServerAuth))
+			server := newServer(t, serverDir)
+
+			clientCA := ca
+			if tt.clientCA {
+				clientCA = newCA(t)
+			}
+			client := &http.Client{}
+			if tt.clientCertificate {
+				clientDir := writeFiles(t, clientCA, ca.issue(t, "scraper", x509.ExtKeyUsageClientAuth))
+				client.Transport = &http.Transport{TLSClientConfig: ClientConfig(NewFiles(clientDir), tt.serverName)}
+			} else {
+				client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool(), ServerName: tt.serverName}}
+			}
+
+			verified, err := get(client, server.URL)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantVerified, verified)
+		})
+	}
+}
+
+func TestFilesReload(t *testing.T) {
+	t.Parallel()
+
+	ca := newCA(t)
+	serverDir := writeFiles(t, ca, ca.issue(t, serverName, x509.ExtKeyUsageServerAuth))
+	clientDir := writeFiles(t, ca, ca.issue(t, "scraper", x509.ExtKeyUsageClientAuth))
+	server := newServer(t, serverDir)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   ClientConfig(NewFiles(clientDir), serverName),
+		DisableKeepAlives: true,
+	}}
+
+	verified, err := get(client, server.URL)
+	require.NoError(t, err)
+	require.True(t, verified)
+
+	// Both sides move to certificates of a new CA, as after a CA rotation.
+	rotated := newCA(t)
+	rewriteFiles(t, serverDir, rotated, rotated.issue(t, serverName, x509.ExtKeyUsageServerAuth))
+	rewriteFiles(t, clientDir, rotated, rotated.issue(t, "scraper", x509.ExtKeyUsageClientAuth))
+
+	verified, err = get(client, server.URL)
+	require.NoError(t, err)
+	require.True(t, verified)
+}
+
+func TestFilesMissing(t *testing.T) {
+	t.Parallel()
+
+	_, _, err := NewFiles(t.TempDir()).Load()
+	require.Error(t, err)
+}
+
+func newServer(t *testing.T, dir string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	server.TLS = ServerConfig(NewFiles(dir))
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get reports whether the server verified the client certificate.
+func get(client *http.Client, url string) (bool, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	return response.StatusCode == http.StatusOK, nil
+}
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+// issue returns the PEM certificate and key of a leaf certificate.
+func (ca testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) [2][]byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return [2][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFiles(t *testing.T, ca testCA, leaf [2][]byte) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	rewriteFiles(t, dir, ca, leaf)
+	return dir
+}
+
+// rewriteFiles writes the files one second after their previous version, so
+// a rewrite within the timestamp resolution is still noticed.
+func rewriteFiles(t *testing.T, dir string, ca testCA, leaf [2][]byte) {
+	t.Helper()
+
+	for name, content := range map[string][]byte{CertificateFile: leaf[0], KeyFile: leaf[1], CAFile: ca.pem} {
+		path := filepath.Join(dir, name)
+		modified := time.Now()
+		if info, err := os.Stat(path); err == nil {
+			modified = info.ModTime().Add(time.Second)
+		}
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+		require.NoError(t, os.Chtimes(path, modified, modified))
+	}
+}
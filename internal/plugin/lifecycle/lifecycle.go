@@ -2,23 +2,56 @@
 package lifecycle
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	cnpgv1 "github.com/cloudnative-pg/api/pkg/api/v1"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper/decoder"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper/object"
 	"github.com/cloudnative-pg/cnpg-i/pkg/lifecycle"
 	"github.com/cloudnative-pg/machinery/pkg/log"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
 )
 
+// defaultApplicationDatabase is the database CNPG creates when the cluster
+// does not name one.
+const defaultApplicationDatabase = "app"
+
+// applicationSecretSuffix names the Secret CNPG creates with the credentials
+// of the application database owner, when the cluster does not name one.
+const applicationSecretSuffix = "-app"
+
+// pushSecretSuffix names the Secret holding the key a cluster's sidecars sign
+// their pushed reports with, under pushSecretKey.
+const (
+	pushSecretSuffix = "-scale-to-zero-push"
+	pushSecretKey    = "key"
+)
+
+const (
+	sidecarTLSVolume = "scale-to-zero-tls"
+	sidecarTLSPath   = "/etc/scale-to-zero/tls"
+)
+
 // Implementation is the implementation of the lifecycle handler
 type Implementation struct {
 	lifecycle.UnimplementedOperatorLifecycleServer
@@ -26,15 +59,20 @@ type Implementation struct {
 	sidecarImage     string
 	sidecarResources corev1.ResourceRequirements
 	sidecarPort      int32
+	sidecarConfig    config.SidecarConfig
+	client           client.Client
 }
 
-// NewImplementation creates a new lifecycle implementation with the given config
-func NewImplementation(cfg *config.Config) *Implementation {
+// NewImplementation creates a new lifecycle implementation with the given
+// config. The client writes the push key Secrets in push mode.
+func NewImplementation(cfg *config.Config, kubeClient client.Client) *Implementation {
 	return &Implementation{
 		logLevel:         cfg.LogLevel,
 		sidecarImage:     cfg.SidecarImage,
 		sidecarResources: cfg.SidecarResources.ToResourceRequirements(),
 		sidecarPort:      cfg.Scraper.SidecarScrapePort,
+		sidecarConfig:    cfg.Sidecar,
+		client:           kubeClient,
 	}
 }
 
@@ -133,11 +171,54 @@ func (impl Implementation) reconcileMetadata(
 				Name:  "LISTEN_ADDRESS",
 				Value: fmt.Sprintf(":%d", impl.sidecarPort),
 			},
+			{
+				Name:  "SAMPLE_INTERVAL",
+				Value: impl.sidecarConfig.SampleInterval.String(),
+			},
 		},
-		VolumeMounts: []corev1.VolumeMount{scratchDataMount},
-		Resources:    impl.sidecarResources,
+		VolumeMounts:  []corev1.VolumeMount{scratchDataMount},
+		Resources:     impl.sidecarResources,
+		LivenessProbe: sidecarProbe("/healthz", impl.sidecarPort),
+	}
+	sidecarContainer.Env = append(sidecarContainer.Env, exclusionEnv(impl.sidecarConfig.Exclusions.Merge(clusterExclusions(cluster.Annotations)))...)
+	if timeout := idleSessionTimeout(cluster.Annotations); timeout > 0 {
+		sidecarContainer.Env = append(sidecarContainer.Env, corev1.EnvVar{
+			Name:  "IDLE_SESSION_TIMEOUT",
+			Value: timeout.String(),
+		})
+	}
+	if idleFor := terminateIdleAfter(cluster.Annotations); idleFor > 0 {
+		sidecarContainer.Env = append(sidecarContainer.Env, corev1.EnvVar{
+			Name:  "TERMINATE_IDLE_AFTER",
+			Value: idleFor.String(),
+		})
+	}
+	if sources := activitySources(cluster.Annotations, impl.sidecarConfig.ActivitySources); len(sources) > 0 {
+		sidecarContainer.Env = append(sidecarContainer.Env, corev1.EnvVar{
+			Name:  "ACTIVITY_SOURCES",
+			Value: strings.Join(sources, ","),
+		})
+	}
+	sidecarContainer.Env = append(sidecarContainer.Env, corev1.EnvVar{
+		Name:  "HOLD_DATABASE",
+		Value: holdDatabase(cluster),
+	})
+	sidecarContainer.Env = append(sidecarContainer.Env, applicationEnv(cluster)...)
+	activityQueryEnv, err := impl.activityQueryEnv(cluster)
+	if err != nil {
+		return nil, err
 	}
+	sidecarContainer.Env = append(sidecarContainer.Env, activityQueryEnv...)
 	sidecarContainer.Env = append(sidecarContainer.Env, postgresEnv...)
+	if impl.sidecarConfig.TLS.Enabled() {
+		impl.injectTLS(mutatedPod, sidecarContainer)
+	}
+	if impl.sidecarConfig.Push.Enabled() {
+		if err := impl.ensurePushSecret(ctx, cluster); err != nil {
+			return nil, err
+		}
+		sidecarContainer.Env = append(sidecarContainer.Env, impl.pushEnv(cluster)...)
+	}
 
 	if mutatedPod.Labels == nil {
 		mutatedPod.Labels = make(map[string]string)
@@ -212,6 +293,317 @@ func postgresRuntime(pod *corev1.Pod) ([]corev1.EnvVar, corev1.VolumeMount, erro
 	return nil, corev1.VolumeMount{}, errors.New("CNPG PostgreSQL runtime environment not found")
 }
 
+// clusterExclusions reads the exclusion annotations of a cluster.
+func clusterExclusions(annotations map[string]string) activity.Exclusions {
+	return activity.Exclusions{
+		Users:            activity.ParseList(annotations[scaletozero.ExcludeUsersAnnotation]),
+		Databases:        activity.ParseList(annotations[scaletozero.ExcludeDatabasesAnnotation]),
+		ApplicationNames: activity.ParseList(annotations[scaletozero.ExcludeApplicationNamesAnnotation]),
+		ClientCIDRs:      activity.ParseList(annotations[scaletozero.ExcludeClientCIDRsAnnotation]),
+		BackendTypes:     activity.ParseList(annotations[scaletozero.ExcludeBackendTypesAnnotation]),
+	}
+}
+
+// idleSessionTimeout reads the idle session threshold of a cluster. Missing,
+// invalid and non-positive values disable it.
+func idleSessionTimeout(annotations map[string]string) time.Duration {
+	minutes, err := strconv.Atoi(annotations[scaletozero.IdleSessionAnnotation])
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// terminateIdleAfter returns how long sessions must have been idle before the
+// sidecar agrees to terminate them, from the cluster's opt-in annotation. Zero
+// when the cluster has not opted in.
+func terminateIdleAfter(annotations map[string]string) time.Duration {
+	minutes, err := strconv.Atoi(annotations[scaletozero.TerminateIdleAnnotation])
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// activitySources returns the sidecar activity sources enabled for a cluster.
+// The cluster annotation replaces the plugin default rather than adding to it,
+// so a cluster can disable sources. Empty enables every source.
+func activitySources(annotations map[string]string, defaults []string) []string {
+	if sources := activity.ParseList(annotations[scaletozero.ActivitySourcesAnnotation]); len(sources) > 0 {
+		return sources
+	}
+	return defaults
+}
+
+// activityQueryEnv passes the custom activity query of a cluster to the
+// sidecar. The query is read from the ConfigMap when the container starts. A
+// missing ConfigMap or key must not prevent PostgreSQL from starting, so the
+// reference is optional and the sidecar reports the missing query instead.
+// Anyone able to edit the ConfigMap chooses the SQL, so it runs as the owner
+// of the application database, whose credentials come from its Secret, and
+// not as the postgres superuser.
+func (impl Implementation) activityQueryEnv(cluster *cnpgv1.Cluster) ([]corev1.EnvVar, error) {
+	reference := strings.TrimSpace(cluster.Annotations[scaletozero.ActivityQueryAnnotation])
+	if reference == "" {
+		return nil, nil
+	}
+	configMap, key, found := strings.Cut(reference, "/")
+	if !found || configMap == "" || key == "" {
+		return nil, fmt.Errorf("%s must reference a ConfigMap key as <configmap>/<key>, got %q",
+			scaletozero.ActivityQueryAnnotation, reference)
+	}
+
+	database := cluster.Annotations[scaletozero.ActivityQueryDatabaseAnnotation]
+	if database == "" {
+		database = applicationDatabase(cluster)
+	}
+
+	return []corev1.EnvVar{
+		{
+			Name:  "ACTIVITY_QUERY_NAME",
+			Value: reference,
+		},
+		{
+			Name: "ACTIVITY_QUERY",
+			ValueFrom: &corev1.EnvVarSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+					Key:                  key,
+					Optional:             ptr.To(true),
+				},
+			},
+		},
+		{
+			Name:  "ACTIVITY_QUERY_DATABASE",
+			Value: database,
+		},
+		{
+			Name:  "ACTIVITY_QUERY_TIMEOUT",
+			Value: impl.sidecarConfig.ActivityQueryTimeout.String(),
+		},
+	}, nil
+}
+
+// applicationEnv passes the credentials of the application database owner,
+// which the sidecar uses to read the hold table and run the custom activity
+// query. Both are controlled by the application and must never be read as the
+// postgres user.
+func applicationEnv(cluster *cnpgv1.Cluster) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name:      "APPLICATION_USER",
+			ValueFrom: optionalSecretKeyRef(applicationSecretName(cluster), "username"),
+		},
+		{
+			Name:      "APPLICATION_PASSWORD",
+			ValueFrom: optionalSecretKeyRef(applicationSecretName(cluster), "password"),
+		},
+	}
+}
+
+func optionalSecretKeyRef(name, key string) *corev1.EnvVarSource {
+	return &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+			Optional:             ptr.To(true),
+		},
+	}
+}
+
+// sidecarProbe returns an HTTP probe of the sidecar. The sidecar has no
+// readiness probe, since its /readyz follows PostgreSQL, whose own probes
+// decide whether the instance is ready.
+func sidecarProbe(path string, port int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt32(port),
+				Scheme: corev1.URISchemeHTTP,
+			},
+		},
+		PeriodSeconds:    10,
+		TimeoutSeconds:   5,
+		FailureThreshold: 3,
+	}
+}
+
+// injectTLS mounts the sidecar certificate Secret and moves the probes to the
+// plain HTTP health port. The Secret is optional so a missing one does not
+// keep PostgreSQL from starting; the sidecar then fails its TLS handshakes and
+// the cluster stays awake. Secret volumes without subPath follow renewals, and
+// the sidecar reads the files again when they change.
+func (impl Implementation) injectTLS(pod *corev1.Pod, container *corev1.Container) {
+	tls := impl.sidecarConfig.TLS
+	if !slices.ContainsFunc(pod.Spec.Volumes, func(volume corev1.Volume) bool {
+		return volume.Name == sidecarTLSVolume
+	}) {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: sidecarTLSVolume,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: tls.SidecarSecret,
+					Optional:   ptr.To(true),
+				},
+			},
+		})
+	}
+
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      sidecarTLSVolume,
+		MountPath: sidecarTLSPath,
+		ReadOnly:  true,
+	})
+	container.Ports = append(container.Ports, corev1.ContainerPort{
+		Name:          "health",
+		ContainerPort: tls.SidecarHealthPort,
+		Protocol:      corev1.ProtocolTCP,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "TLS_CERT_DIR", Value: sidecarTLSPath},
+		corev1.EnvVar{Name: "HEALTH_LISTEN_ADDRESS", Value: fmt.Sprintf(":%d", tls.SidecarHealthPort)},
+	)
+	container.LivenessProbe = sidecarProbe("/healthz", tls.SidecarHealthPort)
+}
+
+// pushEnv makes the sidecar push its reports, signed with the key of its
+// cluster read from the push Secret. The key is left out of the pod spec,
+// which more users can read than Secrets, since it lets whoever holds it
+// report the cluster as idle. The reference is optional like the others: a
+// sidecar without the key sends reports the plugin rejects, and the cluster
+// stays awake.
+func (impl Implementation) pushEnv(cluster *cnpgv1.Cluster) []corev1.EnvVar {
+	cfg := impl.sidecarConfig.Push
+	return []corev1.EnvVar{
+		{Name: "PUSH_URL", Value: cfg.URL},
+		{Name: "PUSH_INTERVAL", Value: cfg.Interval.String()},
+		{Name: "PUSH_KEY", ValueFrom: optionalSecretKeyRef(pushSecretName(cluster), pushSecretKey)},
+		{Name: "CLUSTER_NAME", Value: cluster.Name},
+		{Name: "POD_NAMESPACE", ValueFrom: fieldRef("metadata.namespace")},
+		{Name: "POD_NAME", ValueFrom: fieldRef("metadata.name")},
+	}
+}
+
+// ensurePushSecret stores the push key of cluster, hex encoded, in a Secret of
+// its namespace before the pod referencing it is created. The key is derived
+// again for every pod and the Secret only updated when it differs, after a
+// change of PUSH_SECRET. The Secret is labeled with scaletozero.PushKeyLabel,
+// and a Secret of the same name without it is left alone, and it is owned by
+// the cluster so it is deleted along with it.
+func (impl Implementation) ensurePushSecret(ctx context.Context, cluster *cnpgv1.Cluster) error {
+	data := map[string][]byte{
+		pushSecretKey: []byte(hex.EncodeToString(push.Key([]byte(impl.sidecarConfig.Push.Secret), cluster.Namespace, cluster.Name))),
+	}
+	key := client.ObjectKey{Namespace: cluster.Namespace, Name: pushSecretName(cluster)}
+
+	secret := &corev1.Secret{}
+	err := impl.client.Get(ctx, key, secret)
+	switch {
+	case apierrors.IsNotFound(err):
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Labels:    map[string]string{scaletozero.PushKeyLabel: scaletozero.PushKeyLabelTrue},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: cnpgv1.SchemeGroupVersion.String(),
+					Kind:       cnpgv1.ClusterKind,
+					Name:       cluster.Name,
+					UID:        cluster.UID,
+				}},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		if err := impl.client.Create(ctx, secret); err != nil {
+			return fmt.Errorf("create push key Secret %s: %w", key, err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("get push key Secret %s: %w", key, err)
+	case secret.Labels[scaletozero.PushKeyLabel] != scaletozero.PushKeyLabelTrue:
+		return fmt.Errorf("secret %s is not labeled %s", key, scaletozero.PushKeyLabel)
+	case bytes.Equal(secret.Data[pushSecretKey], data[pushSecretKey]):
+		return nil
+	}
+
+	secret.Data = data
+	if err := impl.client.Update(ctx, secret); err != nil {
+		return fmt.Errorf("update push key Secret %s: %w", key, err)
+	}
+	return nil
+}
+
+// pushSecretName returns the Secret holding the push key of cluster.
+func pushSecretName(cluster *cnpgv1.Cluster) string {
+	return cluster.Name + pushSecretSuffix
+}
+
+func fieldRef(path string) *corev1.EnvVarSource {
+	return &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: path}}
+}
+
+// holdDatabase returns the database the sidecar reads the hold table from.
+func holdDatabase(cluster *cnpgv1.Cluster) string {
+	if database := strings.TrimSpace(cluster.Annotations[scaletozero.HoldDatabaseAnnotation]); database != "" {
+		return database
+	}
+	return applicationDatabase(cluster)
+}
+
+// applicationDatabase returns the database created when the cluster was
+// bootstrapped.
+func applicationDatabase(cluster *cnpgv1.Cluster) string {
+	if bootstrap := cluster.Spec.Bootstrap; bootstrap != nil {
+		switch {
+		case bootstrap.Recovery != nil && bootstrap.Recovery.Database != "":
+			return bootstrap.Recovery.Database
+		case bootstrap.PgBaseBackup != nil && bootstrap.PgBaseBackup.Database != "":
+			return bootstrap.PgBaseBackup.Database
+		case bootstrap.InitDB != nil && bootstrap.InitDB.Database != "":
+			return bootstrap.InitDB.Database
+		}
+	}
+	return defaultApplicationDatabase
+}
+
+// applicationSecretName returns the Secret holding the credentials of the
+// application database owner.
+func applicationSecretName(cluster *cnpgv1.Cluster) string {
+	if bootstrap := cluster.Spec.Bootstrap; bootstrap != nil {
+		switch {
+		case bootstrap.Recovery != nil && bootstrap.Recovery.Secret != nil && bootstrap.Recovery.Secret.Name != "":
+			return bootstrap.Recovery.Secret.Name
+		case bootstrap.PgBaseBackup != nil && bootstrap.PgBaseBackup.Secret != nil && bootstrap.PgBaseBackup.Secret.Name != "":
+			return bootstrap.PgBaseBackup.Secret.Name
+		case bootstrap.InitDB != nil && bootstrap.InitDB.Secret != nil && bootstrap.InitDB.Secret.Name != "":
+			return bootstrap.InitDB.Secret.Name
+		}
+	}
+	return cluster.Name + applicationSecretSuffix
+}
+
+// exclusionEnv passes the exclusions to the sidecar, omitting empty lists.
+func exclusionEnv(exclusions activity.Exclusions) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{name: "EXCLUDE_USERS", values: exclusions.Users},
+		{name: "EXCLUDE_DATABASES", values: exclusions.Databases},
+		{name: "EXCLUDE_APPLICATION_NAMES", values: exclusions.ApplicationNames},
+		{name: "EXCLUDE_CLIENT_CIDRS", values: exclusions.ClientCIDRs},
+		{name: "EXCLUDE_BACKEND_TYPES", values: exclusions.BackendTypes},
+	} {
+		if len(list.values) > 0 {
+			env = append(env, corev1.EnvVar{Name: list.name, Value: strings.Join(list.values, ",")})
+		}
+	}
+	return env
+}
+
 func pathWithinMount(target, mountPath string) bool {
 	target = path.Clean(target)
 	mountPath = path.Clean(mountPath)
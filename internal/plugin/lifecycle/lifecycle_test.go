@@ -1,10 +1,27 @@
 package lifecycle
 
 import (
+	"context"
+	"encoding/hex"
 	"testing"
+	"time"
 
+	cnpgv1 "github.com/cloudnative-pg/api/pkg/api/v1"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
 )
 
 func TestPostgresRuntimeUsesCNPGContainerConfiguration(t *testing.T) {
@@ -43,3 +60,312 @@ func TestPostgresRuntimeRequiresCNPGConfiguration(t *testing.T) {
 
 	require.EqualError(t, err, "CNPG PostgreSQL runtime environment not found")
 }
+
+func TestExclusionEnvMergesClusterAnnotations(t *testing.T) {
+	t.Parallel()
+
+	global := activity.Exclusions{
+		Users:            []string{"monitoring"},
+		ApplicationNames: []string{"pgbouncer*"},
+	}
+	annotations := map[string]string{
+		scaletozero.ExcludeUsersAnnotation:        "monitoring, backup",
+		scaletozero.ExcludeClientCIDRsAnnotation:  "10.0.0.0/8,,",
+		scaletozero.ExcludeBackendTypesAnnotation: " ",
+	}
+
+	env := exclusionEnv(global.Merge(clusterExclusions(annotations)))
+
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "EXCLUDE_USERS", Value: "monitoring,backup"},
+		{Name: "EXCLUDE_APPLICATION_NAMES", Value: "pgbouncer*"},
+		{Name: "EXCLUDE_CLIENT_CIDRS", Value: "10.0.0.0/8"},
+	}, env)
+}
+
+func TestIdleSessionTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		value *string
+		want  time.Duration
+	}{
+		{name: "missing", value: nil, want: 0},
+		{name: "minutes", value: ptr.To("45"), want: 45 * time.Minute},
+		{name: "zero", value: ptr.To("0"), want: 0},
+		{name: "negative", value: ptr.To("-5"), want: 0},
+		{name: "invalid", value: ptr.To("forever"), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			annotations := map[string]string{}
+			if tt.value != nil {
+				annotations[scaletozero.IdleSessionAnnotation] = *tt.value
+			}
+			require.Equal(t, tt.want, idleSessionTimeout(annotations))
+		})
+	}
+}
+
+func TestTerminateIdleAfter(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, time.Duration(0), terminateIdleAfter(nil))
+	require.Equal(t, 30*time.Minute, terminateIdleAfter(map[string]string{scaletozero.TerminateIdleAnnotation: "30"}))
+	require.Equal(t, time.Duration(0), terminateIdleAfter(map[string]string{scaletozero.TerminateIdleAnnotation: "0"}))
+	require.Equal(t, time.Duration(0), terminateIdleAfter(map[string]string{scaletozero.TerminateIdleAnnotation: "soon"}))
+}
+
+func TestActivitySources(t *testing.T) {
+	t.Parallel()
+
+	defaults := []string{"connections", "counters"}
+
+	require.Equal(t, defaults, activitySources(nil, defaults))
+	require.Nil(t, activitySources(map[string]string{}, nil))
+	require.Equal(t, []string{"connections"}, activitySources(map[string]string{
+		scaletozero.ActivitySourcesAnnotation: " connections, ",
+	}, defaults))
+}
+
+func TestSidecarProbe(t *testing.T) {
+	t.Parallel()
+
+	probe := sidecarProbe("/healthz", 9188)
+
+	require.Equal(t, "/healthz", probe.HTTPGet.Path)
+	require.Equal(t, intstr.FromInt32(9188), probe.HTTPGet.Port)
+	require.Equal(t, corev1.URISchemeHTTP, probe.HTTPGet.Scheme)
+	require.Positive(t, probe.TimeoutSeconds)
+}
+
+func TestInjectTLS(t *testing.T) {
+	t.Parallel()
+
+	impl := Implementation{sidecarConfig: config.SidecarConfig{
+		TLS: config.NewTLSConfig("sidecar-tls", "", "", "9189"),
+	}}
+	pod := &corev1.Pod{}
+	container := &corev1.Container{}
+
+	impl.injectTLS(pod, container)
+	impl.injectTLS(pod, &corev1.Container{})
+
+	require.Equal(t, []corev1.Volume{{
+		Name: sidecarTLSVolume,
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: "sidecar-tls",
+			Optional:   ptr.To(true),
+		}},
+	}}, pod.Spec.Volumes)
+	require.Equal(t, []corev1.VolumeMount{{Name: sidecarTLSVolume, MountPath: sidecarTLSPath, ReadOnly: true}}, container.VolumeMounts)
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "TLS_CERT_DIR", Value: sidecarTLSPath},
+		{Name: "HEALTH_LISTEN_ADDRESS", Value: ":9189"},
+	}, container.Env)
+	require.Equal(t, intstr.FromInt32(9189), container.LivenessProbe.HTTPGet.Port)
+	require.Nil(t, container.ReadinessProbe)
+}
+
+func TestHoldDatabase(t *testing.T) {
+	t.Parallel()
+
+	bootstrap := &cnpgv1.BootstrapConfiguration{InitDB: &cnpgv1.BootstrapInitDB{Database: "orders"}}
+
+	require.Equal(t, "app", holdDatabase(&cnpgv1.Cluster{}))
+	require.Equal(t, "orders", holdDatabase(&cnpgv1.Cluster{Spec: cnpgv1.ClusterSpec{Bootstrap: bootstrap}}))
+	require.Equal(t, "queue", holdDatabase(&cnpgv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{scaletozero.HoldDatabaseAnnotation: " queue "}},
+		Spec:       cnpgv1.ClusterSpec{Bootstrap: bootstrap},
+	}))
+}
+
+func TestApplicationEnv(t *testing.T) {
+	t.Parallel()
+
+	secretRef := func(secret, key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+			Key:                  key,
+			Optional:             ptr.To(true),
+		}}
+	}
+
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "APPLICATION_USER", ValueFrom: secretRef("cluster-app", "username")},
+		{Name: "APPLICATION_PASSWORD", ValueFrom: secretRef("cluster-app", "password")},
+	}, applicationEnv(&cnpgv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster"}}))
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "APPLICATION_USER", ValueFrom: secretRef("orders-owner", "username")},
+		{Name: "APPLICATION_PASSWORD", ValueFrom: secretRef("orders-owner", "password")},
+	}, applicationEnv(&cnpgv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: cnpgv1.ClusterSpec{Bootstrap: &cnpgv1.BootstrapConfiguration{InitDB: &cnpgv1.BootstrapInitDB{
+			Database: "orders",
+			Secret:   &cnpgv1.LocalObjectReference{Name: "orders-owner"},
+		}}},
+	}))
+}
+
+func TestActivityQueryEnv(t *testing.T) {
+	t.Parallel()
+
+	impl := Implementation{sidecarConfig: config.SidecarConfig{ActivityQueryTimeout: 500 * time.Millisecond}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		bootstrap   *cnpgv1.BootstrapConfiguration
+		want        []corev1.EnvVar
+		wantErr     bool
+	}{
+		{
+			name: "no query",
+		},
+		{
+			name:        "invalid reference",
+			annotations: map[string]string{scaletozero.ActivityQueryAnnotation: "jobs"},
+			wantErr:     true,
+		},
+		{
+			name:        "bootstrap database",
+			annotations: map[string]string{scaletozero.ActivityQueryAnnotation: "jobs/pending"},
+			bootstrap:   &cnpgv1.BootstrapConfiguration{InitDB: &cnpgv1.BootstrapInitDB{Database: "orders"}},
+			want:        activityQueryEnvVars("orders"),
+		},
+		{
+			name: "annotated database",
+			annotations: map[string]string{
+				scaletozero.ActivityQueryAnnotation:         "jobs/pending",
+				scaletozero.ActivityQueryDatabaseAnnotation: "queue",
+			},
+			bootstrap: &cnpgv1.BootstrapConfiguration{InitDB: &cnpgv1.BootstrapInitDB{Database: "orders"}},
+			want:      activityQueryEnvVars("queue"),
+		},
+		{
+			name:        "default database",
+			annotations: map[string]string{scaletozero.ActivityQueryAnnotation: "jobs/pending"},
+			want:        activityQueryEnvVars("app"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := &cnpgv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster", Annotations: tt.annotations},
+				Spec:       cnpgv1.ClusterSpec{Bootstrap: tt.bootstrap},
+			}
+
+			env, err := impl.activityQueryEnv(cluster)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, env)
+		})
+	}
+}
+
+func activityQueryEnvVars(database string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "ACTIVITY_QUERY_NAME", Value: "jobs/pending"},
+		{Name: "ACTIVITY_QUERY", ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "jobs"},
+				Key:                  "pending",
+				Optional:             ptr.To(true),
+			},
+		}},
+		{Name: "ACTIVITY_QUERY_DATABASE", Value: database},
+		{Name: "ACTIVITY_QUERY_TIMEOUT", Value: "500ms"},
+	}
+}
+
+func TestPushEnv(t *testing.T) {
+	t.Parallel()
+
+	impl := Implementation{sidecarConfig: config.SidecarConfig{Push: config.PushConfig{
+		URL:      "http://scale-to-zero.cnpg-system:9190/reports",
+		Secret:   "secret",
+		Interval: 30 * time.Second,
+	}}}
+	cluster := &cnpgv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cluster"}}
+
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "PUSH_URL", Value: "http://scale-to-zero.cnpg-system:9190/reports"},
+		{Name: "PUSH_INTERVAL", Value: "30s"},
+		{Name: "PUSH_KEY", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "cluster-scale-to-zero-push"},
+				Key:                  "key",
+				Optional:             ptr.To(true),
+			},
+		}},
+		{Name: "CLUSTER_NAME", Value: "cluster"},
+		{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+		{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+	}, impl.pushEnv(cluster))
+}
+
+func TestEnsurePushSecret(t *testing.T) {
+	t.Parallel()
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	cluster := &cnpgv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cluster", UID: "cluster-uid"}}
+	ctx := context.Background()
+
+	var resourceVersions []string
+	for _, secret := range []string{"secret", "secret", "rotated"} {
+		impl := Implementation{
+			sidecarConfig: config.SidecarConfig{Push: config.PushConfig{Secret: secret}},
+			client:        kubeClient,
+		}
+		require.NoError(t, impl.ensurePushSecret(ctx, cluster))
+
+		var stored corev1.Secret
+		require.NoError(t, kubeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cluster-scale-to-zero-push"}, &stored))
+		require.Equal(t, map[string][]byte{
+			"key": []byte(hex.EncodeToString(push.Key([]byte(secret), "default", "cluster"))),
+		}, stored.Data, secret)
+		require.Equal(t, map[string]string{"xata.io/scale-to-zero-push-key": "true"}, stored.Labels, secret)
+		require.Equal(t, []metav1.OwnerReference{{
+			APIVersion: "postgresql.cnpg.io/v1",
+			Kind:       "Cluster",
+			Name:       "cluster",
+			UID:        "cluster-uid",
+		}}, stored.OwnerReferences, secret)
+		resourceVersions = append(resourceVersions, stored.ResourceVersion)
+	}
+	// An unchanged key is not written again.
+	require.Equal(t, resourceVersions[0], resourceVersions[1])
+	require.NotEqual(t, resourceVersions[1], resourceVersions[2])
+
+	impl := Implementation{
+		sidecarConfig: config.SidecarConfig{Push: config.PushConfig{Secret: "secret"}},
+		client:        kubeClient,
+	}
+	other := &cnpgv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"}}
+	require.NoError(t, impl.ensurePushSecret(ctx, other))
+	var stored corev1.Secret
+	require.NoError(t, kubeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "other-scale-to-zero-push"}, &stored))
+	require.Equal(t, hex.EncodeToString(push.Key([]byte("secret"), "default", "other")), string(stored.Data["key"]))
+
+	// A Secret the plugin did not create is not overwritten.
+	foreign := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foreign-scale-to-zero-push"},
+		Data:       map[string][]byte{"key": []byte("user data")},
+	}
+	require.NoError(t, kubeClient.Create(ctx, foreign))
+	require.Error(t, impl.ensurePushSecret(ctx, &cnpgv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foreign"}}))
+	require.NoError(t, kubeClient.Get(ctx, client.ObjectKeyFromObject(foreign), &stored))
+	require.Equal(t, []byte("user data"), stored.Data["key"])
+}
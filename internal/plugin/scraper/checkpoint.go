@@ -0,0 +1,111 @@
+package scraper
+
+import (
+	"context"
+	"time"
+
+	cnpgv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
+)
+
+const (
+	// checkpointRefresh is how often the checkpoint of an unchanged window is
+	// confirmed, which bounds the writes for each pending cluster.
+	checkpointRefresh = 2 * time.Minute
+	// minCheckpointMaxAge is the shortest gap after the last confirmation
+	// that a restarted plugin still trusts, to allow for a rollout.
+	minCheckpointMaxAge = 10 * time.Minute
+)
+
+// inactivityCheckpoint is the inactivity window persisted on a cluster.
+type inactivityCheckpoint struct {
+	since   time.Time
+	checked time.Time
+}
+
+// readCheckpoint returns the checkpoint of the cluster, if it has a valid
+// one.
+func readCheckpoint(cluster *cnpgv1.Cluster) (inactivityCheckpoint, bool) {
+	since, err := time.Parse(time.RFC3339, cluster.Annotations[scaletozero.IdleSinceAnnotation])
+	if err != nil {
+		return inactivityCheckpoint{}, false
+	}
+	checked, err := time.Parse(time.RFC3339, cluster.Annotations[scaletozero.IdleCheckedAnnotation])
+	if err != nil || checked.Before(since) {
+		return inactivityCheckpoint{}, false
+	}
+	return inactivityCheckpoint{since: since, checked: checked}, true
+}
+
+func hasCheckpoint(cluster *cnpgv1.Cluster) bool {
+	_, since := cluster.Annotations[scaletozero.IdleSinceAnnotation]
+	_, checked := cluster.Annotations[scaletozero.IdleCheckedAnnotation]
+	return since || checked
+}
+
+// restoreLastActive returns the start of the inactivity window checkpointed
+// by a previous plugin process. The scrapes missed while no plugin was
+// running cannot vouch for the window, so it is only trusted when a
+// successful scrape confirmed it shortly before.
+func (s *Scraper) restoreLastActive(cluster *cnpgv1.Cluster, now time.Time) (time.Time, bool) {
+	checkpoint, ok := readCheckpoint(cluster)
+	if !ok || checkpoint.checked.After(now) || now.Sub(checkpoint.checked) > s.checkpointMaxAge() {
+		return time.Time{}, false
+	}
+	return checkpoint.since, true
+}
+
+func (s *Scraper) checkpointMaxAge() time.Duration {
+	return max(minCheckpointMaxAge, 3*s.cfg.Interval)
+}
+
+// checkpoint persists the pending inactivity window of a processed cluster,
+// and removes the checkpoint once the window is cleared, interrupted by
+// activity or ended by hibernation. Failures are logged, since they only
+// affect the next plugin restart.
+func (s *Scraper) checkpoint(ctx context.Context, cluster *cnpgv1.Cluster, result clusterResult, now time.Time) {
+	logger := log.FromContext(ctx).WithValues("namespace", cluster.Namespace, "cluster", cluster.Name)
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	lastActive, exists := s.getLastActive(key)
+
+	updated := cluster.DeepCopy()
+	if result.inactivityWindow && exists {
+		since := lastActive.UTC().Format(time.RFC3339)
+		if current, ok := readCheckpoint(cluster); ok &&
+			cluster.Annotations[scaletozero.IdleSinceAnnotation] == since &&
+			now.Sub(current.checked) < checkpointRefresh {
+			return
+		}
+		if updated.Annotations == nil {
+			updated.Annotations = make(map[string]string, 2)
+		}
+		updated.Annotations[scaletozero.IdleSinceAnnotation] = since
+		updated.Annotations[scaletozero.IdleCheckedAnnotation] = now.UTC().Format(time.RFC3339)
+	} else {
+		if !hasCheckpoint(cluster) {
+			return
+		}
+		delete(updated.Annotations, scaletozero.IdleSinceAnnotation)
+		delete(updated.Annotations, scaletozero.IdleCheckedAnnotation)
+	}
+
+	if err := s.client.Patch(ctx, updated, client.MergeFrom(cluster)); err != nil {
+		logger.Error(err, "inactivity checkpoint update error")
+	}
+}
+
+// markEvaluated records that the cluster was processed by this plugin
+// process and reports whether it was the first time.
+func (s *Scraper) markEvaluated(key types.NamespacedName) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, evaluated := s.evaluated[key]; evaluated {
+		return false
+	}
+	s.evaluated[key] = struct{}{}
+	return true
+}
@@ -0,0 +1,178 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
+)
+
+func TestScraperRestoresCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name              string
+		since             time.Time
+		checked           time.Time
+		err               error
+		expectedDecision  string
+		expectedHibernate bool
+	}{
+		{
+			name:              "recent checkpoint",
+			since:             now.Add(-20 * time.Minute),
+			checked:           now.Add(-3 * time.Minute),
+			expectedDecision:  decisionInactive,
+			expectedHibernate: true,
+		},
+		{
+			name:             "recent checkpoint within the threshold",
+			since:            now.Add(-5 * time.Minute),
+			checked:          now.Add(-3 * time.Minute),
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "stale checkpoint",
+			since:            now.Add(-time.Hour),
+			checked:          now.Add(-30 * time.Minute),
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "checkpoint from the future",
+			since:            now.Add(-time.Hour),
+			checked:          now.Add(time.Hour),
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "probe error",
+			since:            now.Add(-20 * time.Minute),
+			checked:          now.Add(-3 * time.Minute),
+			err:              errors.New("connection refused"),
+			expectedDecision: decisionProbeError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubeClient := fakeClient(
+				clusterWithPhase("default", "cluster", "cluster-1", "10", scaletozero.HealthyClusterStatus, map[string]string{
+					scaletozero.IdleSinceAnnotation:   tc.since.UTC().Format(time.RFC3339),
+					scaletozero.IdleCheckedAnnotation: tc.checked.UTC().Format(time.RFC3339),
+				}),
+				runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+			)
+			hibernator := &recordingHibernator{}
+			s := newTestScraper(t, kubeClient, &fakeConnectionsClient{err: tc.err}, testConfig(), WithHibernator(hibernator))
+			key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+
+			result := s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now)
+			require.Equal(t, tc.expectedDecision, result.decision)
+			require.Equal(t, tc.expectedHibernate, hibernator.target.Key == key)
+
+			lastActive, exists := s.getLastActive(key)
+			switch {
+			case tc.err != nil:
+				require.False(t, exists)
+			case tc.expectedHibernate || tc.since.After(now.Add(-10*time.Minute)):
+				require.True(t, tc.since.Equal(lastActive))
+			default:
+				require.True(t, now.Equal(lastActive))
+			}
+		})
+	}
+}
+
+func TestScraperRestoresCheckpointOnlyOnFirstEvaluation(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Truncate(time.Second)
+	kubeClient := fakeClient(
+		clusterWithPhase("default", "cluster", "cluster-1", "10", scaletozero.HealthyClusterStatus, map[string]string{
+			scaletozero.IdleSinceAnnotation:   now.Add(-20 * time.Minute).UTC().Format(time.RFC3339),
+			scaletozero.IdleCheckedAnnotation: now.Add(-time.Minute).UTC().Format(time.RFC3339),
+		}),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{err: errors.New("connection refused")}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+
+	require.Equal(t, decisionProbeError, s.processCluster(context.Background(), cluster, now).decision)
+
+	// A failed scrape breaks the chain of successful ones, so the window
+	// restarts even though the checkpoint is still on the cached cluster.
+	probe.mu.Lock()
+	probe.err = nil
+	probe.mu.Unlock()
+	require.Equal(t, decisionInactive, s.processCluster(context.Background(), cluster, now.Add(time.Minute)).decision)
+	lastActive, exists := s.getLastActive(key)
+	require.True(t, exists)
+	require.True(t, now.Add(time.Minute).Equal(lastActive))
+}
+
+func TestScraperCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name            string
+		at              time.Duration
+		connections     int
+		expectedSince   string
+		expectedChecked string
+	}{
+		{
+			name:            "window starts",
+			expectedSince:   "2025-01-01T12:00:00Z",
+			expectedChecked: "2025-01-01T12:00:00Z",
+		},
+		{
+			name:            "unchanged window is not rewritten",
+			at:              time.Minute,
+			expectedSince:   "2025-01-01T12:00:00Z",
+			expectedChecked: "2025-01-01T12:00:00Z",
+		},
+		{
+			name:            "unchanged window is confirmed",
+			at:              3 * time.Minute,
+			expectedSince:   "2025-01-01T12:00:00Z",
+			expectedChecked: "2025-01-01T12:03:00Z",
+		},
+		{
+			name:        "activity removes the checkpoint",
+			at:          4 * time.Minute,
+			connections: 1,
+		},
+	}
+
+	for _, step := range steps {
+		probe.mu.Lock()
+		probe.openConnections = step.connections
+		probe.mu.Unlock()
+		reconcileAll(t, s, start.Add(step.at))
+
+		cluster := getCluster(t, kubeClient, "default", "cluster")
+		since, hasSince := cluster.Annotations[scaletozero.IdleSinceAnnotation]
+		checked, hasChecked := cluster.Annotations[scaletozero.IdleCheckedAnnotation]
+		require.Equal(t, step.expectedSince, since, step.name)
+		require.Equal(t, step.expectedChecked, checked, step.name)
+		require.Equal(t, step.expectedSince != "", hasSince, step.name)
+		require.Equal(t, step.expectedChecked != "", hasChecked, step.name)
+	}
+}
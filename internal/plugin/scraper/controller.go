@@ -0,0 +1,198 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cnpgv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
+)
+
+// controllerName names the scraper in the controller-runtime metrics and
+// logs.
+const controllerName = "scale-to-zero"
+
+// SetupWithManager registers the scraper as a controller of the clusters,
+// enqueued by changes to them and to their instance pods. It only runs on the
+// elected leader, unless the clusters are sharded between the replicas, where
+// changes of the shard also enqueue the clusters this replica owns.
+func (s *Scraper) SetupWithManager(mgr ctrl.Manager) error {
+	builder := ctrl.NewControllerManagedBy(mgr).
+		Named(controllerName).
+		For(&cnpgv1.Cluster{}).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(podCluster)).
+		WithOptions(s.controllerOptions())
+	if s.shard != nil {
+		builder = builder.WatchesRawSource(source.Func(s.enqueueOwnedClusters))
+	}
+	return builder.Complete(s)
+}
+
+// controllerOptions bounds the clusters evaluated concurrently by the
+// scraper concurrency.
+func (s *Scraper) controllerOptions() controller.Options {
+	return controller.Options{
+		MaxConcurrentReconciles: s.cfg.Concurrency,
+		NeedLeaderElection:      ptr.To(s.shard == nil),
+	}
+}
+
+// enqueueOwnedClusters enqueues the clusters this replica owns whenever the
+// shard changes. Clusters of other replicas are not requeued, so this is how
+// a replica picks up the clusters it gains.
+func (s *Scraper) enqueueOwnedClusters(ctx context.Context, queue workqueue.TypedRateLimitingInterface[reconcile.Request]) error {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.shard.Changes():
+				for _, request := range s.ownedClusters(ctx) {
+					queue.Add(request)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ownedClusters lists the clusters this replica owns.
+func (s *Scraper) ownedClusters(ctx context.Context) []reconcile.Request {
+	clusters := &cnpgv1.ClusterList{}
+	if err := s.client.List(ctx, clusters); err != nil {
+		log.FromContext(ctx).Error(err, "list clusters of the shard error")
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range clusters.Items {
+		if s.shard.Owns(clusters.Items[i].UID) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+				Namespace: clusters.Items[i].Namespace,
+				Name:      clusters.Items[i].Name,
+			}})
+		}
+	}
+	return requests
+}
+
+// podCluster enqueues the cluster of an instance pod.
+func podCluster(_ context.Context, pod client.Object) []reconcile.Request {
+	name := pod.GetLabels()[scaletozero.ClusterLabel]
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: pod.GetNamespace(), Name: name}}}
+}
+
+// Reconcile evaluates a cluster and schedules its next evaluation. Disabled
+// and hibernated clusters are not requeued, so they cost nothing until an
+// event enqueues them again.
+func (s *Scraper) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return s.reconcile(ctx, req.NamespacedName, time.Now())
+}
+
+func (s *Scraper) reconcile(ctx context.Context, key types.NamespacedName, now time.Time) (ctrl.Result, error) {
+	cluster := &cnpgv1.Cluster{}
+	if err := s.client.Get(ctx, key, cluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			s.forgetCluster(ctx, key)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("retrieve cluster: %w", err)
+	}
+	// The clusters of other replicas are not requeued, the shard enqueues
+	// them again if they move back. Their state is dropped, so they resume
+	// from their checkpoint.
+	if s.shard != nil && !s.shard.Owns(cluster.UID) {
+		s.forgetCluster(ctx, key)
+		return ctrl.Result{}, nil
+	}
+	// Events do not scrape a cluster more often than its schedule.
+	previous, scheduled := s.nextEvaluation(key)
+	if scheduled && now.Before(previous.due) {
+		return ctrl.Result{RequeueAfter: previous.due.Sub(now)}, nil
+	}
+
+	start := time.Now()
+	result := s.processCluster(ctx, cluster, now)
+	decision := metric.WithAttributes(attribute.String(decisionAttribute, result.decision))
+	s.evaluationDuration.Record(ctx, time.Since(start).Seconds(), decision)
+	s.clusterDecisions.Add(ctx, 1, decision)
+	// The checkpoint of a cluster that moved during the evaluation belongs
+	// to its new owner.
+	if result.decision == decisionMoved {
+		s.forgetCluster(ctx, key)
+		return ctrl.Result{}, nil
+	}
+	s.checkpoint(ctx, cluster, result, now)
+	s.recordState(ctx, key, result)
+
+	if result.decision == decisionDisabled || result.decision == decisionAlreadyHibernated {
+		s.schedule(ctx, key, nil, "")
+		return ctrl.Result{}, nil
+	}
+	activeStreak := 0
+	if keepsAwake(result.decision) {
+		activeStreak = previous.activeStreak + 1
+	}
+	delay, reason := s.nextDelay(key, cluster, result, activeStreak, now)
+	s.schedule(ctx, key, &clusterSchedule{due: now.Add(delay), delay: delay, activeStreak: activeStreak}, reason)
+	return ctrl.Result{RequeueAfter: delay}, nil
+}
+
+// recordState keeps the totals of the scrape targets and pending inactive
+// clusters up to date with the latest result of the cluster.
+func (s *Scraper) recordState(ctx context.Context, key types.NamespacedName, result clusterResult) {
+	s.mu.Lock()
+	previous := s.results[key]
+	s.results[key] = result
+	s.targets += int64(result.targets - previous.targets)
+	s.pendingInactive += boolToInt64(result.inactivityWindow) - boolToInt64(previous.inactivityWindow)
+	targets, pendingInactive := s.targets, s.pendingInactive
+	s.mu.Unlock()
+
+	s.eligibleTargets.Record(ctx, targets)
+	s.pendingInactiveClusters.Record(ctx, pendingInactive)
+}
+
+// forgetCluster drops the state of a cluster that was deleted or moved to
+// another replica.
+func (s *Scraper) forgetCluster(ctx context.Context, key types.NamespacedName) {
+	s.mu.Lock()
+	previous := s.results[key]
+	delete(s.results, key)
+	delete(s.lastActive, key)
+	delete(s.counters, key)
+	delete(s.evaluated, key)
+	s.targets -= int64(previous.targets)
+	s.pendingInactive -= boolToInt64(previous.inactivityWindow)
+	targets, pendingInactive := s.targets, s.pendingInactive
+	s.mu.Unlock()
+
+	s.schedule(ctx, key, nil, "")
+	s.eligibleTargets.Record(ctx, targets)
+	s.pendingInactiveClusters.Record(ctx, pendingInactive)
+}
+
+func boolToInt64(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
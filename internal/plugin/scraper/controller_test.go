@@ -0,0 +1,190 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
+)
+
+func TestScraperSchedulesClusters(t *testing.T) {
+	t.Parallel()
+
+	disabled := enabledCluster("default", "disabled", "disabled-1", "10")
+	disabled.Annotations[scaletozero.EnabledAnnotation] = "false"
+	hibernated := clusterWithPhase("default", "hibernated", "hibernated-1", "10", scaletozero.HealthyClusterStatus, map[string]string{
+		scaletozero.HibernationAnnotation: scaletozero.HibernationAnnotationValueOn,
+	})
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+		disabled,
+		hibernated,
+	)
+	probe := &fakeConnectionsClient{openConnections: 1}
+	cfg := testConfig()
+	s := newTestScraper(t, kubeClient, probe, cfg)
+	now := time.Now()
+	ctx := context.Background()
+
+	tests := []struct {
+		name            string
+		cluster         string
+		at              time.Duration
+		expectedResult  ctrl.Result
+		expectedScrapes int
+	}{
+		{
+			name:            "enabled cluster is requeued",
+			cluster:         "cluster",
+			expectedResult:  ctrl.Result{RequeueAfter: cfg.Interval},
+			expectedScrapes: 1,
+		},
+		{
+			name:            "event before the next evaluation",
+			cluster:         "cluster",
+			at:              20 * time.Second,
+			expectedResult:  ctrl.Result{RequeueAfter: 40 * time.Second},
+			expectedScrapes: 1,
+		},
+		{
+			name:            "next evaluation backs off while active",
+			cluster:         "cluster",
+			at:              cfg.Interval,
+			expectedResult:  ctrl.Result{RequeueAfter: 2 * cfg.Interval},
+			expectedScrapes: 2,
+		},
+		{
+			name:            "disabled cluster waits for an event",
+			cluster:         "disabled",
+			expectedScrapes: 2,
+		},
+		{
+			name:            "hibernated cluster waits for an event",
+			cluster:         "hibernated",
+			expectedScrapes: 2,
+		},
+		{
+			name:            "deleted cluster",
+			cluster:         "deleted",
+			expectedScrapes: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		result, err := s.reconcile(ctx, types.NamespacedName{Namespace: "default", Name: tc.cluster}, now.Add(tc.at))
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.expectedResult, result, tc.name)
+		require.Equal(t, tc.expectedScrapes, probe.callCount(), tc.name)
+	}
+}
+
+func TestScraperEvaluatesReenabledClusterRightAway(t *testing.T) {
+	t.Parallel()
+
+	cluster := enabledCluster("default", "cluster", "cluster-1", "10")
+	kubeClient := fakeClient(
+		cluster,
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	now := time.Now()
+	ctx := context.Background()
+
+	_, err := s.reconcile(ctx, key, now)
+	require.NoError(t, err)
+
+	cluster = getCluster(t, kubeClient, "default", "cluster")
+	cluster.Annotations[scaletozero.EnabledAnnotation] = "false"
+	require.NoError(t, kubeClient.Update(ctx, cluster))
+	result, err := s.reconcile(ctx, key, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Zero(t, result)
+
+	cluster = getCluster(t, kubeClient, "default", "cluster")
+	cluster.Annotations[scaletozero.EnabledAnnotation] = scaletozero.EnabledAnnotationTrue
+	require.NoError(t, kubeClient.Update(ctx, cluster))
+	_, err = s.reconcile(ctx, key, now.Add(time.Minute+time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 2, probe.callCount())
+}
+
+func TestScraperControllerOptions(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.Concurrency = 5
+	s := newTestScraper(t, fakeClient(), &fakeConnectionsClient{}, cfg)
+	require.Equal(t, 5, s.controllerOptions().MaxConcurrentReconciles)
+	require.True(t, *s.controllerOptions().NeedLeaderElection)
+
+	s = newTestScraper(t, fakeClient(), &fakeConnectionsClient{}, cfg, WithShard(fakeShard{}))
+	require.False(t, *s.controllerOptions().NeedLeaderElection)
+}
+
+func TestScraperEnqueuesClustersGainedByTheShard(t *testing.T) {
+	t.Parallel()
+
+	owned := enabledCluster("default", "owned", "owned-1", "10")
+	owned.UID = "owned-uid"
+	other := enabledCluster("default", "other", "other-1", "10")
+	other.UID = "other-uid"
+	kubeClient := fakeClient(
+		owned,
+		other,
+		runningPrimary("default", "owned", "owned-1", "10.0.0.1"),
+		runningPrimary("default", "other", "other-1", "10.0.0.2"),
+	)
+	probe := &fakeConnectionsClient{}
+	shard := &changingShard{fakeShard: fakeShard{"owned-uid": true}, changes: make(chan struct{})}
+	s := newTestScraper(t, kubeClient, probe, testConfig(), WithShard(shard))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// The clusters of other replicas are dropped until the shard changes.
+	result, err := s.reconcile(ctx, types.NamespacedName{Namespace: "default", Name: "other"}, time.Now())
+	require.NoError(t, err)
+	require.Zero(t, result)
+	require.Zero(t, probe.callCount())
+
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+	t.Cleanup(queue.ShutDown)
+	require.NoError(t, s.enqueueOwnedClusters(ctx, queue))
+	shard.changes <- struct{}{}
+	request, _ := queue.Get()
+	require.Equal(t, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "owned"}}, request)
+	queue.Done(request)
+	require.Zero(t, queue.Len())
+}
+
+// changingShard is a fakeShard whose changes the test sends.
+type changingShard struct {
+	fakeShard
+	changes chan struct{}
+}
+
+func (s *changingShard) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func TestPodCluster(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t,
+		[]reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "cluster"}}},
+		podCluster(context.Background(), runningPrimary("default", "cluster", "cluster-1", "10.0.0.1")),
+	)
+
+	pod := runningPrimary("default", "cluster", "cluster-1", "10.0.0.1")
+	delete(pod.Labels, scaletozero.ClusterLabel)
+	require.Empty(t, podCluster(context.Background(), pod))
+}
@@ -0,0 +1,192 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	pushResultAccepted = "accepted"
+	pushResultRejected = "rejected"
+
+	// maxPushedReportSize bounds the body of a pushed report. Reports group
+	// sessions, so they stay far below it.
+	maxPushedReportSize = 1 << 20
+)
+
+// errReportMissing is returned for an instance that has not pushed a report
+// since the plugin started.
+var errReportMissing = errors.New("no report pushed")
+
+// reportStore keeps the latest report pushed by each instance, keyed by
+// namespace and pod name.
+type reportStore struct {
+	mu      sync.Mutex
+	reports map[types.NamespacedName]pushedReport
+}
+
+type pushedReport struct {
+	cluster    string
+	signedAt   time.Time
+	receivedAt time.Time
+	err        string
+	report     activity.Report
+}
+
+func newReportStore() *reportStore {
+	return &reportStore{reports: make(map[types.NamespacedName]pushedReport)}
+}
+
+// store records a report unless a report signed later was already received,
+// so a delayed or replayed request cannot replace a newer one.
+func (r *reportStore) store(envelope push.Envelope, signedAt, receivedAt time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: envelope.Namespace, Name: envelope.Pod}
+	if previous, exists := r.reports[key]; exists && previous.signedAt.After(signedAt) {
+		return false
+	}
+	r.reports[key] = pushedReport{
+		cluster:    envelope.Cluster,
+		signedAt:   signedAt,
+		receivedAt: receivedAt,
+		err:        envelope.Error,
+		report:     envelope.Report,
+	}
+	return true
+}
+
+// latest returns the report of pod. A missing or late report, or one the
+// sidecar could not collect, is an error, like a failed scrape.
+func (r *reportStore) latest(pod *corev1.Pod, now time.Time, maxAge time.Duration) (activity.Report, error) {
+	r.mu.Lock()
+	pushed, exists := r.reports[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+	r.mu.Unlock()
+
+	switch {
+	case !exists:
+		return activity.Report{}, errReportMissing
+	case pushed.cluster != pod.Labels[scaletozero.ClusterLabel]:
+		return activity.Report{}, fmt.Errorf("report pushed for cluster %q", pushed.cluster)
+	case now.Sub(pushed.receivedAt) > maxAge:
+		return activity.Report{}, fmt.Errorf("latest report pushed %s ago", now.Sub(pushed.receivedAt).Round(time.Second))
+	case pushed.err != "":
+		return activity.Report{}, fmt.Errorf("sidecar report error: %s", pushed.err)
+	}
+	return pushed.report, nil
+}
+
+// ReportHandler accepts the reports pushed by the sidecars. Each report must
+// be signed with the key of the cluster it names.
+func (s *Scraper) ReportHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(push.Path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := s.receiveReport(w, r)
+		result := pushResultAccepted
+		if err != nil {
+			result = pushResultRejected
+			log.FromContext(ctx).Info("rejected pushed activity report", "remoteAddress", r.RemoteAddr, "error", err.Error())
+		}
+		s.pushedReports.Add(ctx, 1, metric.WithAttributes(attribute.String(scrapeResultAttribute, result)))
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.WriteHeader(status)
+	})
+	return mux
+}
+
+func (s *Scraper) receiveReport(w http.ResponseWriter, r *http.Request) (int, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPushedReportSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		return http.StatusBadRequest, fmt.Errorf("read body: %w", err)
+	}
+	var envelope push.Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("decode report: %w", err)
+	}
+
+	now := time.Now()
+	key := push.Key([]byte(s.cfg.Push.Secret), envelope.Namespace, envelope.Cluster)
+	signedAt, err := push.Verify(key, r.Header.Get(push.TimestampHeader), r.Header.Get(push.SignatureHeader), body, now, s.cfg.Push.MaxAge())
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("report of %s/%s: %w", envelope.Namespace, envelope.Pod, err)
+	}
+	if status, err := s.checkReportPod(r.Context(), envelope); err != nil {
+		return status, err
+	}
+	if envelope.Error == "" && (envelope.Report.Version < 1 || envelope.Report.Version > activity.ReportVersion) {
+		return http.StatusBadRequest, fmt.Errorf("unsupported activity report version %d", envelope.Report.Version)
+	}
+
+	if !s.reports.store(envelope, signedAt, now) {
+		return http.StatusConflict, fmt.Errorf("report of %s/%s is older than the latest one", envelope.Namespace, envelope.Pod)
+	}
+	return http.StatusAccepted, nil
+}
+
+// checkReportPod verifies that the pod of a report belongs to the cluster
+// whose key signed it, so one cluster cannot report for another's pods.
+func (s *Scraper) checkReportPod(ctx context.Context, envelope push.Envelope) (int, error) {
+	pod := &corev1.Pod{}
+	if err := s.client.Get(ctx, types.NamespacedName{Namespace: envelope.Namespace, Name: envelope.Pod}, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return http.StatusForbidden, fmt.Errorf("report of unknown pod %s/%s", envelope.Namespace, envelope.Pod)
+		}
+		return http.StatusServiceUnavailable, fmt.Errorf("get pod %s/%s: %w", envelope.Namespace, envelope.Pod, err)
+	}
+	if cluster := pod.Labels[scaletozero.ClusterLabel]; cluster != envelope.Cluster {
+		return http.StatusForbidden, fmt.Errorf("report of %s/%s signed for cluster %q, pod belongs to %q", envelope.Namespace, envelope.Pod, envelope.Cluster, cluster)
+	}
+	return 0, nil
+}
+
+// ServeReports serves the ingestion endpoint until the context is done.
+func (s *Scraper) ServeReports(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.cfg.Push.ListenAddress,
+		Handler:           s.ReportHandler(ctx),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.FromContext(ctx).Error(err, "report ingestion server stop error")
+		}
+	}()
+
+	log.FromContext(ctx).Info("starting report ingestion server", "address", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
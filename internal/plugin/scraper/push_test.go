@@ -0,0 +1,197 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/metric/noop"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
+)
+
+const testPushSecret = "secret"
+
+func TestScraperPushMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		envelope         *push.Envelope
+		secret           string
+		age              time.Duration
+		expectedStatus   int
+		expectedDecision string
+	}{
+		{
+			name:             "no report",
+			expectedDecision: decisionProbeError,
+		},
+		{
+			name:             "inactive",
+			envelope:         &push.Envelope{Report: activity.Report{Version: activity.ReportVersion}},
+			expectedStatus:   http.StatusAccepted,
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "active",
+			envelope:         &push.Envelope{Report: activity.Report{Version: activity.ReportVersion, Connections: 1}},
+			expectedStatus:   http.StatusAccepted,
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "collection error",
+			envelope:         &push.Envelope{Error: "query failed"},
+			expectedStatus:   http.StatusAccepted,
+			expectedDecision: decisionProbeError,
+		},
+		{
+			name:             "late report",
+			envelope:         &push.Envelope{Report: activity.Report{Version: activity.ReportVersion}},
+			age:              3 * time.Minute,
+			expectedStatus:   http.StatusAccepted,
+			expectedDecision: decisionProbeError,
+		},
+		{
+			name:             "invalid signature",
+			envelope:         &push.Envelope{Report: activity.Report{Version: activity.ReportVersion}},
+			secret:           "other",
+			expectedStatus:   http.StatusUnauthorized,
+			expectedDecision: decisionProbeError,
+		},
+		{
+			name:             "unsupported version",
+			envelope:         &push.Envelope{Report: activity.Report{Version: activity.ReportVersion + 1}},
+			expectedStatus:   http.StatusBadRequest,
+			expectedDecision: decisionProbeError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubeClient := fakeClient(
+				enabledCluster("default", "cluster", "cluster-1", "10"),
+				runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+			)
+			probe := &fakeConnectionsClient{}
+			s := newTestScraper(t, kubeClient, probe, pushTestConfig())
+			key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+			now := time.Now()
+
+			if tc.envelope != nil {
+				envelope := *tc.envelope
+				envelope.Namespace, envelope.Cluster, envelope.Pod = "default", "cluster", "cluster-1"
+				secret := testPushSecret
+				if tc.secret != "" {
+					secret = tc.secret
+				}
+				require.Equal(t, tc.expectedStatus, pushReport(t, s, secret, envelope, now))
+				if tc.age > 0 {
+					s.reports.mu.Lock()
+					pushed := s.reports.reports[types.NamespacedName{Namespace: "default", Name: "cluster-1"}]
+					pushed.receivedAt = pushed.receivedAt.Add(-tc.age)
+					s.reports.reports[types.NamespacedName{Namespace: "default", Name: "cluster-1"}] = pushed
+					s.reports.mu.Unlock()
+				}
+			}
+
+			s.setLastActive(key, now.Add(-time.Hour))
+			require.Equal(t, tc.expectedDecision, s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now).decision)
+			require.Zero(t, probe.callCount())
+		})
+	}
+}
+
+func TestScraperPushRejectsOlderReport(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	s := newTestScraper(t, kubeClient, &fakeConnectionsClient{}, pushTestConfig())
+	now := time.Now()
+	envelope := push.Envelope{Namespace: "default", Cluster: "cluster", Pod: "cluster-1", Report: activity.Report{Version: activity.ReportVersion}}
+
+	require.Equal(t, http.StatusAccepted, pushReport(t, s, testPushSecret, envelope, now))
+	envelope.Report.Connections = 1
+	require.Equal(t, http.StatusConflict, pushReport(t, s, testPushSecret, envelope, now.Add(-10*time.Second)))
+
+	report, err := s.scrapeInstance(context.Background(), runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+	require.NoError(t, err)
+	require.Zero(t, report.Connections)
+
+}
+
+func TestScraperPushRejectsReportsForOtherClusters(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+		enabledCluster("default", "other", "other-1", "10"),
+		runningPrimary("default", "other", "other-1", "10.0.0.2"),
+	)
+	s := newTestScraper(t, kubeClient, &fakeConnectionsClient{}, pushTestConfig())
+	now := time.Now()
+	envelope := push.Envelope{Namespace: "default", Cluster: "cluster", Pod: "cluster-1", Report: activity.Report{Version: activity.ReportVersion}}
+	require.Equal(t, http.StatusAccepted, pushReport(t, s, testPushSecret, envelope, now))
+
+	// The key of another cluster cannot replace the report, even dated later.
+	envelope.Cluster = "other"
+	envelope.Report.Connections = 1
+	require.Equal(t, http.StatusForbidden, pushReport(t, s, testPushSecret, envelope, now.Add(time.Minute)))
+	report, err := s.scrapeInstance(context.Background(), runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+	require.NoError(t, err)
+	require.Zero(t, report.Connections)
+
+	// Nor report for pods that do not exist.
+	envelope.Pod = "other-2"
+	require.Equal(t, http.StatusForbidden, pushReport(t, s, testPushSecret, envelope, now))
+}
+
+func TestNewScraperPushModeRequiresSecret(t *testing.T) {
+	t.Parallel()
+
+	cfg := pushTestConfig()
+	cfg.Push.Secret = ""
+	_, err := New(fakeClient(), &fakeConnectionsClient{}, cfg, noop.NewMeterProvider().Meter("test"))
+	require.Error(t, err)
+}
+
+func pushTestConfig() config.ScraperConfig {
+	cfg := testConfig()
+	cfg.Push = config.PushConfig{
+		URL:      "http://scale-to-zero.cnpg-system:9190/reports",
+		Secret:   testPushSecret,
+		Interval: time.Minute,
+	}
+	return cfg
+}
+
+// pushReport sends envelope to the ingestion endpoint of s, signed at
+// signedAt, and returns the response status.
+func pushReport(t *testing.T, s *Scraper, secret string, envelope push.Envelope, signedAt time.Time) int {
+	t.Helper()
+
+	body, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	request := httptest.NewRequest(http.MethodPost, push.Path, bytes.NewReader(body))
+	request.Header.Set(push.TimestampHeader, strconv.FormatInt(signedAt.Unix(), 10))
+	request.Header.Set(push.SignatureHeader, push.Sign(push.Key([]byte(secret), envelope.Namespace, envelope.Cluster), signedAt, body))
+
+	recorder := httptest.NewRecorder()
+	s.ReportHandler(context.Background()).ServeHTTP(recorder, request)
+	return recorder.Code
+}
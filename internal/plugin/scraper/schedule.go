@@ -0,0 +1,129 @@
+package scraper
+
+import (
+	"context"
+	"time"
+
+	cnpgv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	scheduleAttribute = "schedule"
+	// scheduleInterval evaluates the cluster after SCRAPER_INTERVAL.
+	scheduleInterval = "interval"
+	// scheduleBackoff evaluates a steadily active cluster less often.
+	scheduleBackoff = "backoff"
+	// scheduleThreshold evaluates an inactive cluster when its inactivity
+	// window elapses, which is sooner than the interval.
+	scheduleThreshold = "threshold"
+
+	// maxBackoffFactor caps the delay of steadily active clusters, in
+	// intervals.
+	maxBackoffFactor = 8
+	// minDelay keeps a cluster at its threshold from being evaluated in a
+	// loop.
+	minDelay = time.Second
+	// jitterFraction is the largest share of a delay added at random, so the
+	// scrapes of clusters sharing a node drift apart.
+	jitterFraction = 0.1
+)
+
+// clusterSchedule is the next evaluation of a cluster.
+type clusterSchedule struct {
+	due   time.Time
+	delay time.Duration
+	// activeStreak counts the consecutive evaluations that kept the cluster
+	// awake.
+	activeStreak int
+}
+
+// keepsAwake reports whether the decision resets the inactivity window.
+func keepsAwake(decision string) bool {
+	switch decision {
+	case decisionActive, decisionMaintenance, decisionHold, decisionPreparedTransactions, decisionReplicationSlots:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextDelay returns how long to wait before the next evaluation of the
+// cluster. A cluster that keeps being active backs off exponentially, up to
+// a quarter of its inactivity window so that a later hibernation is not
+// delayed by much, while a cluster whose inactivity window elapses before the
+// next interval is evaluated right then.
+func (s *Scraper) nextDelay(key types.NamespacedName, cluster *cnpgv1.Cluster, result clusterResult, activeStreak int, now time.Time) (time.Duration, string) {
+	inactivity := time.Duration(getClusterScaleToZeroConfig(cluster).inactivityMinutes) * time.Minute
+	delay, reason := s.cfg.Interval, scheduleInterval
+
+	switch {
+	case result.inactivityWindow:
+		// A window that already elapsed is held back by something else,
+		// such as a scheduled job, and does not need precise timing.
+		if lastActive, exists := s.getLastActive(key); exists {
+			if remaining := lastActive.Add(inactivity).Sub(now); remaining > 0 && remaining < delay {
+				delay, reason = max(remaining, minDelay), scheduleThreshold
+			}
+		}
+	case activeStreak > 1:
+		limit := max(s.cfg.Interval, min(maxBackoffFactor*s.cfg.Interval, inactivity/4))
+		backoff := s.cfg.Interval
+		for range activeStreak - 1 {
+			if backoff >= limit {
+				break
+			}
+			backoff *= 2
+		}
+		if backoff = min(backoff, limit); backoff > s.cfg.Interval {
+			delay, reason = backoff, scheduleBackoff
+		}
+	}
+
+	// The end of an inactivity window is already specific to the cluster. The
+	// jitter only delays the other evaluations, so it never scrapes more often
+	// than the schedule.
+	if reason == scheduleThreshold {
+		return delay, reason
+	}
+	return delay + time.Duration(s.random()*jitterFraction*float64(delay)), reason
+}
+
+func (s *Scraper) nextEvaluation(key types.NamespacedName) (clusterSchedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedule, scheduled := s.schedules[key]
+	return schedule, scheduled
+}
+
+// schedule records the next evaluation of the cluster, or removes it when
+// schedule is nil, and updates the scheduled evaluation rate.
+func (s *Scraper) schedule(ctx context.Context, key types.NamespacedName, schedule *clusterSchedule, reason string) {
+	s.mu.Lock()
+	if previous, scheduled := s.schedules[key]; scheduled {
+		s.scheduledRate -= 1 / previous.delay.Seconds()
+	}
+	if schedule == nil {
+		delete(s.schedules, key)
+	} else {
+		s.schedules[key] = *schedule
+		s.scheduledRate += 1 / schedule.delay.Seconds()
+	}
+	if len(s.schedules) == 0 {
+		// Drop the rounding errors accumulated by the updates.
+		s.scheduledRate = 0
+	}
+	rate := s.scheduledRate
+	s.mu.Unlock()
+
+	s.scheduledEvaluations.Record(ctx, rate)
+	if schedule != nil {
+		s.evaluationDelay.Record(
+			ctx,
+			schedule.delay.Seconds(),
+			metric.WithAttributes(attribute.String(scheduleAttribute, reason)),
+		)
+	}
+}
@@ -0,0 +1,163 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestScraperNextDelay(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		name              string
+		inactivityMinutes string
+		inactivityWindow  bool
+		lastActive        time.Duration
+		activeStreak      int
+		expectedDelay     time.Duration
+		expectedReason    string
+	}{
+		{
+			name:              "first active evaluation",
+			inactivityMinutes: "60",
+			activeStreak:      1,
+			expectedDelay:     time.Minute,
+			expectedReason:    scheduleInterval,
+		},
+		{
+			name:              "probe error",
+			inactivityMinutes: "60",
+			expectedDelay:     time.Minute,
+			expectedReason:    scheduleInterval,
+		},
+		{
+			name:              "steadily active",
+			inactivityMinutes: "60",
+			activeStreak:      3,
+			expectedDelay:     4 * time.Minute,
+			expectedReason:    scheduleBackoff,
+		},
+		{
+			name:              "backoff capped in intervals",
+			inactivityMinutes: "60",
+			activeStreak:      20,
+			expectedDelay:     8 * time.Minute,
+			expectedReason:    scheduleBackoff,
+		},
+		{
+			name:              "backoff capped by the inactivity window",
+			inactivityMinutes: "10",
+			activeStreak:      3,
+			expectedDelay:     150 * time.Second,
+			expectedReason:    scheduleBackoff,
+		},
+		{
+			name:              "short inactivity window does not back off",
+			inactivityMinutes: "2",
+			activeStreak:      5,
+			expectedDelay:     time.Minute,
+			expectedReason:    scheduleInterval,
+		},
+		{
+			name:              "window ends after the interval",
+			inactivityMinutes: "10",
+			inactivityWindow:  true,
+			lastActive:        5 * time.Minute,
+			expectedDelay:     time.Minute,
+			expectedReason:    scheduleInterval,
+		},
+		{
+			name:              "window ends before the interval",
+			inactivityMinutes: "10",
+			inactivityWindow:  true,
+			lastActive:        9*time.Minute + 30*time.Second,
+			expectedDelay:     30 * time.Second,
+			expectedReason:    scheduleThreshold,
+		},
+		{
+			name:              "window about to end",
+			inactivityMinutes: "10",
+			inactivityWindow:  true,
+			lastActive:        10*time.Minute - 100*time.Millisecond,
+			expectedDelay:     minDelay,
+			expectedReason:    scheduleThreshold,
+		},
+		{
+			name:              "window already elapsed",
+			inactivityMinutes: "10",
+			inactivityWindow:  true,
+			lastActive:        11 * time.Minute,
+			expectedDelay:     time.Minute,
+			expectedReason:    scheduleInterval,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := enabledCluster("default", "cluster", "cluster-1", tc.inactivityMinutes)
+			s := newTestScraper(t, fakeClient(cluster), &fakeConnectionsClient{}, testConfig())
+			key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+			if tc.inactivityWindow {
+				s.setLastActive(key, now.Add(-tc.lastActive))
+			}
+
+			delay, reason := s.nextDelay(key, cluster, clusterResult{inactivityWindow: tc.inactivityWindow}, tc.activeStreak, now)
+			require.Equal(t, tc.expectedDelay, delay)
+			require.Equal(t, tc.expectedReason, reason)
+		})
+	}
+}
+
+func TestScraperNextDelayAddsJitter(t *testing.T) {
+	t.Parallel()
+
+	cluster := enabledCluster("default", "cluster", "cluster-1", "10")
+	s := newTestScraper(t, fakeClient(cluster), &fakeConnectionsClient{}, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+
+	s.random = func() float64 { return 0.5 }
+	delay, _ := s.nextDelay(key, cluster, clusterResult{}, 1, time.Now())
+	require.Equal(t, 63*time.Second, delay)
+
+	s.random = func() float64 { return 0.999 }
+	delay, _ = s.nextDelay(key, cluster, clusterResult{}, 1, time.Now())
+	require.GreaterOrEqual(t, delay, time.Minute)
+	require.Less(t, delay, 66*time.Second)
+
+	now := time.Now()
+	s.setLastActive(key, now.Add(-9*time.Minute-30*time.Second))
+	delay, reason := s.nextDelay(key, cluster, clusterResult{inactivityWindow: true}, 0, now)
+	require.Equal(t, 30*time.Second, delay)
+	require.Equal(t, scheduleThreshold, reason)
+}
+
+func TestScraperScheduledRate(t *testing.T) {
+	t.Parallel()
+
+	s := newTestScraper(t, fakeClient(), &fakeConnectionsClient{}, testConfig())
+	ctx := context.Background()
+	now := time.Now()
+	first := types.NamespacedName{Namespace: "default", Name: "first"}
+	second := types.NamespacedName{Namespace: "default", Name: "second"}
+
+	s.schedule(ctx, first, &clusterSchedule{due: now.Add(time.Minute), delay: time.Minute}, scheduleInterval)
+	s.schedule(ctx, second, &clusterSchedule{due: now.Add(2 * time.Minute), delay: 2 * time.Minute}, scheduleBackoff)
+	require.InDelta(t, 1.0/60+1.0/120, s.scheduledRate, 1e-9)
+
+	s.schedule(ctx, first, &clusterSchedule{due: now.Add(4 * time.Minute), delay: 4 * time.Minute}, scheduleBackoff)
+	require.InDelta(t, 1.0/240+1.0/120, s.scheduledRate, 1e-9)
+
+	s.schedule(ctx, second, nil, "")
+	require.InDelta(t, 1.0/240, s.scheduledRate, 1e-9)
+
+	s.schedule(ctx, first, nil, "")
+	require.Zero(t, s.scheduledRate)
+	require.Empty(t, s.schedules)
+}
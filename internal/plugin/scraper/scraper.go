@@ -1,17 +1,25 @@
 package scraper
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 
 	cnpgv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
 	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/mtls"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
 	"github.com/xataio/cnpg-i-scale-to-zero/pkg/hibernation"
 	"go.opentelemetry.io/otel/attribute"
@@ -20,6 +28,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -29,54 +38,132 @@ const (
 	scrapeResultSuccess   = "success"
 	scrapeResultError     = "error"
 
+	sessionStateAttribute = "state"
+
+	idleSessionTerminatedReason = "IdleSessionTerminated"
+
 	decisionAttribute         = "reason"
 	decisionDisabled          = "disabled"
 	decisionAlreadyHibernated = "already_hibernated"
 	decisionUnhealthy         = "unhealthy"
 	decisionNotScrapeable     = "not_scrapeable"
 	decisionProbeError        = "probe_error"
+	decisionRoleMismatch      = "role_mismatch"
 	decisionActive            = "active"
+	decisionMaintenance       = "maintenance"
+	decisionHold              = "hold"
 	decisionInactive          = "inactive"
+
+	// External systems depending on the cluster prevent hibernation unless
+	// the cluster allows it.
+	decisionPreparedTransactions = "prepared_transactions"
+	decisionReplicationSlots     = "replication_slots"
+	// decisionScheduledJob holds back the hibernation of an inactive cluster
+	// with a pg_cron job due within the inactivity window.
+	decisionScheduledJob = "scheduled_job"
+	// decisionMoved skips the hibernation of an inactive cluster that moved
+	// to another replica during the evaluation, which now decides for it.
+	decisionMoved = "moved"
 )
 
+// ErrActivityUnsupported is returned by GetActivity when the sidecar predates
+// the activity endpoint.
+var ErrActivityUnsupported = errors.New("sidecar does not support activity reports")
+
 type ConnectionsClient interface {
 	GetConnections(ctx context.Context, url string) (int, error)
+	GetActivity(ctx context.Context, url string) (activity.Report, error)
+	TerminateIdleSessions(ctx context.Context, url string, idleFor time.Duration) (activity.TerminationResult, error)
 }
 
 type HTTPConnectionsClient struct {
 	client *http.Client
 }
 
-func NewHTTPConnectionsClient(timeout time.Duration) *HTTPConnectionsClient {
+// NewHTTPConnectionsClient returns a client of the sidecar HTTP API. With a
+// TLS configuration, it is used for https URLs.
+func NewHTTPConnectionsClient(timeout time.Duration, tlsConfig *tls.Config) *HTTPConnectionsClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
 	return &HTTPConnectionsClient{
 		client: &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: transport,
 		},
 	}
 }
 
 func (c *HTTPConnectionsClient) GetConnections(ctx context.Context, url string) (int, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
+	var result int
+	if err := c.getJSON(ctx, url, &result); err != nil {
 		return 0, err
 	}
 
+	return result, nil
+}
+
+func (c *HTTPConnectionsClient) GetActivity(ctx context.Context, url string) (activity.Report, error) {
+	var report activity.Report
+	if err := c.getJSON(ctx, url, &report); err != nil {
+		var statusErr statusError
+		if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound {
+			return activity.Report{}, ErrActivityUnsupported
+		}
+		return activity.Report{}, err
+	}
+	if report.Version < 1 || report.Version > activity.ReportVersion {
+		return activity.Report{}, fmt.Errorf("unsupported activity report version %d", report.Version)
+	}
+
+	return report, nil
+}
+
+func (c *HTTPConnectionsClient) TerminateIdleSessions(ctx context.Context, url string, idleFor time.Duration) (activity.TerminationResult, error) {
+	body, err := json.Marshal(activity.TerminationRequest{IdleSeconds: idleFor.Seconds()})
+	if err != nil {
+		return activity.TerminationResult{}, err
+	}
+
+	var result activity.TerminationResult
+	if err := c.doJSON(ctx, http.MethodPost, url, bytes.NewReader(body), &result); err != nil {
+		return activity.TerminationResult{}, err
+	}
+
+	return result, nil
+}
+
+func (c *HTTPConnectionsClient) getJSON(ctx context.Context, url string, result any) error {
+	return c.doJSON(ctx, http.MethodGet, url, nil, result)
+}
+
+func (c *HTTPConnectionsClient) doJSON(ctx context.Context, method, url string, body io.Reader, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("connections probe returned status %d", resp.StatusCode)
+		return statusError{statusCode: resp.StatusCode}
 	}
 
-	var result int
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, err
-	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
 
-	return result, nil
+type statusError struct {
+	statusCode int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("connections probe returned status %d", e.statusCode)
 }
 
 type Scraper struct {
@@ -84,19 +171,61 @@ type Scraper struct {
 	connectionsClient       ConnectionsClient
 	cfg                     config.ScraperConfig
 	scrapeDuration          metric.Float64Histogram
-	cycleDuration           metric.Float64Histogram
+	evaluationDuration      metric.Float64Histogram
 	clusterDecisions        metric.Int64Counter
 	hibernateAttempts       metric.Int64Counter
 	eligibleTargets         metric.Int64Gauge
 	pendingInactiveClusters metric.Int64Gauge
+	terminatedSessions      metric.Int64Counter
+	pushedReports           metric.Int64Counter
+	scheduledEvaluations    metric.Float64Gauge
+	evaluationDelay         metric.Float64Histogram
 	hibernator              hibernation.Hibernator
+	recorder                record.EventRecorder
+	// shard selects the clusters of this replica when they are partitioned
+	// between plugin replicas.
+	shard Shard
+	// reports holds the pushed reports in push mode, where they replace the
+	// scrapes.
+	reports *reportStore
 
 	mu         sync.Mutex
 	lastActive map[types.NamespacedName]time.Time
+	// counters holds the latest counters of each instance, keyed by cluster
+	// and pod name, as the baseline for the next scrape.
+	counters map[types.NamespacedName]map[string]instanceCounters
+	// evaluated holds the clusters processed since the plugin started, whose
+	// checkpoints are no longer restored.
+	evaluated map[types.NamespacedName]struct{}
+	// schedules holds the next evaluation of each scheduled cluster, and
+	// scheduledRate the evaluations per second they add up to.
+	schedules     map[types.NamespacedName]clusterSchedule
+	scheduledRate float64
+	// random returns the jitter of the schedules, in [0, 1).
+	random func() float64
+	// results holds the latest result of each cluster, and targets and
+	// pendingInactive their totals.
+	results         map[types.NamespacedName]clusterResult
+	targets         int64
+	pendingInactive int64
+}
+
+// Shard selects the clusters a plugin replica processes. Changes receives a
+// value whenever the clusters it owns may have changed.
+type Shard interface {
+	Owns(uid types.UID) bool
+	Changes() <-chan struct{}
 }
 
 type Option func(*Scraper)
 
+// WithShard only processes the clusters the shard owns.
+func WithShard(shard Shard) Option {
+	return func(scraper *Scraper) {
+		scraper.shard = shard
+	}
+}
+
 // WithHibernator replaces the default CNPG hibernation behavior.
 func WithHibernator(hibernator hibernation.Hibernator) Option {
 	return func(scraper *Scraper) {
@@ -104,16 +233,31 @@ func WithHibernator(hibernator hibernation.Hibernator) Option {
 	}
 }
 
+// WithEventRecorder records Kubernetes Events on clusters, such as for
+// terminated idle sessions.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(scraper *Scraper) {
+		scraper.recorder = recorder
+	}
+}
+
 type clusterResult struct {
 	decision         string
-	eligible         bool
+	targets          int
 	inactivityWindow bool
 }
 
 func New(kubeClient client.Client, connectionsClient ConnectionsClient, cfg config.ScraperConfig, meter metric.Meter, options ...Option) (*Scraper, error) {
 	cfg = cfg.WithDefaults()
+	if cfg.Push.Enabled() && cfg.Push.Secret == "" {
+		return nil, errors.New("push mode requires a secret to verify reports")
+	}
 	if connectionsClient == nil {
-		connectionsClient = NewHTTPConnectionsClient(cfg.Timeout)
+		var tlsConfig *tls.Config
+		if cfg.TLS.Enabled() {
+			tlsConfig = mtls.ClientConfig(mtls.NewFiles(cfg.TLS.ScraperCertDir), cfg.TLS.ServerName)
+		}
+		connectionsClient = NewHTTPConnectionsClient(cfg.Timeout, tlsConfig)
 	}
 
 	scrapeDuration, err := meter.Float64Histogram(
@@ -125,14 +269,14 @@ func New(kubeClient client.Client, connectionsClient ConnectionsClient, cfg conf
 	if err != nil {
 		return nil, fmt.Errorf("create scrape duration histogram: %w", err)
 	}
-	cycleDuration, err := meter.Float64Histogram(
-		"cnpg_scale_to_zero_scraper_cycle_duration",
-		metric.WithDescription("Duration of complete scraper cycles"),
+	evaluationDuration, err := meter.Float64Histogram(
+		"cnpg_scale_to_zero_scraper_evaluation_duration",
+		metric.WithDescription("Duration of cluster evaluations"),
 		metric.WithUnit("s"),
-		metric.WithExplicitBucketBoundaries(.1, .25, .5, 1, 2, 5, 10, 30, 60),
+		metric.WithExplicitBucketBoundaries(.01, .05, .1, .25, .5, 1, 2, 5, 10),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("create cycle duration histogram: %w", err)
+		return nil, fmt.Errorf("create evaluation duration histogram: %w", err)
 	}
 	clusterDecisions, err := meter.Int64Counter(
 		"cnpg_scale_to_zero_scraper_cluster_decisions",
@@ -150,30 +294,72 @@ func New(kubeClient client.Client, connectionsClient ConnectionsClient, cfg conf
 	}
 	eligibleTargets, err := meter.Int64Gauge(
 		"cnpg_scale_to_zero_scraper_scrape_targets",
-		metric.WithDescription("Number of sidecar scrape targets in the latest cycle"),
+		metric.WithDescription("Number of sidecar scrape targets in the latest evaluation of each cluster"),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("create scrape targets gauge: %w", err)
 	}
 	pendingInactiveClusters, err := meter.Int64Gauge(
 		"cnpg_scale_to_zero_scraper_pending_inactive_clusters",
-		metric.WithDescription("Number of inactive clusters pending hibernation after the latest cycle"),
+		metric.WithDescription("Number of inactive clusters pending hibernation"),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("create pending inactive clusters gauge: %w", err)
 	}
+	terminatedSessions, err := meter.Int64Counter(
+		"cnpg_scale_to_zero_scraper_terminated_sessions",
+		metric.WithDescription("Number of idle sessions terminated before hibernation"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create terminated sessions counter: %w", err)
+	}
+	pushedReports, err := meter.Int64Counter(
+		"cnpg_scale_to_zero_scraper_pushed_reports",
+		metric.WithDescription("Number of activity reports pushed by sidecars"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create pushed reports counter: %w", err)
+	}
+	scheduledEvaluations, err := meter.Float64Gauge(
+		"cnpg_scale_to_zero_scraper_scheduled_evaluations_per_second",
+		metric.WithDescription("Cluster evaluations per second the current schedules add up to"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create scheduled evaluations gauge: %w", err)
+	}
+	evaluationDelay, err := meter.Float64Histogram(
+		"cnpg_scale_to_zero_scraper_evaluation_delay",
+		metric.WithDescription("Delay until the next evaluation of a cluster"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(1, 5, 15, 30, 60, 120, 300, 600, 1800),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create evaluation delay histogram: %w", err)
+	}
 
 	result := &Scraper{
 		client:                  kubeClient,
 		connectionsClient:       connectionsClient,
 		cfg:                     cfg,
 		scrapeDuration:          scrapeDuration,
-		cycleDuration:           cycleDuration,
+		evaluationDuration:      evaluationDuration,
 		clusterDecisions:        clusterDecisions,
 		hibernateAttempts:       hibernateAttempts,
 		eligibleTargets:         eligibleTargets,
 		pendingInactiveClusters: pendingInactiveClusters,
+		terminatedSessions:      terminatedSessions,
+		pushedReports:           pushedReports,
+		scheduledEvaluations:    scheduledEvaluations,
+		evaluationDelay:         evaluationDelay,
 		lastActive:              make(map[types.NamespacedName]time.Time),
+		counters:                make(map[types.NamespacedName]map[string]instanceCounters),
+		evaluated:               make(map[types.NamespacedName]struct{}),
+		schedules:               make(map[types.NamespacedName]clusterSchedule),
+		random:                  rand.Float64,
+		results:                 make(map[types.NamespacedName]clusterResult),
+	}
+	if cfg.Push.Enabled() {
+		result.reports = newReportStore()
 	}
 	result.hibernator = &defaultHibernator{client: kubeClient}
 	for _, apply := range options {
@@ -182,106 +368,12 @@ func New(kubeClient client.Client, connectionsClient ConnectionsClient, cfg conf
 	return result, nil
 }
 
-func (s *Scraper) Start(ctx context.Context) error {
-	ticker := time.NewTicker(s.cfg.Interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			start := time.Now()
-			if err := s.RunOnce(ctx, start); err != nil {
-				log.FromContext(ctx).Error(err, "scrape tick failed")
-			}
-			drainTicker(ticker)
-		}
-	}
-}
-
-func drainTicker(ticker *time.Ticker) {
-	for {
-		select {
-		case <-ticker.C:
-		default:
-			return
-		}
-	}
-}
-
-func (s *Scraper) RunOnce(ctx context.Context, now time.Time) (runErr error) {
-	cycleStart := time.Now()
-	defer func() {
-		result := scrapeResultSuccess
-		if runErr != nil {
-			result = scrapeResultError
-		}
-		s.cycleDuration.Record(
-			ctx,
-			time.Since(cycleStart).Seconds(),
-			metric.WithAttributes(attribute.String(scrapeResultAttribute, result)),
-		)
-	}()
-
-	clusters := &cnpgv1.ClusterList{}
-	if err := s.client.List(ctx, clusters); err != nil {
-		return fmt.Errorf("list clusters: %w", err)
-	}
-	s.pruneLastActive(clusters.Items)
-
-	// A fixed worker pool bounds goroutine and request growth when one cycle
-	// contains tens of thousands of clusters.
-	workerCount := min(s.cfg.Concurrency, len(clusters.Items))
-	jobs := make(chan *cnpgv1.Cluster)
-	results := make(chan clusterResult, workerCount)
-	var wg sync.WaitGroup
-
-	for range workerCount {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for cluster := range jobs {
-				results <- s.processCluster(ctx, cluster, now)
-			}
-		}()
-	}
-
-	go func() {
-		for i := range clusters.Items {
-			jobs <- &clusters.Items[i]
-		}
-		close(jobs)
-	}()
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	var eligibleTargets, pendingInactiveClusters int64
-	for result := range results {
-		s.clusterDecisions.Add(
-			ctx,
-			1,
-			metric.WithAttributes(attribute.String(decisionAttribute, result.decision)),
-		)
-		if result.eligible {
-			eligibleTargets++
-		}
-		if result.inactivityWindow {
-			pendingInactiveClusters++
-		}
-	}
-	s.eligibleTargets.Record(ctx, eligibleTargets)
-	s.pendingInactiveClusters.Record(ctx, pendingInactiveClusters)
-	return nil
-}
-
 // processCluster clears pending inactivity whenever activity cannot be
 // determined reliably. Hibernation requires consecutive successful scrapes.
 func (s *Scraper) processCluster(ctx context.Context, cluster *cnpgv1.Cluster, now time.Time) clusterResult {
 	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
 	logger := log.FromContext(ctx).WithValues("namespace", cluster.Namespace, "cluster", cluster.Name)
+	firstEvaluation := s.markEvaluated(key)
 
 	cfg := getClusterScaleToZeroConfig(cluster)
 	if !cfg.enabled {
@@ -303,6 +395,11 @@ func (s *Scraper) processCluster(ctx context.Context, cluster *cnpgv1.Cluster, n
 		logger.Info("cluster has no current primary, skipping hibernation")
 		return clusterResult{decision: decisionNotScrapeable}
 	}
+	if target := cluster.Status.TargetPrimary; target != "" && target != cluster.Status.CurrentPrimary {
+		s.clearLastActive(key)
+		logger.Info("cluster is changing primary, skipping hibernation", "currentPrimary", cluster.Status.CurrentPrimary, "targetPrimary", target)
+		return clusterResult{decision: decisionRoleMismatch}
+	}
 
 	pod := &corev1.Pod{}
 	if err := s.client.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Status.CurrentPrimary}, pod); err != nil {
@@ -313,39 +410,145 @@ func (s *Scraper) processCluster(ctx context.Context, cluster *cnpgv1.Cluster, n
 		return clusterResult{decision: decisionNotScrapeable}
 	}
 
-	if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.Labels[scaletozero.SidecarLabel] != scaletozero.SidecarLabelTrue {
+	if !isScrapeable(pod) {
 		s.clearLastActive(key)
 		logger.Info("primary pod is not scrapeable", "pod", pod.Name, "phase", pod.Status.Phase, "podIP", pod.Status.PodIP)
 		return clusterResult{decision: decisionNotScrapeable}
 	}
 
-	result := clusterResult{eligible: true}
-	scrapeCtx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
-	defer cancel()
-	scrapeStart := time.Now()
-	openConnections, err := s.connectionsClient.GetConnections(scrapeCtx, fmt.Sprintf("http://%s:%d/connections", pod.Status.PodIP, s.cfg.SidecarScrapePort))
-	scrapeResult := scrapeResultSuccess
+	replicas, err := s.replicaPods(ctx, cluster)
 	if err != nil {
-		scrapeResult = scrapeResultError
+		s.clearLastActive(key)
+		logger.Error(err, "replica pods cache lookup error")
+		return clusterResult{decision: decisionNotScrapeable}
 	}
-	metricOptions := metric.WithAttributes(attribute.String(scrapeResultAttribute, scrapeResult))
-	s.scrapeDuration.Record(ctx, time.Since(scrapeStart).Seconds(), metricOptions)
+
+	// The primary is always required. Replicas only serve reads, so the
+	// per-cluster policy decides whether an unreachable one blocks the
+	// evaluation.
+	result := clusterResult{targets: 1}
+	report, err := s.scrapeInstance(ctx, pod)
 	if err != nil {
 		s.clearLastActive(key)
 		logger.Error(err, "sidecar connection scrape error", "pod", pod.Name)
 		result.decision = decisionProbeError
 		return result
 	}
+	// A sample from an instance that is no longer the primary, such as the
+	// old primary during a failover, says nothing about the cluster.
+	if err := verifyInstance(cluster, report, true); err != nil {
+		s.clearLastActive(key)
+		logger.Info("rejecting sample from unexpected instance", "pod", pod.Name, "error", err.Error())
+		result.decision = decisionRoleMismatch
+		return result
+	}
 
-	if openConnections > 0 {
+	reports := map[string]instanceReport{pod.Name: {uid: pod.UID, baseURL: s.sidecarURL(pod), report: report}}
+	for i := range replicas {
+		replica := &replicas[i]
+		if !isScrapeable(replica) {
+			if cfg.unreachableReplicas == scaletozero.UnreachableReplicasIgnore {
+				logger.Info("ignoring replica pod that is not scrapeable", "pod", replica.Name, "phase", replica.Status.Phase, "podIP", replica.Status.PodIP)
+				continue
+			}
+			s.clearLastActive(key)
+			logger.Info("replica pod is not scrapeable", "pod", replica.Name, "phase", replica.Status.Phase, "podIP", replica.Status.PodIP)
+			result.decision = decisionNotScrapeable
+			return result
+		}
+
+		result.targets++
+		replicaReport, err := s.scrapeInstance(ctx, replica)
+		if err != nil {
+			if cfg.unreachableReplicas == scaletozero.UnreachableReplicasIgnore {
+				logger.Info("ignoring replica connection scrape error", "pod", replica.Name, "error", err.Error())
+				continue
+			}
+			s.clearLastActive(key)
+			logger.Error(err, "sidecar connection scrape error", "pod", replica.Name)
+			result.decision = decisionProbeError
+			return result
+		}
+		if err := verifyInstance(cluster, replicaReport, false); err != nil {
+			s.clearLastActive(key)
+			logger.Info("rejecting sample from unexpected instance", "pod", replica.Name, "error", err.Error())
+			result.decision = decisionRoleMismatch
+			return result
+		}
+		reports[replica.Name] = instanceReport{uid: replica.UID, baseURL: s.sidecarURL(replica), report: replicaReport}
+	}
+
+	previousCounters := s.swapCounters(key, reports)
+	// Hibernating would throw away the work of a running maintenance
+	// operation, so it blocks the cluster like activity does.
+	if maintenance := maintenanceOperations(reports); len(maintenance) > 0 {
 		s.setLastActive(key, now)
+		logger.Debug("cluster is running maintenance", "maintenance", maintenance)
+		result.decision = decisionMaintenance
+		return result
+	}
+	// Applications hold the cluster awake from inside PostgreSQL.
+	if holds := clusterHolds(reports); len(holds) > 0 {
+		s.setLastActive(key, now)
+		logger.Debug("cluster is held by applications", "holds", holds)
+		result.decision = decisionHold
+		return result
+	}
+	if reasons := activityReasons(reports, previousCounters, cfg); len(reasons) > 0 {
+		s.setLastActive(key, now)
+		activeReports := make(map[string]activity.Report, len(reasons))
+		for name := range reasons {
+			activeReports[name] = reports[name].report
+		}
+		logger.Debug("cluster is active", "reasons", reasons, "reports", activeReports)
+		// Terminated sessions still count as activity for this evaluation, so the
+		// inactivity window starts once they are gone. They are left alone
+		// when the cluster could not hibernate without them either.
+		if idleFor := time.Duration(cfg.terminateIdleMinutes) * time.Minute; idleFor > 0 && onlyIdleSessions(reports, reasons, idleFor) {
+			if blocker := hibernationBlocker(reports, cfg, now); blocker != "" {
+				logger.Debug("keeping idle sessions of a cluster that cannot hibernate", "decision", blocker)
+			} else {
+				s.terminateIdleSessions(ctx, cluster, reports, idleFor)
+			}
+		}
 		result.decision = decisionActive
 		return result
 	}
 
+	if decision := dependencyDecision(reports, cfg); decision != "" {
+		s.setLastActive(key, now)
+		dependencies := make(map[string]any, len(reports))
+		for name, current := range reports {
+			dependencies[name] = map[string]any{
+				"preparedTransactions": current.report.PreparedTransactions,
+				"replicationSlots":     current.report.ConsumedReplicationSlots(),
+			}
+		}
+		logger.Debug("cluster has external dependencies", "decision", decision, "dependencies", dependencies)
+		result.decision = decision
+		return result
+	}
+
 	result.decision = decisionInactive
 	result.inactivityWindow = true
 	lastActive, exists := s.getLastActive(key)
+	// After a restart, the first successful scrape resumes the window of the
+	// previous plugin process instead of starting a new one.
+	if !exists && firstEvaluation {
+		if restored, ok := s.restoreLastActive(cluster, now); ok {
+			lastActive, exists = restored, true
+			s.setLastActive(key, lastActive)
+			logger.Info("restored inactivity window from checkpoint", "idleSince", lastActive)
+		}
+	}
+	// Sidecar samplers cover the time between scrapes. Moving the window
+	// forward for activity they saw is always safe, while seeding a new window
+	// from their idle time needs every instance to vouch for it.
+	sampledLastActive, complete := sidecarLastActive(reports, now, cfg)
+	if !sampledLastActive.IsZero() && ((exists && sampledLastActive.After(lastActive)) || (!exists && complete)) {
+		lastActive, exists = sampledLastActive, true
+		s.setLastActive(key, lastActive)
+	}
 	if !exists {
 		s.setLastActive(key, now)
 		return result
@@ -355,36 +558,340 @@ func (s *Scraper) processCluster(ctx context.Context, cluster *cnpgv1.Cluster, n
 		return result
 	}
 
-	if err := s.hibernate(ctx, cluster); err != nil {
+	nextRun, scheduled := nextScheduledRun(reports, now)
+	scheduled = scheduled && !cfg.ignoreScheduledJobs
+	if scheduled && nextRun.Sub(now) < time.Duration(cfg.inactivityMinutes)*time.Minute {
+		logger.Debug("scheduled job is due within the inactivity window", "nextRun", nextRun)
+		result.decision = decisionScheduledJob
+		return result
+	}
+	var hibernationNextRun *time.Time
+	if scheduled {
+		hibernationNextRun = &nextRun
+	}
+
+	moved, err := s.hibernate(ctx, cluster, hibernationNextRun)
+	if err != nil {
 		s.hibernateAttempts.Add(ctx, 1, metric.WithAttributes(attribute.String(scrapeResultAttribute, scrapeResultError)))
 		logger.Error(err, "hibernation failed")
 		return result
 	}
+	if moved {
+		logger.Info("cluster moved to another replica, skipping hibernation")
+		result.decision = decisionMoved
+		result.inactivityWindow = false
+		return result
+	}
 	s.hibernateAttempts.Add(ctx, 1, metric.WithAttributes(attribute.String(scrapeResultAttribute, scrapeResultSuccess)))
 	result.inactivityWindow = false
 	return result
 }
 
-func (s *Scraper) hibernate(ctx context.Context, cluster *cnpgv1.Cluster) error {
-	// The cluster list came from the cache at the start of the cycle. Re-read it
-	// before mutation so a stale scrape cannot hibernate a changed cluster.
+// replicaPods returns the sidecar-labeled instance pods of the cluster other
+// than the current primary.
+func (s *Scraper) replicaPods(ctx context.Context, cluster *cnpgv1.Cluster) ([]corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := s.client.List(
+		ctx,
+		pods,
+		client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{
+			scaletozero.ClusterLabel: cluster.Name,
+			scaletozero.SidecarLabel: scaletozero.SidecarLabelTrue,
+		},
+	); err != nil {
+		return nil, fmt.Errorf("list cluster pods: %w", err)
+	}
+
+	replicas := make([]corev1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		if pods.Items[i].Name == cluster.Status.CurrentPrimary {
+			continue
+		}
+		replicas = append(replicas, pods.Items[i])
+	}
+	return replicas, nil
+}
+
+// scrapeInstance fetches the activity report of one instance. Sidecars
+// injected before the activity endpoint existed only report a connection
+// count, which is translated into an equivalent report. In push mode, the
+// latest pushed report is used instead.
+func (s *Scraper) scrapeInstance(ctx context.Context, pod *corev1.Pod) (activity.Report, error) {
+	if s.reports != nil {
+		return s.reports.latest(pod, time.Now(), s.cfg.Push.MaxAge())
+	}
+	scrapeCtx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	scrapeStart := time.Now()
+	baseURL := s.sidecarURL(pod)
+	report, err := s.connectionsClient.GetActivity(scrapeCtx, baseURL+"/activity")
+	if errors.Is(err, ErrActivityUnsupported) {
+		var openConnections int
+		openConnections, err = s.connectionsClient.GetConnections(scrapeCtx, baseURL+"/connections")
+		report = activity.Report{Version: activity.ReportVersion, Connections: openConnections}
+	}
+	scrapeResult := scrapeResultSuccess
+	if err != nil {
+		scrapeResult = scrapeResultError
+	}
+	metricOptions := metric.WithAttributes(attribute.String(scrapeResultAttribute, scrapeResult))
+	s.scrapeDuration.Record(ctx, time.Since(scrapeStart).Seconds(), metricOptions)
+	return report, err
+}
+
+func (s *Scraper) sidecarURL(pod *corev1.Pod) string {
+	scheme := "http"
+	if s.cfg.TLS.Enabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, pod.Status.PodIP, s.cfg.SidecarScrapePort)
+}
+
+type instanceReport struct {
+	uid     types.UID
+	baseURL string
+	report  activity.Report
+}
+
+// onlyIdleSessions reports whether the cluster is active only because of
+// sessions that have been idle for at least idleFor.
+func onlyIdleSessions(reports map[string]instanceReport, reasons map[string][]string, idleFor time.Duration) bool {
+	for name, instanceReasons := range reasons {
+		if !slices.Equal(instanceReasons, []string{"connections"}) || !reports[name].report.OnlyIdleSessions(idleFor) {
+			return false
+		}
+	}
+	return true
+}
+
+// terminateIdleSessions asks the sidecars of the instances with open
+// sessions to terminate the ones idle for at least idleFor, and records every
+// terminated session.
+func (s *Scraper) terminateIdleSessions(ctx context.Context, cluster *cnpgv1.Cluster, reports map[string]instanceReport, idleFor time.Duration) {
+	logger := log.FromContext(ctx).WithValues("namespace", cluster.Namespace, "cluster", cluster.Name)
+	for name, current := range reports {
+		if !current.report.Active() {
+			continue
+		}
+
+		terminateCtx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+		result, err := s.connectionsClient.TerminateIdleSessions(terminateCtx, current.baseURL+"/terminate", idleFor)
+		cancel()
+		if err != nil {
+			logger.Error(err, "idle session termination error", "pod", name)
+			continue
+		}
+
+		for _, session := range result.Sessions {
+			s.terminatedSessions.Add(ctx, 1, metric.WithAttributes(attribute.String(sessionStateAttribute, session.State)))
+			logger.Info("terminated idle session",
+				"pod", name,
+				"pid", session.PID,
+				"database", session.Database,
+				"user", session.User,
+				"applicationName", session.ApplicationName,
+				"state", session.State,
+				"stateChange", session.StateChange)
+			if s.recorder != nil {
+				s.recorder.Eventf(cluster, corev1.EventTypeNormal, idleSessionTerminatedReason,
+					"Terminated session %d of user %q on database %q (application %q) on pod %s, %s since %s",
+					session.PID, session.User, session.Database, session.ApplicationName, name, session.State,
+					session.StateChange.UTC().Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// sidecarLastActive translates the latest activity seen by the sidecar
+// samplers to the scraper clock. The result is complete when every instance
+// runs a sampler. Samplers count counter advances, so instances whose
+// counters are ignored do not contribute.
+func sidecarLastActive(reports map[string]instanceReport, now time.Time, cfg clusterScaleToZeroConfig) (time.Time, bool) {
+	var lastActive time.Time
+	complete := true
+	for _, current := range reports {
+		idleFor, known := current.report.IdleFor()
+		if !known || cfg.ignoresCounters(current.report) {
+			complete = false
+			continue
+		}
+		if candidate := now.Add(-idleFor); candidate.After(lastActive) {
+			lastActive = candidate
+		}
+	}
+	return lastActive, complete
+}
+
+type instanceCounters struct {
+	uid      types.UID
+	counters activity.Counters
+}
+
+// maintenanceOperations returns the maintenance operations in progress, keyed
+// by pod name.
+func maintenanceOperations(reports map[string]instanceReport) map[string][]activity.MaintenanceOperation {
+	operations := make(map[string][]activity.MaintenanceOperation)
+	for name, current := range reports {
+		if current.report.InMaintenance() {
+			operations[name] = current.report.Maintenance
+		}
+	}
+	return operations
+}
+
+// verifyInstance checks that a report comes from an instance of the cluster
+// with the expected role. The primary must also be on the cluster's current
+// timeline, so an old primary that still accepts connections after a
+// failover is not mistaken for the new one. The designated primary of a
+// replica cluster replays WAL from the source cluster, so it is in recovery
+// like the other instances. Reports without an instance come from sidecars
+// that predate it and are accepted.
+func verifyInstance(cluster *cnpgv1.Cluster, report activity.Report, primary bool) error {
+	instance := report.Instance
+	if instance == nil {
+		return nil
+	}
+	if primary && instance.InRecovery && !cluster.IsReplica() {
+		return errors.New("primary is in recovery")
+	}
+	if !primary && !instance.InRecovery {
+		return errors.New("replica is not in recovery")
+	}
+	if cluster.Status.SystemID != "" && instance.SystemIdentifier != cluster.Status.SystemID {
+		return fmt.Errorf("system identifier %s does not match cluster %s", instance.SystemIdentifier, cluster.Status.SystemID)
+	}
+	if primary && cluster.Status.TimelineID > 0 && instance.Timeline < int64(cluster.Status.TimelineID) {
+		return fmt.Errorf("timeline %d is behind cluster timeline %d", instance.Timeline, cluster.Status.TimelineID)
+	}
+	return nil
+}
+
+// clusterHolds returns the application holds, keyed by pod name.
+func clusterHolds(reports map[string]instanceReport) map[string][]activity.Hold {
+	holds := make(map[string][]activity.Hold)
+	for name, current := range reports {
+		if current.report.Held() {
+			holds[name] = current.report.Holds
+		}
+	}
+	return holds
+}
+
+// dependencyDecision returns the decision for a cluster that external systems
+// still depend on, or an empty string. Prepared transactions take precedence
+// over replication slots.
+func dependencyDecision(reports map[string]instanceReport, cfg clusterScaleToZeroConfig) string {
+	slots := false
+	for _, current := range reports {
+		if current.report.PreparedTransactions > 0 && !cfg.ignorePreparedTransactions {
+			return decisionPreparedTransactions
+		}
+		if len(current.report.ConsumedReplicationSlots()) > 0 && !cfg.ignoreReplicationSlots {
+			slots = true
+		}
+	}
+	if slots {
+		return decisionReplicationSlots
+	}
+	return ""
+}
+
+// hibernationBlocker returns the decision that would keep the cluster from
+// hibernating once its sessions are gone: an external dependency, or a
+// pg_cron job due within the inactivity window.
+func hibernationBlocker(reports map[string]instanceReport, cfg clusterScaleToZeroConfig, now time.Time) string {
+	if decision := dependencyDecision(reports, cfg); decision != "" {
+		return decision
+	}
+	nextRun, scheduled := nextScheduledRun(reports, now)
+	if scheduled && !cfg.ignoreScheduledJobs && nextRun.Sub(now) < time.Duration(cfg.inactivityMinutes)*time.Minute {
+		return decisionScheduledJob
+	}
+	return ""
+}
+
+// nextScheduledRun returns when the next pg_cron job of the cluster is due, by
+// the scraper clock, and whether any job is scheduled.
+func nextScheduledRun(reports map[string]instanceReport, now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, current := range reports {
+		run, scheduled := current.report.NextScheduledRun()
+		if !scheduled {
+			continue
+		}
+		// The sidecar clock is only compared with itself.
+		run = now.Add(run.Sub(current.report.GeneratedAt))
+		if next.IsZero() || run.Before(next) {
+			next = run
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// activityReasons explains why a cluster is active, keyed by pod name.
+// Counters only count once a baseline from the same pod exists.
+func activityReasons(reports map[string]instanceReport, previousCounters map[string]instanceCounters, cfg clusterScaleToZeroConfig) map[string][]string {
+	reasons := make(map[string][]string)
+	for name, current := range reports {
+		if current.report.Active() {
+			reasons[name] = append(reasons[name], "connections")
+		}
+		if current.report.CustomQueryActive() {
+			reasons[name] = append(reasons[name], "custom_query")
+		}
+		if current.report.SocketsActive() {
+			reasons[name] = append(reasons[name], "sockets")
+		}
+		if current.report.LogicalReplication.Walsenders > 0 && !cfg.ignoreWalsenders {
+			reasons[name] = append(reasons[name], "walsenders")
+		}
+		if current.report.LogicalReplication.ApplyingWorkers > 0 && !cfg.ignoreSubscribers {
+			reasons[name] = append(reasons[name], "subscription_apply")
+		}
+		previous, exists := previousCounters[name]
+		if current.report.Counters != nil && exists && previous.uid == current.uid && !cfg.ignoresCounters(current.report) &&
+			current.report.Counters.AdvancedSince(previous.counters) {
+			reasons[name] = append(reasons[name], "counters")
+		}
+	}
+	return reasons
+}
+
+func isScrapeable(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning &&
+		pod.Status.PodIP != "" &&
+		pod.Labels[scaletozero.SidecarLabel] == scaletozero.SidecarLabelTrue
+}
+
+// hibernate hibernates the cluster unless it changed during the evaluation.
+// It reports whether the cluster moved to another replica, which is left to
+// decide for it.
+func (s *Scraper) hibernate(ctx context.Context, cluster *cnpgv1.Cluster, nextScheduledRun *time.Time) (bool, error) {
+	// The cluster came from the cache at the start of the evaluation. Re-read
+	// it before mutation so a stale scrape cannot hibernate a changed cluster.
 	latest := &cnpgv1.Cluster{}
 	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
 	if err := s.client.Get(ctx, key, latest); err != nil {
-		return fmt.Errorf("retrieve cluster: %w", err)
+		return false, fmt.Errorf("retrieve cluster: %w", err)
 	}
 
 	if latest.Status.Phase != scaletozero.HealthyClusterStatus {
-		return nil
+		return false, nil
 	}
 	if latest.Annotations != nil && latest.Annotations[scaletozero.HibernationAnnotation] == scaletozero.HibernationAnnotationValueOn {
-		return nil
+		return false, nil
+	}
+	// The cluster may have moved to another replica during the evaluation.
+	if s.shard != nil && !s.shard.Owns(latest.UID) {
+		return true, nil
 	}
 
-	return s.hibernator.Hibernate(ctx, hibernation.Target{
-		Key:             key,
-		UID:             latest.UID,
-		OwnerReferences: append([]metav1.OwnerReference(nil), latest.OwnerReferences...),
+	return false, s.hibernator.Hibernate(ctx, hibernation.Target{
+		Key:              key,
+		UID:              latest.UID,
+		OwnerReferences:  append([]metav1.OwnerReference(nil), latest.OwnerReferences...),
+		NextScheduledRun: nextScheduledRun,
 	})
 }
 
@@ -412,6 +919,11 @@ func (h *defaultHibernator) Hibernate(ctx context.Context, target hibernation.Ta
 		cluster.Annotations = make(map[string]string)
 	}
 	cluster.Annotations[scaletozero.HibernationAnnotation] = scaletozero.HibernationAnnotationValueOn
+	if target.NextScheduledRun != nil {
+		cluster.Annotations[scaletozero.NextScheduledRunAnnotation] = target.NextScheduledRun.UTC().Format(time.RFC3339)
+	} else {
+		delete(cluster.Annotations, scaletozero.NextScheduledRunAnnotation)
+	}
 	if err := h.client.Patch(ctx, cluster, client.MergeFrom(patchBase)); err != nil {
 		return err
 	}
@@ -452,35 +964,47 @@ func (s *Scraper) clearLastActive(key types.NamespacedName) {
 	delete(s.lastActive, key)
 }
 
-func (s *Scraper) pruneLastActive(clusters []cnpgv1.Cluster) {
+// swapCounters stores the counters of the latest reports as the new baseline
+// of the cluster and returns the previous one.
+func (s *Scraper) swapCounters(key types.NamespacedName, reports map[string]instanceReport) map[string]instanceCounters {
+	current := make(map[string]instanceCounters, len(reports))
+	for name, report := range reports {
+		if report.report.Counters != nil {
+			current[name] = instanceCounters{uid: report.uid, counters: *report.report.Counters}
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	// The inactivity map outlives each cache list, so deleted clusters must be
-	// removed explicitly.
-	stale := make(map[types.NamespacedName]struct{}, len(s.lastActive))
-	for key := range s.lastActive {
-		stale[key] = struct{}{}
-	}
-	for i := range clusters {
-		delete(stale, types.NamespacedName{
-			Namespace: clusters[i].Namespace,
-			Name:      clusters[i].Name,
-		})
-	}
-	for key := range stale {
-		delete(s.lastActive, key)
-	}
+	previous := s.counters[key]
+	s.counters[key] = current
+	return previous
 }
 
 type clusterScaleToZeroConfig struct {
-	enabled           bool
-	inactivityMinutes int
+	enabled             bool
+	inactivityMinutes   int
+	unreachableReplicas string
+	// terminateIdleMinutes is zero unless idle session termination is enabled
+	terminateIdleMinutes       int
+	ignorePreparedTransactions bool
+	ignoreReplicationSlots     bool
+	ignoreWalsenders           bool
+	ignoreSubscribers          bool
+	ignoreScheduledJobs        bool
+}
+
+// ignoresCounters reports whether the counters of an instance are ignored.
+// Applied changes advance them like client writes do, so they cannot be told
+// apart on an instance applying subscriptions that should not count.
+func (cfg clusterScaleToZeroConfig) ignoresCounters(report activity.Report) bool {
+	return cfg.ignoreSubscribers && report.LogicalReplication.Workers > 0
 }
 
 func getClusterScaleToZeroConfig(cluster *cnpgv1.Cluster) clusterScaleToZeroConfig {
 	result := clusterScaleToZeroConfig{
-		inactivityMinutes: scaletozero.DefaultInactivityMinutes,
+		inactivityMinutes:   scaletozero.DefaultInactivityMinutes,
+		unreachableReplicas: scaletozero.UnreachableReplicasBlock,
 	}
 	if cluster.Annotations == nil {
 		return result
@@ -495,6 +1019,31 @@ func getClusterScaleToZeroConfig(cluster *cnpgv1.Cluster) clusterScaleToZeroConf
 			result.inactivityMinutes = parsed
 		}
 	}
+	if cluster.Annotations[scaletozero.UnreachableReplicasAnnotation] == scaletozero.UnreachableReplicasIgnore {
+		result.unreachableReplicas = scaletozero.UnreachableReplicasIgnore
+	}
+	if cluster.Annotations[scaletozero.LogicalWalsendersAnnotation] == scaletozero.LogicalReplicationIgnore {
+		result.ignoreWalsenders = true
+	}
+	if cluster.Annotations[scaletozero.LogicalSubscribersAnnotation] == scaletozero.LogicalReplicationIgnore {
+		result.ignoreSubscribers = true
+	}
+	for _, dependency := range activity.ParseList(cluster.Annotations[scaletozero.IgnoreDependenciesAnnotation]) {
+		switch dependency {
+		case scaletozero.DependencyPreparedTransactions:
+			result.ignorePreparedTransactions = true
+		case scaletozero.DependencyReplicationSlots:
+			result.ignoreReplicationSlots = true
+		case scaletozero.DependencyScheduledJobs:
+			result.ignoreScheduledJobs = true
+		}
+	}
+	if value, exists := cluster.Annotations[scaletozero.TerminateIdleAnnotation]; exists {
+		parsed, err := strconv.Atoi(value)
+		if err == nil && parsed > 0 {
+			result.terminateIdleMinutes = parsed
+		}
+	}
 
 	return result
 }
@@ -2,11 +2,11 @@ package scraper
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	goruntime "runtime"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +15,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
 	pluginmetrics "github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/metrics"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/scaletozero"
@@ -26,6 +27,8 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -39,7 +42,7 @@ func TestScraperActiveScrapePreventsHibernation(t *testing.T) {
 	)
 	s := newTestScraper(t, kubeClient, &fakeConnectionsClient{openConnections: 1}, testConfig())
 
-	require.NoError(t, s.RunOnce(context.Background(), time.Now()))
+	reconcileAll(t, s, time.Now())
 
 	cluster := getCluster(t, kubeClient, "default", "cluster")
 	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
@@ -56,11 +59,11 @@ func TestScraperZeroConnectionsHibernateAfterInactivityPeriod(t *testing.T) {
 	s := newTestScraper(t, kubeClient, &fakeConnectionsClient{openConnections: 0}, testConfig())
 	now := time.Now()
 
-	require.NoError(t, s.RunOnce(context.Background(), now))
+	reconcileAll(t, s, now)
 	cluster := getCluster(t, kubeClient, "default", "cluster")
 	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
 
-	require.NoError(t, s.RunOnce(context.Background(), now.Add(11*time.Minute)))
+	reconcileAll(t, s, now.Add(11*time.Minute))
 
 	cluster = getCluster(t, kubeClient, "default", "cluster")
 	require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
@@ -98,8 +101,8 @@ func TestScraperDelegatesHibernationWithoutMutatingCNPGResources(t *testing.T) {
 	)
 	now := time.Now()
 
-	require.NoError(t, s.RunOnce(context.Background(), now))
-	require.NoError(t, s.RunOnce(context.Background(), now.Add(11*time.Minute)))
+	reconcileAll(t, s, now)
+	reconcileAll(t, s, now.Add(11*time.Minute))
 
 	require.Equal(t, hibernation.Target{
 		Key:             types.NamespacedName{Namespace: "default", Name: "cluster"},
@@ -148,15 +151,15 @@ func TestScraperUnknownScrapeNeverHibernates(t *testing.T) {
 	s := newTestScraper(t, kubeClient, probe, testConfig())
 	now := time.Now()
 
-	require.NoError(t, s.RunOnce(context.Background(), now))
+	reconcileAll(t, s, now)
 
 	probe.err = errors.New("probe failed")
-	require.NoError(t, s.RunOnce(context.Background(), now.Add(20*time.Minute)))
+	reconcileAll(t, s, now.Add(20*time.Minute))
 	cluster := getCluster(t, kubeClient, "default", "cluster")
 	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
 
 	probe.err = nil
-	require.NoError(t, s.RunOnce(context.Background(), now.Add(21*time.Minute)))
+	reconcileAll(t, s, now.Add(21*time.Minute))
 	cluster = getCluster(t, kubeClient, "default", "cluster")
 	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
 }
@@ -172,16 +175,774 @@ func TestScraperRemovesInactivityStateForDeletedClusters(t *testing.T) {
 	s := newTestScraper(t, kubeClient, &fakeConnectionsClient{openConnections: 0}, testConfig())
 	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
 
-	require.NoError(t, s.RunOnce(context.Background(), time.Now()))
+	reconcileAll(t, s, time.Now())
 	_, exists := s.getLastActive(key)
 	require.True(t, exists)
 
 	require.NoError(t, kubeClient.Delete(context.Background(), cluster))
-	require.NoError(t, s.RunOnce(context.Background(), time.Now()))
+	result, err := s.reconcile(context.Background(), key, time.Now())
+	require.NoError(t, err)
+	require.Zero(t, result)
 	_, exists = s.getLastActive(key)
 	require.False(t, exists)
 }
 
+func TestScraperProcessesOnlyItsShard(t *testing.T) {
+	t.Parallel()
+
+	owned := enabledCluster("default", "owned", "owned-1", "10")
+	owned.UID = "owned-uid"
+	other := enabledCluster("default", "other", "other-1", "10")
+	other.UID = "other-uid"
+	kubeClient := fakeClient(
+		owned,
+		other,
+		runningPrimary("default", "owned", "owned-1", "10.0.0.1"),
+		runningPrimary("default", "other", "other-1", "10.0.0.2"),
+	)
+	probe := &fakeConnectionsClient{}
+	shard := fakeShard{"owned-uid": true}
+	hibernator := &recordingHibernator{}
+	s := newTestScraper(t, kubeClient, probe, testConfig(), WithShard(shard), WithHibernator(hibernator))
+	otherKey := types.NamespacedName{Namespace: "default", Name: "other"}
+	now := time.Now()
+
+	s.setLastActive(otherKey, now.Add(-time.Hour))
+	reconcileAll(t, s, now)
+	require.Equal(t, []string{"http://10.0.0.1:9188/activity"}, probe.urls)
+	_, exists := s.getLastActive(otherKey)
+	require.False(t, exists)
+
+	// A cluster that moves away during the cycle is skipped, without
+	// hibernation or error.
+	shard["owned-uid"] = false
+	s.setLastActive(types.NamespacedName{Namespace: "default", Name: "owned"}, now.Add(-time.Hour))
+	result := s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "owned"), now)
+	require.Equal(t, decisionMoved, result.decision)
+	require.False(t, result.inactivityWindow)
+	require.Empty(t, hibernator.target.Key.Name)
+}
+
+func TestScraperReplicaActivityPreventsHibernation(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+		runningReplica("default", "cluster", "cluster-2", "10.0.0.2"),
+	)
+	probe := &fakeConnectionsClient{
+		connectionsByURL: map[string]int{"http://10.0.0.2:9188/activity": 2},
+	}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	now := time.Now()
+
+	reconcileAll(t, s, now)
+	reconcileAll(t, s, now.Add(11*time.Minute))
+
+	require.Equal(t, 4, probe.callCount())
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperCounterAdvancePreventsHibernation(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{counters: &activity.Counters{XactCommit: 10, WALPosition: 100}}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	now := time.Now()
+
+	reconcileAll(t, s, now)
+	lastActive, exists := s.getLastActive(key)
+	require.True(t, exists)
+	require.Equal(t, now, lastActive)
+
+	probe.counters = &activity.Counters{XactCommit: 11, WALPosition: 100}
+	reconcileAll(t, s, now.Add(11*time.Minute))
+	lastActive, _ = s.getLastActive(key)
+	require.Equal(t, now.Add(11*time.Minute), lastActive)
+
+	reconcileAll(t, s, now.Add(15*time.Minute))
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+
+	reconcileAll(t, s, now.Add(22*time.Minute))
+	cluster = getCluster(t, kubeClient, "default", "cluster")
+	require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperMaintenancePreventsHibernation(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{
+		maintenance: []activity.MaintenanceOperation{{Kind: activity.MaintenanceCreateIndex, Database: "app", Count: 1}},
+	}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	now := time.Now()
+
+	require.Equal(t, decisionMaintenance, s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now).decision)
+	require.Equal(t, decisionMaintenance, s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now.Add(11*time.Minute)).decision)
+	lastActive, exists := s.getLastActive(key)
+	require.True(t, exists)
+	require.Equal(t, now.Add(11*time.Minute), lastActive)
+
+	probe.maintenance = nil
+	reconcileAll(t, s, now.Add(15*time.Minute))
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+
+	reconcileAll(t, s, now.Add(22*time.Minute))
+	cluster = getCluster(t, kubeClient, "default", "cluster")
+	require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperHoldsPreventHibernation(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{
+		holds: []activity.Hold{{Source: activity.HoldAdvisoryLock, Database: "app", Holder: "importer"}},
+	}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	now := time.Now()
+
+	require.Equal(t, decisionHold, s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now).decision)
+	require.Equal(t, decisionHold, s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now.Add(11*time.Minute)).decision)
+	lastActive, exists := s.getLastActive(key)
+	require.True(t, exists)
+	require.Equal(t, now.Add(11*time.Minute), lastActive)
+
+	probe.holds = nil
+	reconcileAll(t, s, now.Add(15*time.Minute))
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+
+	reconcileAll(t, s, now.Add(22*time.Minute))
+	cluster = getCluster(t, kubeClient, "default", "cluster")
+	require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperRejectsUnexpectedInstance(t *testing.T) {
+	t.Parallel()
+
+	const (
+		primaryURL = "http://10.0.0.1:9188/activity"
+		replicaURL = "http://10.0.0.2:9188/activity"
+		systemID   = "7412345678901234567"
+	)
+	primary := activity.Instance{Timeline: 3, SystemIdentifier: systemID}
+	replica := activity.Instance{InRecovery: true, Timeline: 3, SystemIdentifier: systemID}
+	tests := []struct {
+		name             string
+		targetPrimary    string
+		replicaCluster   bool
+		instances        map[string]activity.Instance
+		expectedDecision string
+	}{
+		{
+			name:             "expected roles",
+			instances:        map[string]activity.Instance{primaryURL: primary, replicaURL: replica},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "designated primary of a replica cluster",
+			replicaCluster:   true,
+			instances:        map[string]activity.Instance{primaryURL: replica, replicaURL: replica},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "designated primary behind cluster timeline",
+			replicaCluster:   true,
+			instances:        map[string]activity.Instance{primaryURL: {InRecovery: true, Timeline: 2, SystemIdentifier: systemID}, replicaURL: replica},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name:           "replica cluster replica out of recovery",
+			replicaCluster: true,
+			instances: map[string]activity.Instance{
+				primaryURL: replica,
+				replicaURL: {Timeline: 4, SystemIdentifier: systemID},
+			},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name:             "sidecars without instance",
+			expectedDecision: decisionInactive,
+		},
+		{
+			name: "primary in recovery",
+			instances: map[string]activity.Instance{
+				primaryURL: {InRecovery: true, Timeline: 3, SystemIdentifier: systemID},
+				replicaURL: replica,
+			},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name: "primary behind cluster timeline",
+			instances: map[string]activity.Instance{
+				primaryURL: {Timeline: 2, SystemIdentifier: systemID},
+				replicaURL: replica,
+			},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name: "other system",
+			instances: map[string]activity.Instance{
+				primaryURL: {Timeline: 3, SystemIdentifier: "7400000000000000000"},
+				replicaURL: replica,
+			},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name: "promoted replica",
+			instances: map[string]activity.Instance{
+				primaryURL: primary,
+				replicaURL: {Timeline: 4, SystemIdentifier: systemID},
+			},
+			expectedDecision: decisionRoleMismatch,
+		},
+		{
+			name:             "switchover in progress",
+			targetPrimary:    "cluster-2",
+			instances:        map[string]activity.Instance{primaryURL: primary, replicaURL: replica},
+			expectedDecision: decisionRoleMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := enabledCluster("default", "cluster", "cluster-1", "10")
+			cluster.Status.SystemID = systemID
+			cluster.Status.TimelineID = 3
+			cluster.Status.TargetPrimary = tt.targetPrimary
+			if tt.replicaCluster {
+				cluster.Spec.ReplicaCluster = &cnpgv1.ReplicaClusterConfiguration{Enabled: ptr.To(true), Source: "origin"}
+			}
+			kubeClient := fakeClient(
+				cluster,
+				runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+				runningReplica("default", "cluster", "cluster-2", "10.0.0.2"),
+			)
+			probe := &fakeConnectionsClient{instancesByURL: tt.instances}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+			key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+			now := time.Now()
+
+			s.setLastActive(key, now.Add(-time.Hour))
+			result := s.processCluster(context.Background(), getCluster(t, kubeClient, "default", "cluster"), now)
+			require.Equal(t, tt.expectedDecision, result.decision)
+			if tt.expectedDecision == decisionRoleMismatch {
+				_, exists := s.getLastActive(key)
+				require.False(t, exists)
+			}
+		})
+	}
+}
+
+func TestScraperLogicalReplicationPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		replication      activity.LogicalReplication
+		advanceCounters  bool
+		expectedDecision string
+	}{
+		{
+			name:             "publisher walsenders count",
+			replication:      activity.LogicalReplication{Walsenders: 1},
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "publisher walsenders ignored",
+			annotations:      map[string]string{scaletozero.LogicalWalsendersAnnotation: scaletozero.LogicalReplicationIgnore},
+			replication:      activity.LogicalReplication{Walsenders: 1},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "applying subscriber counts",
+			replication:      activity.LogicalReplication{Workers: 1, ApplyingWorkers: 1},
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "idle subscriber",
+			replication:      activity.LogicalReplication{Workers: 1},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "applied changes count",
+			replication:      activity.LogicalReplication{Workers: 1},
+			advanceCounters:  true,
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "applying subscriber ignored",
+			annotations:      map[string]string{scaletozero.LogicalSubscribersAnnotation: scaletozero.LogicalReplicationIgnore},
+			replication:      activity.LogicalReplication{Workers: 1, ApplyingWorkers: 1},
+			advanceCounters:  true,
+			expectedDecision: decisionInactive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := clusterWithPhase("default", "cluster", "cluster-1", "10", string(scaletozero.HealthyClusterStatus), tt.annotations)
+			kubeClient := fakeClient(cluster, runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+			probe := &fakeConnectionsClient{
+				replication: tt.replication,
+				counters:    &activity.Counters{XactCommit: 1},
+			}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+			now := time.Now()
+
+			s.processCluster(context.Background(), cluster, now)
+			if tt.advanceCounters {
+				probe.counters = &activity.Counters{XactCommit: 2}
+			}
+			require.Equal(t, tt.expectedDecision, s.processCluster(context.Background(), cluster, now.Add(time.Minute)).decision)
+		})
+	}
+}
+
+func TestScraperAdditionalActivitySignals(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		customQuery      *activity.CustomQueryResult
+		sockets          *activity.SocketActivity
+		expectedDecision string
+	}{
+		{
+			name:             "no signals",
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "query reports activity",
+			customQuery:      &activity.CustomQueryResult{Name: "jobs/pending", Value: 3},
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "query reports no activity",
+			customQuery:      &activity.CustomQueryResult{Name: "jobs/pending", Value: 0},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "connections in handshake",
+			sockets:          &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 1},
+			expectedDecision: decisionActive,
+		},
+		{
+			name:             "attached sockets only",
+			sockets:          &activity.SocketActivity{Established: 2, Peers: 1},
+			expectedDecision: decisionInactive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := clusterWithPhase("default", "cluster", "cluster-1", "10", string(scaletozero.HealthyClusterStatus), nil)
+			kubeClient := fakeClient(cluster, runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+			probe := &fakeConnectionsClient{customQuery: tt.customQuery, sockets: tt.sockets}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+
+			require.Equal(t, tt.expectedDecision, s.processCluster(context.Background(), cluster, time.Now()).decision)
+		})
+	}
+}
+
+func TestScraperScheduledJobs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name                string
+		annotations         map[string]string
+		nextRunIn           *time.Duration
+		expectedDecision    string
+		expectedHibernation bool
+		expectedNextRun     bool
+	}{
+		{
+			name:                "due within the inactivity window",
+			nextRunIn:           ptr.To(5 * time.Minute),
+			expectedDecision:    decisionScheduledJob,
+			expectedHibernation: false,
+		},
+		{
+			name:                "unknown next run",
+			expectedDecision:    decisionScheduledJob,
+			expectedHibernation: false,
+		},
+		{
+			name:                "due after the inactivity window",
+			nextRunIn:           ptr.To(2 * time.Hour),
+			expectedDecision:    decisionInactive,
+			expectedHibernation: true,
+			expectedNextRun:     true,
+		},
+		{
+			name:                "ignored",
+			annotations:         map[string]string{scaletozero.IgnoreDependenciesAnnotation: scaletozero.DependencyScheduledJobs},
+			nextRunIn:           ptr.To(5 * time.Minute),
+			expectedDecision:    decisionInactive,
+			expectedHibernation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			annotations := map[string]string{scaletozero.NextScheduledRunAnnotation: "2020-01-01T00:00:00Z"}
+			for key, value := range tt.annotations {
+				annotations[key] = value
+			}
+			cluster := clusterWithPhase("default", "cluster", "cluster-1", "10", string(scaletozero.HealthyClusterStatus), annotations)
+			kubeClient := fakeClient(cluster, runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+			job := activity.ScheduledJob{ID: 1, Name: "nightly", Schedule: "0 3 * * *"}
+			if tt.nextRunIn != nil {
+				job.NextRun = ptr.To(time.Now().Add(*tt.nextRunIn))
+			}
+			probe := &fakeConnectionsClient{scheduledJobs: []activity.ScheduledJob{job}}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+			now := time.Now()
+
+			s.processCluster(context.Background(), cluster, now)
+			require.Equal(t, tt.expectedDecision, s.processCluster(context.Background(), cluster, now.Add(11*time.Minute)).decision)
+
+			latest := getCluster(t, kubeClient, "default", "cluster")
+			require.Equal(t, tt.expectedHibernation, latest.Annotations[scaletozero.HibernationAnnotation] == scaletozero.HibernationAnnotationValueOn)
+			if !tt.expectedHibernation {
+				return
+			}
+			nextRun, recorded := latest.Annotations[scaletozero.NextScheduledRunAnnotation]
+			require.Equal(t, tt.expectedNextRun, recorded)
+			if tt.expectedNextRun {
+				parsed, err := time.Parse(time.RFC3339, nextRun)
+				require.NoError(t, err)
+				require.WithinDuration(t, now.Add(11*time.Minute+*tt.nextRunIn), parsed, time.Minute)
+			}
+		})
+	}
+}
+
+func TestScraperExternalDependenciesPreventHibernation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		prepared         int
+		slots            []activity.ReplicationSlot
+		expectedDecision string
+	}{
+		{
+			name:             "prepared transactions",
+			prepared:         1,
+			slots:            []activity.ReplicationSlot{{Name: "cdc", Active: true}},
+			expectedDecision: decisionPreparedTransactions,
+		},
+		{
+			name:             "active replication slot",
+			slots:            []activity.ReplicationSlot{{Name: "cdc", Active: true}},
+			expectedDecision: decisionReplicationSlots,
+		},
+		{
+			name:             "lagging replication slot",
+			slots:            []activity.ReplicationSlot{{Name: "cdc", LagBytes: 1024}},
+			expectedDecision: decisionReplicationSlots,
+		},
+		{
+			name:             "caught up replication slot",
+			slots:            []activity.ReplicationSlot{{Name: "cdc"}},
+			expectedDecision: decisionInactive,
+		},
+		{
+			name:             "ignored prepared transactions",
+			annotations:      map[string]string{scaletozero.IgnoreDependenciesAnnotation: "prepared-transactions"},
+			prepared:         1,
+			slots:            []activity.ReplicationSlot{{Name: "cdc", Active: true}},
+			expectedDecision: decisionReplicationSlots,
+		},
+		{
+			name:             "ignored dependencies",
+			annotations:      map[string]string{scaletozero.IgnoreDependenciesAnnotation: "prepared-transactions, replication-slots"},
+			prepared:         1,
+			slots:            []activity.ReplicationSlot{{Name: "cdc", Active: true}},
+			expectedDecision: decisionInactive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cluster := clusterWithPhase("default", "cluster", "cluster-1", "10", string(scaletozero.HealthyClusterStatus), tt.annotations)
+			kubeClient := fakeClient(cluster, runningReplica("default", "cluster", "cluster-2", "10.0.0.2"), runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"))
+			probe := &fakeConnectionsClient{prepared: tt.prepared, slots: tt.slots}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+			now := time.Now()
+
+			require.Equal(t, tt.expectedDecision, s.processCluster(context.Background(), cluster, now).decision)
+			require.Equal(t, tt.expectedDecision, s.processCluster(context.Background(), cluster, now.Add(11*time.Minute)).decision)
+			hibernated := getCluster(t, kubeClient, "default", "cluster")
+			require.Equal(t,
+				tt.expectedDecision == decisionInactive,
+				hibernated.Annotations[scaletozero.HibernationAnnotation] == scaletozero.HibernationAnnotationValueOn)
+		})
+	}
+}
+
+func TestScraperSeedsInactivityFromSidecarSampler(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{idleFor: ptr.To(15 * time.Minute)}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+
+	reconcileAll(t, s, time.Now())
+
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperSidecarSamplerActivityMovesInactivityWindow(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+		runningReplica("default", "cluster", "cluster-2", "10.0.0.2"),
+	)
+	probe := &fakeConnectionsClient{}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	key := types.NamespacedName{Namespace: "default", Name: "cluster"}
+	now := time.Now()
+
+	reconcileAll(t, s, now)
+
+	// A burst between scrapes moves the window even though no session is
+	// open when the next scrape runs.
+	probe.idleFor = ptr.To(time.Minute)
+	reconcileAll(t, s, now.Add(11*time.Minute))
+	lastActive, exists := s.getLastActive(key)
+	require.True(t, exists)
+	require.WithinDuration(t, now.Add(10*time.Minute), lastActive, time.Second)
+
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperFallsBackToConnectionsForLegacySidecars(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient(
+		enabledCluster("default", "cluster", "cluster-1", "10"),
+		runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+	)
+	probe := &fakeConnectionsClient{openConnections: 1, legacy: true}
+	s := newTestScraper(t, kubeClient, probe, testConfig())
+	now := time.Now()
+
+	reconcileAll(t, s, now)
+	reconcileAll(t, s, now.Add(11*time.Minute))
+
+	require.Equal(t, []string{"http://10.0.0.1:9188/connections", "http://10.0.0.1:9188/connections"}, probe.urls)
+	cluster := getCluster(t, kubeClient, "default", "cluster")
+	require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+}
+
+func TestScraperTerminatesIdleSessions(t *testing.T) {
+	t.Parallel()
+
+	stale := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name              string
+		annotations       map[string]string
+		sessions          []activity.SessionGroup
+		prepared          int
+		slots             []activity.ReplicationSlot
+		scheduledJobs     []activity.ScheduledJob
+		expectedTerminate []string
+	}{
+		{
+			name:              "stale idle sessions",
+			annotations:       map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:          []activity.SessionGroup{{State: "idle in transaction", Count: 1, LastStateChange: &stale}},
+			expectedTerminate: []string{"http://10.0.0.1:9188/terminate"},
+		},
+		{
+			name:        "recent idle session",
+			annotations: map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:    []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &recent}},
+		},
+		{
+			name:        "active session",
+			annotations: map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:    []activity.SessionGroup{{State: "active", Count: 1, LastStateChange: &stale}},
+		},
+		{
+			name:     "termination disabled",
+			sessions: []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &stale}},
+		},
+		{
+			name:        "prepared transactions",
+			annotations: map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:    []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &stale}},
+			prepared:    1,
+		},
+		{
+			name:        "consumed replication slot",
+			annotations: map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:    []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &stale}},
+			slots:       []activity.ReplicationSlot{{Name: "cdc", Active: true}},
+		},
+		{
+			name:          "scheduled job due within the inactivity window",
+			annotations:   map[string]string{scaletozero.TerminateIdleAnnotation: "60"},
+			sessions:      []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &stale}},
+			scheduledJobs: []activity.ScheduledJob{{ID: 1, Name: "vacuum", NextRun: ptr.To(time.Now().Add(5 * time.Minute))}},
+		},
+		{
+			name: "ignored prepared transactions",
+			annotations: map[string]string{
+				scaletozero.TerminateIdleAnnotation:      "60",
+				scaletozero.IgnoreDependenciesAnnotation: scaletozero.DependencyPreparedTransactions,
+			},
+			sessions:          []activity.SessionGroup{{State: "idle", Count: 1, LastStateChange: &stale}},
+			prepared:          1,
+			expectedTerminate: []string{"http://10.0.0.1:9188/terminate"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubeClient := fakeClient(
+				clusterWithPhase("default", "cluster", "cluster-1", "10", string(scaletozero.HealthyClusterStatus), tt.annotations),
+				runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+			)
+			probe := &fakeConnectionsClient{
+				openConnections: 1,
+				sessions:        tt.sessions,
+				prepared:        tt.prepared,
+				slots:           tt.slots,
+				scheduledJobs:   tt.scheduledJobs,
+				terminated: []activity.TerminatedSession{
+					{PID: 42, Database: "app", User: "app", ApplicationName: "api", State: "idle in transaction", StateChange: stale},
+				},
+			}
+			recorder := record.NewFakeRecorder(10)
+			s := newTestScraper(t, kubeClient, probe, testConfig(), WithEventRecorder(recorder))
+
+			reconcileAll(t, s, time.Now())
+
+			require.Equal(t, tt.expectedTerminate, probe.terminateURLs)
+			if tt.expectedTerminate == nil {
+				require.Empty(t, recorder.Events)
+				return
+			}
+			require.Len(t, recorder.Events, 1)
+			event := <-recorder.Events
+			require.Contains(t, event, "Normal IdleSessionTerminated Terminated session 42 of user \"app\" on database \"app\"")
+			require.Contains(t, event, "on pod cluster-1")
+		})
+	}
+}
+
+func TestScraperUnreachableReplicaPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name              string
+		policy            string
+		replica           *corev1.Pod
+		replicaErr        error
+		expectHibernation bool
+	}{
+		{
+			name:    "default blocks on non-running replica",
+			replica: primaryPod("default", "cluster", "cluster-2", "10.0.0.2", corev1.PodPending, true),
+		},
+		{
+			name:       "block on replica probe error",
+			policy:     scaletozero.UnreachableReplicasBlock,
+			replica:    runningReplica("default", "cluster", "cluster-2", "10.0.0.2"),
+			replicaErr: errors.New("probe failed"),
+		},
+		{
+			name:              "ignore non-running replica",
+			policy:            scaletozero.UnreachableReplicasIgnore,
+			replica:           primaryPod("default", "cluster", "cluster-2", "10.0.0.2", corev1.PodPending, true),
+			expectHibernation: true,
+		},
+		{
+			name:              "ignore replica probe error",
+			policy:            scaletozero.UnreachableReplicasIgnore,
+			replica:           runningReplica("default", "cluster", "cluster-2", "10.0.0.2"),
+			replicaErr:        errors.New("probe failed"),
+			expectHibernation: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			annotations := map[string]string{}
+			if tc.policy != "" {
+				annotations[scaletozero.UnreachableReplicasAnnotation] = tc.policy
+			}
+			kubeClient := fakeClient(
+				clusterWithPhase("default", "cluster", "cluster-1", "10", scaletozero.HealthyClusterStatus, annotations),
+				runningPrimary("default", "cluster", "cluster-1", "10.0.0.1"),
+				tc.replica,
+			)
+			probe := &fakeConnectionsClient{
+				errorsByURL: map[string]error{"http://10.0.0.2:9188/activity": tc.replicaErr},
+			}
+			s := newTestScraper(t, kubeClient, probe, testConfig())
+			now := time.Now()
+
+			reconcileAll(t, s, now)
+			reconcileAll(t, s, now.Add(11*time.Minute))
+
+			cluster := getCluster(t, kubeClient, "default", "cluster")
+			if tc.expectHibernation {
+				require.Equal(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+			} else {
+				require.NotEqual(t, scaletozero.HibernationAnnotationValueOn, cluster.Annotations[scaletozero.HibernationAnnotation])
+			}
+		})
+	}
+}
+
 func TestScraperSkipsUnsafeClusters(t *testing.T) {
 	t.Parallel()
 
@@ -246,37 +1007,13 @@ func TestScraperSkipsUnsafeClusters(t *testing.T) {
 			s := newTestScraper(t, fakeClient(tc.objects...), probe, testConfig())
 			now := time.Now()
 
-			require.NoError(t, s.RunOnce(context.Background(), now))
-			require.NoError(t, s.RunOnce(context.Background(), now.Add(20*time.Minute)))
+			reconcileAll(t, s, now)
+			reconcileAll(t, s, now.Add(20*time.Minute))
 			require.Zero(t, probe.calls)
 		})
 	}
 }
 
-func TestScraperUsesBoundedWorkers(t *testing.T) {
-	kubeClient := fakeClient(scaleObjects(1000)...)
-	release := make(chan struct{})
-	probe := &fakeConnectionsClient{openConnections: 1, block: release}
-	cfg := testConfig()
-	cfg.Concurrency = 5
-	s := newTestScraper(t, kubeClient, probe, cfg)
-
-	baseline := goruntime.NumGoroutine()
-	done := make(chan error, 1)
-	go func() {
-		done <- s.RunOnce(context.Background(), time.Now())
-	}()
-
-	require.Eventually(t, func() bool {
-		return probe.callCount() == cfg.Concurrency
-	}, time.Second, time.Millisecond)
-	require.LessOrEqual(t, goruntime.NumGoroutine()-baseline, cfg.Concurrency+10)
-
-	close(release)
-	require.NoError(t, <-done)
-	require.Equal(t, 1000, probe.calls)
-}
-
 func TestScraperSlowTargetsAreBoundedByTimeout(t *testing.T) {
 	kubeClient := fakeClient(scaleObjects(20)...)
 	probe := &fakeConnectionsClient{waitForContext: true}
@@ -286,7 +1023,7 @@ func TestScraperSlowTargetsAreBoundedByTimeout(t *testing.T) {
 	s := newTestScraper(t, kubeClient, probe, cfg)
 
 	start := time.Now()
-	require.NoError(t, s.RunOnce(context.Background(), start))
+	reconcileAll(t, s, start)
 	require.Less(t, time.Since(start), time.Second)
 	require.LessOrEqual(t, probe.maxConcurrent, 5)
 }
@@ -312,15 +1049,16 @@ func TestScraperRecordsScrapeMetrics(t *testing.T) {
 		provider.Meter("test"),
 	)
 	require.NoError(t, err)
+	s.random = func() float64 { return 0 }
 
-	require.NoError(t, s.RunOnce(context.Background(), time.Now()))
+	now := time.Now()
+	reconcileAll(t, s, now)
 	probe.err = errors.New("probe failed")
-	require.NoError(t, s.RunOnce(context.Background(), time.Now()))
+	reconcileAll(t, s, now.Add(time.Minute))
 	probe.err = nil
 	probe.openConnections = 0
-	now := time.Now()
-	require.NoError(t, s.RunOnce(context.Background(), now))
-	require.NoError(t, s.RunOnce(context.Background(), now.Add(11*time.Minute)))
+	reconcileAll(t, s, now.Add(2*time.Minute))
+	reconcileAll(t, s, now.Add(13*time.Minute))
 
 	families, err := registry.Gather()
 	require.NoError(t, err)
@@ -339,10 +1077,6 @@ func TestScraperRecordsScrapeMetrics(t *testing.T) {
 		require.Empty(t, labelValue(current, "otel_scope_version"))
 	}
 
-	cycleDuration := metrics["cnpg_scale_to_zero_scraper_cycle_duration_seconds"]
-	require.NotNil(t, cycleDuration)
-	require.Equal(t, map[string]uint64{scrapeResultSuccess: 4}, histogramCountsByLabel(cycleDuration, scrapeResultAttribute))
-
 	decisions := metrics["cnpg_scale_to_zero_scraper_cluster_decisions_total"]
 	require.NotNil(t, decisions)
 	require.Equal(t, map[string]float64{
@@ -351,6 +1085,14 @@ func TestScraperRecordsScrapeMetrics(t *testing.T) {
 		decisionInactive:   2,
 	}, counterValuesByLabel(decisions, decisionAttribute))
 
+	evaluationDuration := metrics["cnpg_scale_to_zero_scraper_evaluation_duration_seconds"]
+	require.NotNil(t, evaluationDuration)
+	require.Equal(t, map[string]uint64{
+		decisionActive:     1,
+		decisionProbeError: 1,
+		decisionInactive:   2,
+	}, histogramCountsByLabel(evaluationDuration, decisionAttribute))
+
 	hibernateAttempts := metrics["cnpg_scale_to_zero_scraper_hibernations_total"]
 	require.NotNil(t, hibernateAttempts)
 	require.Equal(t, map[string]float64{scrapeResultSuccess: 1}, counterValuesByLabel(hibernateAttempts, scrapeResultAttribute))
@@ -362,6 +1104,14 @@ func TestScraperRecordsScrapeMetrics(t *testing.T) {
 	pendingInactiveClusters := metrics["cnpg_scale_to_zero_scraper_pending_inactive_clusters"]
 	require.NotNil(t, pendingInactiveClusters)
 	require.Equal(t, float64(0), gaugeValue(t, pendingInactiveClusters))
+
+	scheduledEvaluations := metrics["cnpg_scale_to_zero_scraper_scheduled_evaluations_per_second"]
+	require.NotNil(t, scheduledEvaluations)
+	require.InDelta(t, 1/testConfig().Interval.Seconds(), gaugeValue(t, scheduledEvaluations), 1e-9)
+
+	evaluationDelay := metrics["cnpg_scale_to_zero_scraper_evaluation_delay_seconds"]
+	require.NotNil(t, evaluationDelay)
+	require.Equal(t, map[string]uint64{scheduleInterval: 4}, histogramCountsByLabel(evaluationDelay, scheduleAttribute))
 }
 
 func TestHTTPConnectionsClientRejectsUnknownResponses(t *testing.T) {
@@ -392,7 +1142,7 @@ func TestHTTPConnectionsClientRejectsUnknownResponses(t *testing.T) {
 			server := httptest.NewServer(tc.handler)
 			defer server.Close()
 
-			_, err := NewHTTPConnectionsClient(time.Second).GetConnections(context.Background(), server.URL)
+			_, err := NewHTTPConnectionsClient(time.Second, nil).GetConnections(context.Background(), server.URL)
 			require.Error(t, err)
 		})
 	}
@@ -406,11 +1156,85 @@ func TestHTTPConnectionsClientReturnsConnections(t *testing.T) {
 	}))
 	defer server.Close()
 
-	connections, err := NewHTTPConnectionsClient(time.Second).GetConnections(context.Background(), server.URL)
+	connections, err := NewHTTPConnectionsClient(time.Second, nil).GetConnections(context.Background(), server.URL)
 	require.NoError(t, err)
 	require.Equal(t, 3, connections)
 }
 
+func TestHTTPConnectionsClientTerminatesIdleSessions(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request activity.TerminationRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil || request.IdleSeconds != 3600 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sessions":[{"pid":42,"state":"idle"}]}`))
+	}))
+	defer server.Close()
+
+	result, err := NewHTTPConnectionsClient(time.Second, nil).TerminateIdleSessions(context.Background(), server.URL, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, activity.TerminationResult{Sessions: []activity.TerminatedSession{{PID: 42, State: "idle"}}}, result)
+}
+
+func TestHTTPConnectionsClientActivity(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		expected    activity.Report
+		expectedErr error
+	}{
+		{
+			name: "report",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"version":1,"connections":2,"sessions":[{"database":"app","user":"app","application_name":"api","state":"idle","backend_type":"client backend","count":2}]}`))
+			},
+			expected: activity.Report{
+				Version:     1,
+				Connections: 2,
+				Sessions: []activity.SessionGroup{
+					{Database: "app", User: "app", ApplicationName: "api", State: "idle", BackendType: "client backend", Count: 2},
+				},
+			},
+		},
+		{
+			name: "legacy sidecar",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			expectedErr: ErrActivityUnsupported,
+		},
+		{
+			name: "unsupported version",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"version":2,"connections":0}`))
+			},
+			expectedErr: errors.New("unsupported activity report version 2"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+
+			report, err := NewHTTPConnectionsClient(time.Second, nil).GetActivity(context.Background(), server.URL)
+			if tc.expectedErr != nil {
+				require.EqualError(t, err, tc.expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, report)
+		})
+	}
+}
+
 func testConfig() config.ScraperConfig {
 	return config.ScraperConfig{
 		Interval:          time.Minute,
@@ -420,6 +1244,18 @@ func testConfig() config.ScraperConfig {
 	}
 }
 
+// reconcileAll evaluates every cluster at now, like the events following a
+// plugin start.
+func reconcileAll(t *testing.T, s *Scraper, now time.Time) {
+	t.Helper()
+	clusters := &cnpgv1.ClusterList{}
+	require.NoError(t, s.client.List(context.Background(), clusters))
+	for i := range clusters.Items {
+		_, err := s.reconcile(context.Background(), types.NamespacedName{Namespace: clusters.Items[i].Namespace, Name: clusters.Items[i].Name}, now)
+		require.NoError(t, err)
+	}
+}
+
 func newTestScraper(
 	t *testing.T,
 	kubeClient client.Client,
@@ -430,6 +1266,9 @@ func newTestScraper(
 	t.Helper()
 	s, err := New(kubeClient, connectionsClient, cfg, noop.NewMeterProvider().Meter("test"), options...)
 	require.NoError(t, err)
+	// Without jitter, clusters are due exactly one schedule after their
+	// evaluation.
+	s.random = func() float64 { return 0 }
 	return s
 }
 
@@ -506,6 +1345,10 @@ func runningPrimary(namespace, cluster, name, ip string) *corev1.Pod {
 	return primaryPod(namespace, cluster, name, ip, corev1.PodRunning, true)
 }
 
+func runningReplica(namespace, cluster, name, ip string) *corev1.Pod {
+	return primaryPod(namespace, cluster, name, ip, corev1.PodRunning, true)
+}
+
 func primaryPod(namespace, cluster, name, ip string, phase corev1.PodPhase, sidecarLabel bool) *corev1.Pod {
 	labels := map[string]string{
 		scaletozero.ClusterLabel: cluster,
@@ -561,20 +1404,101 @@ func scaleObjects(count int) []client.Object {
 	return objects
 }
 
+type fakeShard map[types.UID]bool
+
+func (s fakeShard) Owns(uid types.UID) bool {
+	return s[uid]
+}
+
+func (fakeShard) Changes() <-chan struct{} {
+	return nil
+}
+
 type fakeConnectionsClient struct {
-	mu              sync.Mutex
-	openConnections int
-	err             error
-	waitForContext  bool
-	block           <-chan struct{}
-	calls           int
-	current         int
-	maxConcurrent   int
+	mu               sync.Mutex
+	openConnections  int
+	connectionsByURL map[string]int
+	err              error
+	errorsByURL      map[string]error
+	instancesByURL   map[string]activity.Instance
+	legacy           bool
+	counters         *activity.Counters
+	idleFor          *time.Duration
+	sessions         []activity.SessionGroup
+	maintenance      []activity.MaintenanceOperation
+	holds            []activity.Hold
+	prepared         int
+	slots            []activity.ReplicationSlot
+	replication      activity.LogicalReplication
+	customQuery      *activity.CustomQueryResult
+	sockets          *activity.SocketActivity
+	scheduledJobs    []activity.ScheduledJob
+	terminated       []activity.TerminatedSession
+	terminateURLs    []string
+	waitForContext   bool
+	block            <-chan struct{}
+	calls            int
+	urls             []string
+	current          int
+	maxConcurrent    int
 }
 
 func (c *fakeConnectionsClient) GetConnections(ctx context.Context, url string) (int, error) {
+	return c.get(ctx, url)
+}
+
+func (c *fakeConnectionsClient) GetActivity(ctx context.Context, url string) (activity.Report, error) {
+	if c.legacy {
+		return activity.Report{}, ErrActivityUnsupported
+	}
+	openConnections, err := c.get(ctx, url)
+	if err != nil {
+		return activity.Report{}, err
+	}
+	report := activity.Report{Version: activity.ReportVersion, Connections: openConnections}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counters != nil {
+		counters := *c.counters
+		report.Counters = &counters
+	}
+	if c.idleFor != nil {
+		report.GeneratedAt = time.Now()
+		lastActive := report.GeneratedAt.Add(-*c.idleFor)
+		report.LastActive = &lastActive
+	}
+	if c.sessions != nil {
+		report.GeneratedAt = time.Now()
+		report.Sessions = c.sessions
+	}
+	if instance, exists := c.instancesByURL[url]; exists {
+		report.Instance = &instance
+	}
+	report.Maintenance = c.maintenance
+	report.Holds = c.holds
+	report.LogicalReplication = c.replication
+	report.PreparedTransactions = c.prepared
+	report.ReplicationSlots = c.slots
+	report.CustomQuery = c.customQuery
+	report.Sockets = c.sockets
+	if c.scheduledJobs != nil {
+		report.GeneratedAt = time.Now()
+		report.ScheduledJobs = c.scheduledJobs
+	}
+	return report, nil
+}
+
+func (c *fakeConnectionsClient) TerminateIdleSessions(_ context.Context, url string, _ time.Duration) (activity.TerminationResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.terminateURLs = append(c.terminateURLs, url)
+	return activity.TerminationResult{Sessions: c.terminated}, nil
+}
+
+func (c *fakeConnectionsClient) get(ctx context.Context, url string) (int, error) {
 	c.mu.Lock()
 	c.calls++
+	c.urls = append(c.urls, url)
 	c.current++
 	if c.current > c.maxConcurrent {
 		c.maxConcurrent = c.current
@@ -601,6 +1525,12 @@ func (c *fakeConnectionsClient) GetConnections(ctx context.Context, url string)
 	if c.err != nil {
 		return 0, c.err
 	}
+	if err := c.errorsByURL[url]; err != nil {
+		return 0, err
+	}
+	if openConnections, exists := c.connectionsByURL[url]; exists {
+		return openConnections, nil
+	}
 	return c.openConnections, nil
 }
 
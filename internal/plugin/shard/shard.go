@@ -0,0 +1,245 @@
+// Package shard partitions the clusters between the plugin replicas. Each
+// replica keeps a member Lease alive, and every cluster belongs to the live
+// member with the highest rendezvous hash of its UID, so a member joining or
+// leaving only moves the clusters it gains or loses.
+package shard
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// MemberLabel marks the member Leases of the plugin replicas.
+	MemberLabel     = "xata.io/scale-to-zero-member"
+	MemberLabelTrue = "true"
+
+	leasePrefix = "cnpg-i-scale-to-zero-member-"
+
+	renewInterval = 10 * time.Second
+	leaseDuration = 30 * time.Second
+	// leaveTimeout bounds the removal of the member Lease on shutdown.
+	leaveTimeout = 5 * time.Second
+)
+
+// Membership maintains the member Lease of this replica and its view of the
+// live members.
+type Membership struct {
+	client    client.Client
+	reader    client.Reader
+	namespace string
+	identity  string
+	now       func() time.Time
+
+	mu      sync.Mutex
+	members []string
+	// validUntil is when the other members may consider this one gone,
+	// minus one renewal, if its Lease is not renewed in the meantime.
+	validUntil time.Time
+	// settledAt is when every other member has listed this one since it
+	// joined, so they no longer process the clusters it takes over.
+	settledAt time.Time
+	// active is whether this member owned its clusters at the latest
+	// renewal.
+	active bool
+	// changes signals renewals that may have changed the owned clusters.
+	changes chan struct{}
+}
+
+// New returns the membership of the replica named identity. Leases are
+// written with kubeClient and listed with reader, which should not be backed
+// by a cache.
+func New(kubeClient client.Client, reader client.Reader, namespace, identity string) *Membership {
+	return &Membership{
+		client:    kubeClient,
+		reader:    reader,
+		namespace: namespace,
+		identity:  identity,
+		now:       time.Now,
+		changes:   make(chan struct{}, 1),
+	}
+}
+
+// Start renews the member Lease and refreshes the members until ctx is
+// done, then removes the Lease so the other members take over right away.
+func (m *Membership) Start(ctx context.Context) error {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		m.sync(ctx)
+		select {
+		case <-ctx.Done():
+			m.leave(context.WithoutCancel(ctx))
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Owns reports whether the cluster with the given UID belongs to this
+// replica. A replica whose Lease may have expired for the other members owns
+// no cluster.
+func (m *Membership) Owns(uid types.UID) bool {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.After(m.validUntil) || now.Before(m.settledAt) {
+		return false
+	}
+	return owner(uid, m.members) == m.identity
+}
+
+// Changes receives a value after each renewal that may have changed the
+// clusters this replica owns: when the members change, and when this replica
+// starts or stops owning clusters. Values are coalesced, so a slow reader
+// only misses repeated ones.
+func (m *Membership) Changes() <-chan struct{} {
+	return m.changes
+}
+
+func (m *Membership) sync(ctx context.Context) {
+	logger := log.FromContext(ctx).WithValues("identity", m.identity)
+	now := m.now()
+	if err := m.renew(ctx, now); err != nil {
+		logger.Error(err, "shard member lease renewal error")
+		return
+	}
+	members, err := m.liveMembers(ctx, now)
+	if err != nil {
+		logger.Error(err, "shard members list error")
+		return
+	}
+
+	m.mu.Lock()
+	changed := !slices.Equal(m.members, members)
+	m.members = members
+	// A replica rejoining after its Lease may have expired waits like a new
+	// one.
+	if now.After(m.validUntil) {
+		m.settledAt = now.Add(renewInterval)
+	}
+	m.validUntil = now.Add(leaseDuration - renewInterval)
+	active := !now.Before(m.settledAt)
+	activeChanged := active != m.active
+	m.active = active
+	m.mu.Unlock()
+
+	if changed {
+		logger.Info("shard members changed", "members", members)
+	}
+	if changed || activeChanged {
+		select {
+		case m.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *Membership) renew(ctx context.Context, now time.Time) error {
+	renewTime := metav1.NewMicroTime(now)
+	lease := &coordinationv1.Lease{}
+	err := m.reader.Get(ctx, types.NamespacedName{Namespace: m.namespace, Name: leasePrefix + m.identity}, lease)
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: m.namespace,
+				Name:      leasePrefix + m.identity,
+				Labels:    map[string]string{MemberLabel: MemberLabelTrue},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To(m.identity),
+				LeaseDurationSeconds: ptr.To(int32(leaseDuration.Seconds())),
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		if err := m.client.Create(ctx, lease); err != nil {
+			return fmt.Errorf("create member lease: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("retrieve member lease: %w", err)
+	}
+
+	lease.Spec.HolderIdentity = ptr.To(m.identity)
+	lease.Spec.LeaseDurationSeconds = ptr.To(int32(leaseDuration.Seconds()))
+	lease.Spec.RenewTime = &renewTime
+	if err := m.client.Update(ctx, lease); err != nil {
+		return fmt.Errorf("update member lease: %w", err)
+	}
+	return nil
+}
+
+// liveMembers returns the identities of the members whose Lease has not
+// expired, in order.
+func (m *Membership) liveMembers(ctx context.Context, now time.Time) ([]string, error) {
+	leases := &coordinationv1.LeaseList{}
+	if err := m.reader.List(
+		ctx,
+		leases,
+		client.InNamespace(m.namespace),
+		client.MatchingLabels{MemberLabel: MemberLabelTrue},
+	); err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(leases.Items))
+	for i := range leases.Items {
+		spec := leases.Items[i].Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiresAt := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiresAt) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	slices.Sort(members)
+	return slices.Compact(members), nil
+}
+
+func (m *Membership) leave(ctx context.Context) {
+	m.mu.Lock()
+	m.validUntil = time.Time{}
+	m.active = false
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, leaveTimeout)
+	defer cancel()
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: m.namespace, Name: leasePrefix + m.identity}}
+	if err := m.client.Delete(ctx, lease); client.IgnoreNotFound(err) != nil {
+		log.FromContext(ctx).Error(err, "shard member lease removal error", "identity", m.identity)
+	}
+}
+
+// owner returns the member with the highest hash of the member and the UID.
+func owner(uid types.UID, members []string) string {
+	var (
+		result  string
+		highest uint64
+	)
+	for _, member := range members {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(member))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(uid))
+		if weight := hash.Sum64(); result == "" || weight > highest {
+			result, highest = member, weight
+		}
+	}
+	return result
+}
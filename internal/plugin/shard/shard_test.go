@@ -0,0 +1,143 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestOwnerMovesOnlyClustersOfChangedMembers(t *testing.T) {
+	t.Parallel()
+
+	before := []string{"plugin-a", "plugin-b"}
+	after := []string{"plugin-a", "plugin-b", "plugin-c"}
+	owned := map[string]int{}
+	for i := range 1000 {
+		uid := types.UID(fmt.Sprintf("cluster-%d", i))
+		previous, current := owner(uid, before), owner(uid, after)
+		owned[current]++
+		if previous != current {
+			require.Equal(t, "plugin-c", current, "cluster moved between remaining members")
+		}
+	}
+	for _, member := range after {
+		require.Greater(t, owned[member], 250, member)
+	}
+	require.Empty(t, owner("cluster", nil))
+}
+
+func TestMembership(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := newTestMembership(kubeClient, "plugin-a", &now)
+	b := newTestMembership(kubeClient, "plugin-b", &now)
+	ctx := context.Background()
+
+	// Nothing is owned before the first renewal, nor until the other
+	// members have listed the new one.
+	require.False(t, a.Owns("cluster"))
+	a.sync(ctx)
+	require.False(t, a.Owns("cluster"))
+	now = now.Add(renewInterval)
+	a.sync(ctx)
+	require.True(t, a.Owns("cluster"))
+
+	b.sync(ctx)
+	a.sync(ctx)
+	now = now.Add(renewInterval)
+	a.sync(ctx)
+	b.sync(ctx)
+	for i := range 100 {
+		uid := types.UID(fmt.Sprintf("cluster-%d", i))
+		require.NotEqual(t, a.Owns(uid), b.Owns(uid), uid)
+	}
+
+	// A member that stops renewing gives up its clusters before the others
+	// consider it gone and take them over.
+	now = now.Add(leaseDuration - renewInterval + time.Second)
+	a.sync(ctx)
+	require.False(t, b.Owns(owned(t, b.members, "plugin-b")))
+	require.Equal(t, []string{"plugin-a", "plugin-b"}, a.members)
+	now = now.Add(renewInterval)
+	a.sync(ctx)
+	require.Equal(t, []string{"plugin-a"}, a.members)
+	require.True(t, a.Owns(owned(t, []string{"plugin-a", "plugin-b"}, "plugin-b")))
+
+	// Leaving removes the Lease, so the other members do not wait for it to
+	// expire.
+	b.sync(ctx)
+	a.sync(ctx)
+	require.Equal(t, []string{"plugin-a", "plugin-b"}, a.members)
+	b.leave(ctx)
+	require.False(t, b.Owns(owned(t, a.members, "plugin-b")))
+	a.sync(ctx)
+	require.Equal(t, []string{"plugin-a"}, a.members)
+}
+
+func TestMembershipChanges(t *testing.T) {
+	t.Parallel()
+
+	kubeClient := fakeClient()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := newTestMembership(kubeClient, "plugin-a", &now)
+	b := newTestMembership(kubeClient, "plugin-b", &now)
+	ctx := context.Background()
+
+	steps := []struct {
+		name    string
+		sync    func()
+		changed bool
+	}{
+		{name: "joined", sync: func() { a.sync(ctx) }, changed: true},
+		{name: "settled", sync: func() { now = now.Add(renewInterval); a.sync(ctx) }, changed: true},
+		{name: "renewed", sync: func() { now = now.Add(renewInterval); a.sync(ctx) }},
+		{name: "member joined", sync: func() { b.sync(ctx); a.sync(ctx) }, changed: true},
+		{name: "renewed again", sync: func() { a.sync(ctx) }},
+		{name: "member left", sync: func() { b.leave(ctx); a.sync(ctx) }, changed: true},
+	}
+	for _, step := range steps {
+		step.sync()
+		select {
+		case <-a.Changes():
+			require.True(t, step.changed, step.name)
+		default:
+			require.False(t, step.changed, step.name)
+		}
+	}
+}
+
+func newTestMembership(kubeClient client.Client, identity string, now *time.Time) *Membership {
+	m := New(kubeClient, kubeClient, "cnpg-system", identity)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+// owned returns a cluster UID that belongs to member among members.
+func owned(t *testing.T, members []string, member string) types.UID {
+	t.Helper()
+	for i := range 100 {
+		uid := types.UID(fmt.Sprintf("cluster-%d", i))
+		if owner(uid, members) == member {
+			return uid
+		}
+	}
+	require.FailNow(t, "no cluster owned", member)
+	return ""
+}
+
+func fakeClient() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	return fake.NewClientBuilder().WithScheme(scheme).Build()
+}
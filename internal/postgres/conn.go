@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Conn is a single connection that runs every query with the simple
+// protocol. Each query is then exactly one transaction, and nothing else is
+// sent to the server, unlike a pool that pings idle connections or a
+// prepared statement cache that parses statements in transactions of their
+// own. It must not be used concurrently.
+type Conn struct {
+	*pgx.Conn
+}
+
+func NewConn(ctx context.Context, url string) (*Conn, error) {
+	pgCfg, err := pgx.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing postgres connection string: %w", err)
+	}
+	pgCfg.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+
+	conn, err := pgx.ConnectConfig(ctx, pgCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	return &Conn{Conn: conn}, nil
+}
+
+func (c *Conn) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return c.Conn.QueryRow(ctx, query, args...)
+}
+
+func (c *Conn) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := c.Conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c *Conn) Close(ctx context.Context) error {
+	return c.Conn.Close(ctx)
+}
@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsConnectionError reports whether err means the connection to PostgreSQL
+// could not be established or was lost, so that a new connection may succeed
+// where the query failed. Errors reported by PostgreSQL about the query
+// itself, and cancellations by the caller, are not connection errors.
+func IsConnectionError(err error) bool {
+	if err == nil || pgconn.Timeout(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08 is connection exception. The 57P class is raised while
+		// the server shuts down or starts up.
+		return strings.HasPrefix(pgErr.Code, "08") ||
+			pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsUndefinedTable reports whether PostgreSQL rejected a query because a
+// table or schema it references does not exist.
+func IsUndefinedTable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// 42P01 is undefined_table and 3F000 invalid_schema_name.
+	return pgErr.Code == "42P01" || pgErr.Code == "3F000"
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "no error"},
+		{name: "refused", err: fmt.Errorf("query: %w", syscall.ECONNREFUSED), expected: true},
+		{name: "missing socket", err: &net.OpError{Op: "dial", Net: "unix", Err: syscall.ENOENT}, expected: true},
+		{name: "reset", err: syscall.ECONNRESET, expected: true},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, expected: true},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}, expected: true},
+		{name: "starting up", err: &pgconn.PgError{Code: "57P03"}, expected: true},
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, expected: true},
+		{name: "statement timeout", err: &pgconn.PgError{Code: "57014"}},
+		{name: "undefined table", err: &pgconn.PgError{Code: "42P01"}},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded)},
+		{name: "canceled", err: context.Canceled},
+		{name: "other", err: errors.New("scan failed")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, IsConnectionError(tc.err))
+		})
+	}
+}
+
+func TestIsUndefinedTable(t *testing.T) {
+	t.Parallel()
+
+	require.True(t, IsUndefinedTable(fmt.Errorf("query: %w", &pgconn.PgError{Code: "42P01"})))
+	require.True(t, IsUndefinedTable(&pgconn.PgError{Code: "3F000"}))
+	require.False(t, IsUndefinedTable(&pgconn.PgError{Code: "42501"}))
+	require.False(t, IsUndefinedTable(errors.New("relation does not exist")))
+	require.False(t, IsUndefinedTable(nil))
+}
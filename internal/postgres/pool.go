@@ -5,6 +5,7 @@ package postgres
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -13,7 +14,15 @@ type Pool struct {
 	*pgxpool.Pool
 }
 
-const maxConns = 50
+const (
+	// maxConns keeps the pool small. Its users run one query at a time, and
+	// the second connection serves a query started while the first one is
+	// being replaced.
+	maxConns = 2
+	// healthCheckPeriod is how often idle connections are checked, so one
+	// broken by a PostgreSQL restart is replaced before the next query.
+	healthCheckPeriod = 15 * time.Second
+)
 
 func NewConnPool(ctx context.Context, url string) (*Pool, error) {
 	pgCfg, err := pgxpool.ParseConfig(url)
@@ -21,6 +30,7 @@ func NewConnPool(ctx context.Context, url string) (*Pool, error) {
 		return nil, fmt.Errorf("failed parsing postgres connection string: %w", err)
 	}
 	pgCfg.MaxConns = maxConns
+	pgCfg.HealthCheckPeriod = healthCheckPeriod
 
 	pool, err := pgxpool.NewWithConfig(ctx, pgCfg)
 	if err != nil {
@@ -34,6 +44,14 @@ func (c *Pool) QueryRow(ctx context.Context, query string, args ...any) Row {
 	return c.Pool.QueryRow(ctx, query, args...)
 }
 
+func (c *Pool) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := c.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
 func (c *Pool) Close(_ context.Context) error {
 	c.Pool.Close()
 	return nil
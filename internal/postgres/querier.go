@@ -6,11 +6,23 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
+// ErrNoRows is returned by Row.Scan when the query returned no row.
+var ErrNoRows = pgx.ErrNoRows
+
 type Querier interface {
 	QueryRow(ctx context.Context, query string, args ...any) Row
+	Query(ctx context.Context, query string, args ...any) (Rows, error)
 	Close(ctx context.Context) error
 }
 
 type Row interface {
 	pgx.Row
 }
+
+// Rows is the subset of pgx.Rows used to iterate over query results.
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close()
+}
@@ -0,0 +1,78 @@
+// Package push defines the signed activity reports sidecars push to the
+// central scraper when it does not poll them.
+package push
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+// Path is the path of the ingestion endpoint on the plugin.
+const Path = "/reports"
+
+// Headers of a pushed report.
+const (
+	// TimestampHeader carries the Unix time the report was signed at.
+	TimestampHeader = "X-Scale-To-Zero-Timestamp"
+	// SignatureHeader carries the hex HMAC-SHA256 of the timestamp and body.
+	SignatureHeader = "X-Scale-To-Zero-Signature"
+)
+
+// Envelope is the body of a pushed report. It names the instance, because the
+// plugin cannot tell pods apart by the address of the request.
+type Envelope struct {
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+	Pod       string `json:"pod"`
+	// Error is set instead of Report when the sidecar could not collect it,
+	// so the plugin does not have to wait for the report to be late.
+	Error  string          `json:"error,omitempty"`
+	Report activity.Report `json:"report"`
+}
+
+// Key derives the signing key of a cluster from the plugin secret. Sidecars
+// only receive the key of their own cluster, so a leaked key cannot be used to
+// report for other clusters.
+func Key(secret []byte, namespace, cluster string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(namespace + "/" + cluster))
+	return mac.Sum(nil)
+}
+
+// Sign returns the signature of body sent at timestamp.
+func Sign(key []byte, timestamp time.Time, body []byte) string {
+	return hex.EncodeToString(sum(key, timestamp, body))
+}
+
+// Verify checks the signature of body and that it was signed within maxAge of
+// now, so a captured request cannot be replayed later. It returns the time the
+// body was signed at.
+func Verify(key []byte, timestamp, signature string, body []byte, now time.Time, maxAge time.Duration) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if age := now.Sub(signedAt); age > maxAge || age < -maxAge {
+		return time.Time{}, fmt.Errorf("timestamp %s is more than %s away", signedAt.UTC().Format(time.RFC3339), maxAge)
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum(key, signedAt, body), actual) {
+		return time.Time{}, errors.New("invalid signature")
+	}
+	return signedAt, nil
+}
+
+func sum(key []byte, timestamp time.Time, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
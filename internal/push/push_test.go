@@ -0,0 +1,92 @@
+package push
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	key := Key([]byte("secret"), "default", "cluster")
+	body := []byte(`{"namespace":"default","cluster":"cluster","pod":"cluster-1"}`)
+	signedAt := time.Unix(1735732800, 0)
+
+	tests := []struct {
+		name      string
+		key       []byte
+		body      []byte
+		signature string
+		now       time.Time
+		wantErr   bool
+	}{
+		{
+			name: "valid",
+			now:  signedAt.Add(30 * time.Second),
+		},
+		{
+			name:    "tampered body",
+			body:    []byte(`{"namespace":"default","cluster":"cluster","pod":"cluster-2"}`),
+			now:     signedAt,
+			wantErr: true,
+		},
+		{
+			name:    "key of another cluster",
+			key:     Key([]byte("secret"), "default", "other"),
+			now:     signedAt,
+			wantErr: true,
+		},
+		{
+			name:      "malformed signature",
+			signature: "not-hex",
+			now:       signedAt,
+			wantErr:   true,
+		},
+		{
+			name:    "expired",
+			now:     signedAt.Add(2 * time.Minute),
+			wantErr: true,
+		},
+		{
+			name:    "from the future",
+			now:     signedAt.Add(-2 * time.Minute),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			signature := Sign(key, signedAt, body)
+			if tc.signature != "" {
+				signature = tc.signature
+			}
+			verifyKey, verifyBody := key, body
+			if tc.key != nil {
+				verifyKey = tc.key
+			}
+			if tc.body != nil {
+				verifyBody = tc.body
+			}
+
+			verifiedAt, err := Verify(verifyKey, strconv.FormatInt(signedAt.Unix(), 10), signature, verifyBody, tc.now, time.Minute)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, signedAt.Equal(verifiedAt))
+		})
+	}
+}
+
+func TestVerifyInvalidTimestamp(t *testing.T) {
+	t.Parallel()
+
+	_, err := Verify([]byte("key"), "yesterday", "", nil, time.Now(), time.Minute)
+	require.Error(t, err)
+}
@@ -15,8 +15,68 @@ const (
 	EnabledAnnotation     = "xata.io/scale-to-zero-enabled"
 	EnabledAnnotationTrue = "true"
 	InactivityAnnotation  = "xata.io/scale-to-zero-inactivity-minutes"
+	// IdleSessionAnnotation is read when a pod is created, like the exclusion
+	// annotations.
+	IdleSessionAnnotation = "xata.io/scale-to-zero-idle-session-minutes"
 	SidecarLabel          = "xata.io/scale-to-zero-sidecar"
 	SidecarLabelTrue      = "true"
+	// PushKeyLabel marks the Secrets holding the push key of a cluster. The
+	// plugin only updates the Secrets carrying it.
+	PushKeyLabel     = "xata.io/scale-to-zero-push-key"
+	PushKeyLabelTrue = "true"
+
+	UnreachableReplicasAnnotation = "xata.io/scale-to-zero-unreachable-replicas"
+	UnreachableReplicasBlock      = "block"
+	UnreachableReplicasIgnore     = "ignore"
+
+	TerminateIdleAnnotation = "xata.io/scale-to-zero-terminate-idle-minutes"
+
+	// Logical replication annotations decide whether walsenders serving
+	// subscribers and workers applying subscriptions count as activity. They
+	// do unless set to LogicalReplicationIgnore.
+	LogicalWalsendersAnnotation  = "xata.io/scale-to-zero-logical-walsenders"
+	LogicalSubscribersAnnotation = "xata.io/scale-to-zero-logical-subscribers"
+	LogicalReplicationIgnore     = "ignore"
+
+	// IgnoreDependenciesAnnotation lists the external dependencies that may
+	// not prevent hibernation, separated by commas.
+	IgnoreDependenciesAnnotation   = "xata.io/scale-to-zero-ignore-dependencies"
+	DependencyPreparedTransactions = "prepared-transactions"
+	DependencyReplicationSlots     = "replication-slots"
+	DependencyScheduledJobs        = "scheduled-jobs"
+
+	// NextScheduledRunAnnotation is set on hibernated clusters with pg_cron
+	// jobs to the time the next one is due, in RFC 3339 format, so a wake
+	// mechanism can resume the cluster in time.
+	NextScheduledRunAnnotation = "xata.io/scale-to-zero-next-scheduled-run"
+
+	// Checkpoint annotations persist a pending inactivity window across
+	// plugin restarts: when it started, and when a successful scrape last
+	// confirmed it, both in RFC 3339 format. The plugin owns them.
+	IdleSinceAnnotation   = "xata.io/scale-to-zero-idle-since"
+	IdleCheckedAnnotation = "xata.io/scale-to-zero-idle-checked"
+
+	// Exclusion annotations hold comma-separated lists. They are read when a
+	// pod is created, so changes apply to pods created afterwards.
+	ExcludeUsersAnnotation            = "xata.io/scale-to-zero-exclude-users"
+	ExcludeDatabasesAnnotation        = "xata.io/scale-to-zero-exclude-databases"
+	ExcludeApplicationNamesAnnotation = "xata.io/scale-to-zero-exclude-application-names"
+	ExcludeClientCIDRsAnnotation      = "xata.io/scale-to-zero-exclude-client-cidrs"
+	ExcludeBackendTypesAnnotation     = "xata.io/scale-to-zero-exclude-backend-types"
+
+	// ActivityQueryAnnotation references a custom activity query as
+	// <configmap>/<key>, and ActivityQueryDatabaseAnnotation names the database
+	// it runs in. Like the exclusions, they are read when a pod is created.
+	ActivityQueryAnnotation         = "xata.io/scale-to-zero-activity-query"
+	ActivityQueryDatabaseAnnotation = "xata.io/scale-to-zero-activity-query-database"
+
+	// ActivitySourcesAnnotation lists the sidecar activity sources enabled for
+	// a cluster, replacing the plugin default.
+	ActivitySourcesAnnotation = "xata.io/scale-to-zero-activity-sources"
+
+	// HoldDatabaseAnnotation names the database of the scale_to_zero.holds
+	// table, which defaults to the application database.
+	HoldDatabaseAnnotation = "xata.io/scale-to-zero-hold-database"
 
 	DefaultInactivityMinutes = 30
 )
@@ -0,0 +1,91 @@
+package sidecar
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	connectionUnknown      = "unknown"
+	connectionConnected    = "connected"
+	connectionDisconnected = "disconnected"
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// connectionStatus describes the probe's connection to PostgreSQL on the
+// health endpoint.
+type connectionStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	NextReconnect       *time.Time `json:"next_reconnect,omitempty"`
+}
+
+// connectionTracker follows the probe's connection to PostgreSQL and paces
+// reconnections with exponential backoff, so a PostgreSQL that is down is not
+// hammered by every sample and scrape. The zero value has not connected yet.
+type connectionTracker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	lastError string
+	retryAt   time.Time
+}
+
+// reconnectDue reports whether the backoff after the latest failed
+// reconnection has elapsed.
+func (c *connectionTracker) reconnectDue(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !now.Before(c.retryAt)
+}
+
+// succeeded records a query that reached PostgreSQL.
+func (c *connectionTracker) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = connectionConnected
+	c.failures = 0
+	c.lastError = ""
+	c.retryAt = time.Time{}
+}
+
+// failed records a failed reconnection and schedules the next one.
+func (c *connectionTracker) failed(now time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = connectionDisconnected
+	c.failures++
+	c.lastError = err.Error()
+	c.retryAt = now.Add(reconnectBackoff(c.failures))
+}
+
+func (c *connectionTracker) status() connectionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := connectionStatus{
+		State:               c.state,
+		ConsecutiveFailures: c.failures,
+		LastError:           c.lastError,
+	}
+	if status.State == "" {
+		status.State = connectionUnknown
+	}
+	if !c.retryAt.IsZero() {
+		retryAt := c.retryAt
+		status.NextReconnect = &retryAt
+	}
+	return status
+}
+
+// reconnectBackoff doubles the delay with every consecutive failure.
+func reconnectBackoff(failures int) time.Duration {
+	backoff := minReconnectBackoff
+	for i := 1; i < failures && backoff < maxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxReconnectBackoff)
+}
@@ -0,0 +1,182 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+const (
+	defaultActivityQueryTimeout = time.Second
+	// activityQueryApplicationName identifies the connections of the custom
+	// query and hold table, which must not count as client sessions
+	// themselves.
+	activityQueryApplicationName = "scale-to-zero-activity-query"
+)
+
+// ActivityQuery is a custom SQL query whose result counts as activity when it
+// is true or positive.
+type ActivityQuery struct {
+	// Name identifies the query in reports. The query is disabled when empty.
+	Name     string
+	SQL      string
+	Database string
+	Timeout  time.Duration
+	// User and Password authenticate the query, which comes from the cluster
+	// namespace and must not run with the privileges of the postgres user.
+	User     string
+	Password string
+}
+
+// customQuerySource evaluates the custom activity query on its own connection
+// to the configured database, connected on first use. The connection only runs
+// read-only transactions and cancels statements after the query timeout. Only
+// the first column of the first row is read. Nothing is reported when no query
+// is configured. The query runs at most every ownStatementInterval, and the
+// previous result is reported in between.
+type customQuerySource struct {
+	query   ActivityQuery
+	connect querierFactory
+	querier postgres.Querier
+	own     *ownTransactions
+	// ran is when the query last ran, and result what it returned.
+	ran    time.Time
+	result *activity.CustomQueryResult
+}
+
+func (*customQuerySource) Name() string {
+	return SourceCustomQuery
+}
+
+func (s *customQuerySource) Collect(ctx context.Context, _ postgres.Querier, report *activity.Report) error {
+	if s.query.Name == "" {
+		return nil
+	}
+	sql := strings.TrimRight(strings.TrimSpace(s.query.SQL), "; \t\n")
+	if sql == "" {
+		return fmt.Errorf("activity query %q is empty", s.query.Name)
+	}
+	if s.query.User == "" {
+		return fmt.Errorf("activity query %q has no user", s.query.Name)
+	}
+	if s.result != nil && !s.own.due(s.ran) {
+		result := *s.result
+		report.CustomQuery = &result
+		return nil
+	}
+
+	if s.querier == nil {
+		querier, err := s.connect(ctx, s.query.connString())
+		if err != nil {
+			return fmt.Errorf("connect activity query %q: %w", s.query.Name, err)
+		}
+		s.querier = querier
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, 2*s.query.timeout())
+	defer cancel()
+
+	var value *string
+	query := `SELECT (result.value)::text FROM (` + sql + `) AS result(value) LIMIT 1;`
+	err := s.querier.QueryRow(queryCtx, query).Scan(&value)
+	s.own.record(s.query.Database, err)
+	s.ran = s.own.now()
+	s.result = nil
+	if err != nil && !errors.Is(err, postgres.ErrNoRows) {
+		// The connection is replaced on the next evaluation, in case it is the
+		// reason for the failure.
+		_ = s.querier.Close(ctx)
+		s.querier = nil
+		return fmt.Errorf("evaluate activity query %q: %w", s.query.Name, err)
+	}
+
+	result := &activity.CustomQueryResult{Name: s.query.Name}
+	if value != nil {
+		parsed, err := parseActivityQueryValue(*value)
+		if err != nil {
+			return fmt.Errorf("activity query %q: %w", s.query.Name, err)
+		}
+		result.Value = parsed
+	}
+	s.result = result
+	reported := *result
+	report.CustomQuery = &reported
+	return nil
+}
+
+// Close closes the activity query connection.
+func (s *customQuerySource) Close(ctx context.Context) error {
+	if s.querier == nil {
+		return nil
+	}
+	return s.querier.Close(ctx)
+}
+
+func (q ActivityQuery) timeout() time.Duration {
+	if q.Timeout <= 0 {
+		return defaultActivityQueryTimeout
+	}
+	return q.Timeout
+}
+
+// connString connects as the query's user.
+func (q ActivityQuery) connString() string {
+	return applicationConnString(q.User, q.Password, q.Database, q.timeout())
+}
+
+// applicationConnString connects as user, the owner of the application
+// database, to read what the application controls. Only the postgres user
+// may log in through the Unix socket, so the connection goes through the
+// loopback interface and authenticates with the password.
+func applicationConnString(user, password, database string, timeout time.Duration) string {
+	return fmt.Sprintf("host=localhost user=%s password=%s sslmode=prefer ", connStringValue(user), connStringValue(password)) +
+		readOnlySettings(database, timeout)
+}
+
+// readOnlyConnString connects to another database than the probe's as the
+// postgres user, for queries that only read objects the application does not
+// control and must not run for longer than the timeout.
+func readOnlyConnString(database string, timeout time.Duration) string {
+	return "user=postgres sslmode=disable " + readOnlySettings(database, timeout)
+}
+
+// readOnlySettings selects the database and limits the connection to
+// read-only transactions that do not run for longer than the timeout.
+func readOnlySettings(database string, timeout time.Duration) string {
+	return fmt.Sprintf(
+		"dbname=%s application_name=%s default_transaction_read_only=on connect_timeout=%d statement_timeout=%d lock_timeout=%d",
+		connStringValue(database),
+		activityQueryApplicationName,
+		int(connectTimeout.Seconds()),
+		timeout.Milliseconds(),
+		min(timeout, lockTimeout).Milliseconds(),
+	)
+}
+
+// connStringValue quotes a value for a key/value connection string.
+func connStringValue(value string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + `'`
+}
+
+// parseActivityQueryValue reads the text form of a boolean or numeric result.
+// The error does not quote the result, which may be anything the query could
+// read and ends up in logs and reports.
+func parseActivityQueryValue(value string) (float64, error) {
+	switch value {
+	case "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.New("result is neither boolean nor numeric")
+	}
+	return parsed, nil
+}
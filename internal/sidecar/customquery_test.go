@@ -0,0 +1,274 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+func TestCustomQuerySource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		sql      string
+		value    *string
+		err      error
+		expected *activity.CustomQueryResult
+		wantErr  bool
+	}{
+		{
+			name:     "boolean true",
+			sql:      "SELECT EXISTS (SELECT 1 FROM jobs WHERE pending);",
+			value:    ptr.To("true"),
+			expected: &activity.CustomQueryResult{Name: "jobs/pending", Value: 1},
+		},
+		{
+			name:     "boolean false",
+			sql:      "SELECT EXISTS (SELECT 1 FROM jobs WHERE pending)",
+			value:    ptr.To("false"),
+			expected: &activity.CustomQueryResult{Name: "jobs/pending"},
+		},
+		{
+			name:     "numeric",
+			sql:      "SELECT count(*) FROM jobs",
+			value:    ptr.To("3"),
+			expected: &activity.CustomQueryResult{Name: "jobs/pending", Value: 3},
+		},
+		{
+			name:     "null",
+			sql:      "SELECT max(id) FROM jobs",
+			expected: &activity.CustomQueryResult{Name: "jobs/pending"},
+		},
+		{
+			name:     "no rows",
+			sql:      "SELECT 1 FROM jobs WHERE pending",
+			err:      postgres.ErrNoRows,
+			expected: &activity.CustomQueryResult{Name: "jobs/pending"},
+		},
+		{
+			name:    "not numeric",
+			sql:     "SELECT 'busy'",
+			value:   ptr.To("busy"),
+			wantErr: true,
+		},
+		{
+			name:    "query error",
+			sql:     "SELECT count(*) FROM missing",
+			err:     errors.New(`relation "missing" does not exist`),
+			wantErr: true,
+		},
+		{
+			name:    "empty query",
+			sql:     " ; ",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			querier := &customQuerier{value: tt.value, err: tt.err}
+			var connString string
+			source := &customQuerySource{
+				query: ActivityQuery{Name: "jobs/pending", SQL: tt.sql, Database: "app", User: "app", Password: "secret"},
+				connect: func(_ context.Context, url string) (postgres.Querier, error) {
+					connString = url
+					return querier, nil
+				},
+				own: newOwnTransactions(),
+			}
+
+			var report activity.Report
+			err := source.Collect(context.Background(), nil, &report)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, report.CustomQuery)
+			require.Contains(t, connString, "user='app'")
+			require.Contains(t, connString, "default_transaction_read_only=on")
+			require.NotContains(t, querier.query, ";)")
+		})
+	}
+}
+
+func TestCustomQuerySourceReconnectsAfterError(t *testing.T) {
+	t.Parallel()
+
+	failing := &customQuerier{err: errors.New("connection reset")}
+	connections := 0
+	source := &customQuerySource{
+		query: ActivityQuery{Name: "jobs/pending", SQL: "SELECT true", User: "app"},
+		connect: func(context.Context, string) (postgres.Querier, error) {
+			connections++
+			if connections == 1 {
+				return failing, nil
+			}
+			return &customQuerier{value: ptr.To("true")}, nil
+		},
+		own: newOwnTransactions(),
+	}
+
+	var report activity.Report
+	require.Error(t, source.Collect(context.Background(), nil, &report))
+	require.True(t, failing.closed)
+
+	require.NoError(t, source.Collect(context.Background(), nil, &report))
+	require.True(t, report.CustomQueryActive())
+	require.Equal(t, 2, connections)
+}
+
+func TestCustomQuerySourceDisabled(t *testing.T) {
+	t.Parallel()
+
+	var report activity.Report
+	require.NoError(t, (&customQuerySource{}).Collect(context.Background(), nil, &report))
+	require.Nil(t, report.CustomQuery)
+}
+
+func TestCustomQuerySourceDoesNotEchoResult(t *testing.T) {
+	t.Parallel()
+
+	source := &customQuerySource{
+		query: ActivityQuery{Name: "jobs/pending", SQL: "SELECT secret FROM credentials", User: "app"},
+		connect: func(context.Context, string) (postgres.Querier, error) {
+			return &customQuerier{value: ptr.To("root:x:0:0")}, nil
+		},
+		own: newOwnTransactions(),
+	}
+
+	var report activity.Report
+	err := source.Collect(context.Background(), nil, &report)
+	require.EqualError(t, err, `activity query "jobs/pending": result is neither boolean nor numeric`)
+	require.NotContains(t, err.Error(), "root")
+}
+
+func TestCustomQuerySourceRequiresUser(t *testing.T) {
+	t.Parallel()
+
+	connected := false
+	source := &customQuerySource{
+		query: ActivityQuery{Name: "jobs/pending", SQL: "SELECT true"},
+		connect: func(context.Context, string) (postgres.Querier, error) {
+			connected = true
+			return &customQuerier{value: ptr.To("true")}, nil
+		},
+		own: newOwnTransactions(),
+	}
+
+	var report activity.Report
+	require.Error(t, source.Collect(context.Background(), nil, &report))
+	require.False(t, connected)
+}
+
+func TestCustomQuerySourceSpacesEvaluations(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	own := newOwnTransactions()
+	own.now = func() time.Time { return now }
+	querier := &customQuerier{value: ptr.To("false")}
+	source := &customQuerySource{
+		query: ActivityQuery{Name: "jobs/pending", SQL: "SELECT count(*) > 0 FROM jobs", Database: "app", User: "app"},
+		connect: func(context.Context, string) (postgres.Querier, error) {
+			return querier, nil
+		},
+		own: own,
+	}
+
+	var report activity.Report
+	require.NoError(t, source.Collect(context.Background(), nil, &report))
+	require.Equal(t, 1, querier.queries)
+
+	// A scrape right after a sample reports the result of the sample.
+	querier.value = ptr.To("true")
+	now = now.Add(time.Second)
+	require.NoError(t, source.Collect(context.Background(), nil, &report))
+	require.Equal(t, 1, querier.queries)
+	require.False(t, report.CustomQueryActive())
+
+	now = now.Add(ownStatementInterval)
+	require.NoError(t, source.Collect(context.Background(), nil, &report))
+	require.Equal(t, 2, querier.queries)
+	require.True(t, report.CustomQueryActive())
+
+	counters, settled := own.settled()
+	require.Equal(t, activity.Counters{XactCommit: 2}, counters)
+	require.False(t, settled)
+}
+
+func TestReadOnlyConnString(t *testing.T) {
+	t.Parallel()
+
+	connString := readOnlyConnString(`it's\app`, 500*time.Millisecond)
+
+	require.Equal(t,
+		`user=postgres sslmode=disable dbname='it\'s\\app' application_name=scale-to-zero-activity-query default_transaction_read_only=on connect_timeout=5 statement_timeout=500 lock_timeout=500`,
+		connString)
+}
+
+func TestActivityQueryConnString(t *testing.T) {
+	t.Parallel()
+
+	query := ActivityQuery{Database: "app", User: "app", Password: `p'ss`, Timeout: time.Second}
+
+	require.Equal(t,
+		`host=localhost user='app' password='p\'ss' sslmode=prefer dbname='app' application_name=scale-to-zero-activity-query default_transaction_read_only=on connect_timeout=5 statement_timeout=1000 lock_timeout=1000`,
+		query.connString())
+}
+
+type customQuerier struct {
+	value   *string
+	err     error
+	query   string
+	queries int
+	closed  bool
+	// committed is called for every query, as PostgreSQL counts its
+	// transaction.
+	committed func()
+}
+
+func (c *customQuerier) QueryRow(_ context.Context, query string, _ ...any) postgres.Row {
+	c.query = query
+	c.queries++
+	if c.committed != nil {
+		c.committed()
+	}
+	return customQueryRow{value: c.value, err: c.err}
+}
+
+func (c *customQuerier) Query(context.Context, string, ...any) (postgres.Rows, error) {
+	return nil, errors.New("unexpected query")
+}
+
+func (c *customQuerier) Close(context.Context) error {
+	c.closed = true
+	return nil
+}
+
+type customQueryRow struct {
+	value *string
+	err   error
+}
+
+func (r customQueryRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	value, ok := dest[0].(**string)
+	if !ok {
+		return errors.New("expected **string")
+	}
+	*value = r.value
+	return nil
+}
@@ -0,0 +1,83 @@
+package sidecar
+
+import (
+	"context"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// logicalReplicationSource counts the logical replication backends, which the
+// central scraper classifies according to the cluster configuration.
+type logicalReplicationSource struct{}
+
+func (logicalReplicationSource) Name() string {
+	return SourceLogicalReplication
+}
+
+func (logicalReplicationSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `SELECT COUNT(*) FILTER (WHERE ` + logicalWalsenderFilter + `),
+	COUNT(*) FILTER (WHERE ` + logicalWorkerFilter + `),
+	COUNT(*) FILTER (WHERE ` + logicalWorkerFilter + ` AND state = 'active')
+FROM pg_stat_activity;`
+
+	return querier.QueryRow(ctx, query).Scan(
+		&report.LogicalReplication.Walsenders,
+		&report.LogicalReplication.Workers,
+		&report.LogicalReplication.ApplyingWorkers,
+	)
+}
+
+// dependenciesSource reports what external systems may still expect from the
+// instance: transactions prepared for two-phase commit, which an external
+// transaction manager is expected to resolve, and logical replication slots.
+type dependenciesSource struct{}
+
+func (dependenciesSource) Name() string {
+	return SourceDependencies
+}
+
+func (dependenciesSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `SELECT COUNT(*) FROM pg_prepared_xacts;`
+	if err := querier.QueryRow(ctx, query).Scan(&report.PreparedTransactions); err != nil {
+		return err
+	}
+
+	slots, err := replicationSlots(ctx, querier)
+	if err != nil {
+		return err
+	}
+	report.ReplicationSlots = slots
+	return nil
+}
+
+// replicationSlots lists the logical replication slots. The lag is measured
+// against the replay location on replicas, which may host slots since
+// PostgreSQL 16.
+func replicationSlots(ctx context.Context, querier postgres.Querier) ([]activity.ReplicationSlot, error) {
+	const query = `SELECT slot_name, COALESCE(database, ''), active,
+	COALESCE((CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END - confirmed_flush_lsn)::bigint, 0)
+FROM pg_replication_slots
+WHERE slot_type = 'logical'
+ORDER BY slot_name;`
+
+	rows, err := querier.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []activity.ReplicationSlot
+	for rows.Next() {
+		var slot activity.ReplicationSlot
+		if err := rows.Scan(&slot.Name, &slot.Database, &slot.Active, &slot.LagBytes); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return slots, nil
+}
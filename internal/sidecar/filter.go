@@ -0,0 +1,97 @@
+package sidecar
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+// clientSessionsFilter selects the sessions that count as activity, excluding
+// the sidecar's own sessions, physical replication, logical replication
+// backends, the configured exclusions and sessions idle for longer than the
+// idle session timeout. Its parameters are the values returned by filterArgs.
+const clientSessionsFilter = `state IN ('active', 'idle', 'idle in transaction')
+AND pg_backend_pid() != pg_stat_activity.pid
+AND COALESCE(application_name, '') NOT IN ('` + probeApplicationName + `', '` + activityQueryApplicationName + `')
+AND usename != 'streaming_replica'
+AND NOT (` + logicalWalsenderFilter + `)
+AND NOT (` + logicalWorkerFilter + `)
+AND COALESCE(usename, '') <> ALL($1::text[])
+AND COALESCE(datname, '') <> ALL($2::text[])
+AND NOT COALESCE(application_name, '') LIKE ANY($3::text[])
+AND (client_addr IS NULL OR NOT client_addr <<= ANY($4::text[]::cidr[]))
+AND COALESCE(backend_type, '') <> ALL($5::text[])
+AND NOT ($6::double precision > 0 AND state = 'idle' AND state_change < now() - make_interval(secs => $6::double precision))`
+
+// Logical walsenders are told apart from physical ones by their database, and
+// logical replication workers from the launcher by the backend type suffix,
+// which names the kind of worker since PostgreSQL 16.
+const (
+	logicalWalsenderFilter = `backend_type = 'walsender' AND datname IS NOT NULL`
+	logicalWorkerFilter    = `backend_type LIKE 'logical replication%worker'`
+)
+
+// filterArgs returns the clientSessionsFilter parameters. Every list is
+// non-nil, because comparing against a NULL array would exclude all sessions.
+// A zero idle session timeout counts idle sessions regardless of their age.
+func filterArgs(exclusions activity.Exclusions, idleSessionTimeout time.Duration) []any {
+	patterns := make([]string, 0, len(exclusions.ApplicationNames))
+	for _, name := range exclusions.ApplicationNames {
+		patterns = append(patterns, likePattern(name))
+	}
+
+	return []any{
+		nonNil(exclusions.Users),
+		nonNil(exclusions.Databases),
+		patterns,
+		nonNil(exclusions.ClientCIDRs),
+		nonNil(exclusions.BackendTypes),
+		max(idleSessionTimeout, 0).Seconds(),
+	}
+}
+
+// validExclusions drops the client CIDRs PostgreSQL would reject, so one
+// invalid entry does not make every activity query fail.
+func validExclusions(ctx context.Context, exclusions activity.Exclusions) activity.Exclusions {
+	cidrs := make([]string, 0, len(exclusions.ClientCIDRs))
+	for _, cidr := range exclusions.ClientCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.FromContext(ctx).Error(err, "ignoring invalid client CIDR exclusion", "cidr", cidr)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	exclusions.ClientCIDRs = cidrs
+	return exclusions
+}
+
+// likePattern converts a pattern using * and ? wildcards to a LIKE pattern,
+// escaping the LIKE wildcards that should match literally.
+func likePattern(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '\\', '%', '_':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
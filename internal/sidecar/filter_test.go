@@ -0,0 +1,107 @@
+package sidecar
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+func TestFilterArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name               string
+		exclusions         activity.Exclusions
+		idleSessionTimeout time.Duration
+		want               []any
+	}{
+		{
+			name:       "no exclusions",
+			exclusions: activity.Exclusions{},
+			want:       []any{[]string{}, []string{}, []string{}, []string{}, []string{}, 0.0},
+		},
+		{
+			name:               "idle session timeout",
+			idleSessionTimeout: 90 * time.Minute,
+			want:               []any{[]string{}, []string{}, []string{}, []string{}, []string{}, 5400.0},
+		},
+		{
+			name: "all exclusions",
+			exclusions: activity.Exclusions{
+				Users:            []string{"monitoring"},
+				Databases:        []string{"metrics"},
+				ApplicationNames: []string{"pgbouncer*", "health?check", "100%_ok\\"},
+				ClientCIDRs:      []string{"10.0.0.0/8"},
+				BackendTypes:     []string{"walsender"},
+			},
+			want: []any{
+				[]string{"monitoring"},
+				[]string{"metrics"},
+				[]string{"pgbouncer%", "health_check", "100\\%\\_ok\\\\"},
+				[]string{"10.0.0.0/8"},
+				[]string{"walsender"},
+				0.0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.want, filterArgs(tt.exclusions, tt.idleSessionTimeout))
+		})
+	}
+}
+
+func TestClientSessionsFilterExcludesPooledProbeConnections(t *testing.T) {
+	t.Parallel()
+
+	excluded := regexp.MustCompile(`COALESCE\(application_name, ''\) NOT IN \(([^)]*)\)`).FindStringSubmatch(clientSessionsFilter)
+	require.NotNil(t, excluded)
+	var names []string
+	for _, name := range strings.Split(excluded[1], ",") {
+		names = append(names, strings.Trim(strings.TrimSpace(name), "'"))
+	}
+	probeName := regexp.MustCompile(`application_name=(\S+)`).FindStringSubmatch(postgresConnString())
+	require.NotNil(t, probeName)
+
+	// The pool holds two probe connections, one of which runs the query.
+	const backendPID = 1
+	sessions := []struct {
+		pid             int
+		applicationName string
+	}{
+		{pid: backendPID, applicationName: probeName[1]},
+		{pid: 2, applicationName: probeName[1]},
+		{pid: 3, applicationName: activityQueryApplicationName},
+		{pid: 4, applicationName: "api"},
+	}
+	var counted []int
+	for _, session := range sessions {
+		if session.pid != backendPID && !slices.Contains(names, session.applicationName) {
+			counted = append(counted, session.pid)
+		}
+	}
+	require.Equal(t, []int{4}, counted)
+}
+
+func TestValidExclusionsDropsInvalidCIDRs(t *testing.T) {
+	t.Parallel()
+
+	exclusions := validExclusions(context.Background(), activity.Exclusions{
+		Users:       []string{"monitoring"},
+		ClientCIDRs: []string{"10.0.0.0/8", "10.0.0.1", "fd00::/8"},
+	})
+
+	require.Equal(t, activity.Exclusions{
+		Users:       []string{"monitoring"},
+		ClientCIDRs: []string{"10.0.0.0/8", "fd00::/8"},
+	}, exclusions)
+}
@@ -0,0 +1,134 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// holdsSource reports the holds applications place to keep the cluster awake
+// without Kubernetes access: sessions holding the activity.HoldAdvisoryLockKey
+// advisory lock in any database, and unexpired rows of the
+// scale_to_zero.holds table in the hold database. The table is read on its own
+// connection, created on first use, and skipped while it does not exist. Like
+// the custom activity query, it is read at most every ownStatementInterval,
+// and the previous rows are reported in between.
+//
+// The application controls the table, which could be a view or call
+// functions running with the privileges of the reader, so it is read as the
+// owner of the application database and never as the postgres user.
+type holdsSource struct {
+	database string
+	user     string
+	password string
+	connect  querierFactory
+	querier  postgres.Querier
+	own      *ownTransactions
+	// read is when the table was last read, and tableHolds what it listed.
+	read       time.Time
+	tableHolds []activity.Hold
+}
+
+func (*holdsSource) Name() string {
+	return SourceHolds
+}
+
+func (s *holdsSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	if err := advisoryLockHolds(ctx, querier, report); err != nil {
+		return err
+	}
+	if s.database == "" {
+		return nil
+	}
+	if !s.read.IsZero() && !s.own.due(s.read) {
+		report.Holds = append(report.Holds, s.tableHolds...)
+		return nil
+	}
+
+	if s.user == "" {
+		return fmt.Errorf("hold database %q has no user", s.database)
+	}
+	if s.querier == nil {
+		querier, err := s.connect(ctx, applicationConnString(s.user, s.password, s.database, defaultActivityQueryTimeout))
+		if err != nil {
+			return fmt.Errorf("connect hold database %q: %w", s.database, err)
+		}
+		s.querier = querier
+	}
+	holds, err := tableHolds(ctx, s.querier, s.database)
+	s.own.record(s.database, err)
+	if err != nil && !postgres.IsUndefinedTable(err) {
+		// The connection is replaced on the next collection, in case it is
+		// the reason for the failure.
+		_ = s.querier.Close(ctx)
+		s.querier = nil
+		return fmt.Errorf("read hold table: %w", err)
+	}
+	s.read = s.own.now()
+	s.tableHolds = holds
+	report.Holds = append(report.Holds, holds...)
+	return nil
+}
+
+// Close closes the hold database connection.
+func (s *holdsSource) Close(ctx context.Context) error {
+	if s.querier == nil {
+		return nil
+	}
+	return s.querier.Close(ctx)
+}
+
+// advisoryLockHolds lists the sessions holding the hold advisory lock. A
+// bigint key is split into classid and objid in pg_locks, with objsubid 1.
+func advisoryLockHolds(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `SELECT DISTINCT COALESCE(a.datname, ''), COALESCE(a.application_name, '')
+FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+AND l.classid = $1::bigint::oid AND l.objid = $2::bigint::oid
+ORDER BY 1, 2;`
+
+	rows, err := querier.Query(ctx, query, activity.HoldAdvisoryLockKey>>32, activity.HoldAdvisoryLockKey&0xffffffff)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		hold := activity.Hold{Source: activity.HoldAdvisoryLock}
+		if err := rows.Scan(&hold.Database, &hold.Holder); err != nil {
+			return err
+		}
+		report.Holds = append(report.Holds, hold)
+	}
+	return rows.Err()
+}
+
+// tableHolds lists the rows of scale_to_zero.holds that have not expired. A
+// row without expiry holds the cluster until it is deleted. The table is read
+// in a single statement, which fails with an undefined table error while it
+// does not exist.
+func tableHolds(ctx context.Context, querier postgres.Querier, database string) ([]activity.Hold, error) {
+	const query = `SELECT holder::text, COALESCE(reason::text, ''), expires_at
+FROM scale_to_zero.holds
+WHERE expires_at IS NULL OR expires_at > now()
+ORDER BY holder;`
+
+	rows, err := querier.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []activity.Hold
+	for rows.Next() {
+		hold := activity.Hold{Source: activity.HoldTable, Database: database}
+		if err := rows.Scan(&hold.Holder, &hold.Reason, &hold.ExpiresAt); err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
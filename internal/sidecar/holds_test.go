@@ -0,0 +1,170 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+func TestHoldsSource(t *testing.T) {
+	t.Parallel()
+
+	expiresAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		database    string
+		user        string
+		querier     mockQuerier
+		holdQuerier mockQuerier
+		connectErr  error
+		expected    []activity.Hold
+		wantErr     bool
+	}{
+		{
+			name:     "no holds",
+			database: "app",
+			user:     "app",
+		},
+		{
+			name:    "advisory lock",
+			querier: mockQuerier{lockHolds: []activity.Hold{{Database: "app", Holder: "importer"}}},
+			expected: []activity.Hold{
+				{Source: activity.HoldAdvisoryLock, Database: "app", Holder: "importer"},
+			},
+		},
+		{
+			name:     "hold table",
+			database: "app",
+			user:     "app",
+			querier:  mockQuerier{lockHolds: []activity.Hold{{Database: "postgres", Holder: "psql"}}},
+			holdQuerier: mockQuerier{tableHolds: []activity.Hold{
+				{Holder: "backfill", Reason: "migrating orders", ExpiresAt: &expiresAt},
+				{Holder: "support"},
+			}},
+			expected: []activity.Hold{
+				{Source: activity.HoldAdvisoryLock, Database: "postgres", Holder: "psql"},
+				{Source: activity.HoldTable, Database: "app", Holder: "backfill", Reason: "migrating orders", ExpiresAt: &expiresAt},
+				{Source: activity.HoldTable, Database: "app", Holder: "support"},
+			},
+		},
+		{
+			name:    "hold table skipped without database",
+			querier: mockQuerier{},
+		},
+		{
+			name:        "hold table error",
+			database:    "app",
+			user:        "app",
+			holdQuerier: mockQuerier{tableHolds: []activity.Hold{}, err: errors.New("permission denied")},
+			wantErr:     true,
+		},
+		{
+			name:       "connection error",
+			database:   "app",
+			user:       "app",
+			connectErr: errors.New("database does not exist"),
+			wantErr:    true,
+		},
+		{
+			name:     "hold table without user",
+			database: "app",
+			wantErr:  true,
+		},
+		{
+			name:    "lock query error",
+			querier: mockQuerier{err: errors.New("query failed")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var connString string
+			source := &holdsSource{
+				database: tt.database,
+				user:     tt.user,
+				connect: func(_ context.Context, url string) (postgres.Querier, error) {
+					connString = url
+					return tt.holdQuerier, tt.connectErr
+				},
+				own: newOwnTransactions(),
+			}
+
+			var report activity.Report
+			err := source.Collect(context.Background(), tt.querier, &report)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Nil(t, source.querier)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, report.Holds)
+			require.Equal(t, len(tt.expected) > 0, report.Held())
+			if tt.database != "" {
+				require.Contains(t, connString, "host=localhost user='app'")
+				require.Contains(t, connString, "dbname='app'")
+				require.Contains(t, connString, "default_transaction_read_only=on")
+			}
+		})
+	}
+}
+
+func TestHoldsSourceSpacesTableReads(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	own := newOwnTransactions()
+	own.now = func() time.Time { return now }
+	reads := 0
+	holdQuerier := committingQuerier{
+		Querier:   mockQuerier{tableHolds: []activity.Hold{{Holder: "backfill"}}},
+		committed: func() { reads++ },
+	}
+	source := &holdsSource{
+		database: "app",
+		user:     "app",
+		connect:  func(context.Context, string) (postgres.Querier, error) { return holdQuerier, nil },
+		own:      own,
+	}
+	expected := []activity.Hold{{Source: activity.HoldTable, Database: "app", Holder: "backfill"}}
+
+	for _, at := range []time.Duration{0, time.Second, ownStatementInterval} {
+		now = now.Add(at)
+		var report activity.Report
+		require.NoError(t, source.Collect(context.Background(), mockQuerier{}, &report))
+		require.Equal(t, expected, report.Holds)
+	}
+	require.Equal(t, 2, reads)
+
+	counters, settled := own.settled()
+	require.Equal(t, activity.Counters{XactCommit: 2}, counters)
+	require.False(t, settled)
+}
+
+func TestHoldsSourceMissingTable(t *testing.T) {
+	t.Parallel()
+
+	own := newOwnTransactions()
+	source := &holdsSource{
+		database: "app",
+		user:     "app",
+		connect:  func(context.Context, string) (postgres.Querier, error) { return mockQuerier{}, nil },
+		own:      own,
+	}
+
+	var report activity.Report
+	require.NoError(t, source.Collect(context.Background(), mockQuerier{}, &report))
+	require.Empty(t, report.Holds)
+	require.NotNil(t, source.querier)
+
+	counters, _ := own.settled()
+	require.Equal(t, activity.Counters{XactRollback: 1}, counters)
+}
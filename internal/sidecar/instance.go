@@ -0,0 +1,26 @@
+package sidecar
+
+import (
+	"context"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// instanceIdentity reads the role, timeline and system identifier of the
+// instance. It is part of every report rather than an activity source,
+// because the scraper relies on it to recognize a stale primary. A primary's
+// timeline comes from its current WAL file name, since the checkpoint
+// timeline lags behind a promotion until the next checkpoint.
+func instanceIdentity(ctx context.Context, querier postgres.Querier) (activity.Instance, error) {
+	const query = `SELECT pg_is_in_recovery(),
+	CASE WHEN pg_is_in_recovery() THEN (SELECT timeline_id FROM pg_control_checkpoint())::bigint
+	ELSE ('x' || substr(pg_walfile_name(pg_current_wal_lsn()), 1, 8))::bit(32)::bigint END,
+	(SELECT system_identifier FROM pg_control_system())::text;`
+
+	var instance activity.Instance
+	if err := querier.QueryRow(ctx, query).Scan(&instance.InRecovery, &instance.Timeline, &instance.SystemIdentifier); err != nil {
+		return activity.Instance{}, err
+	}
+	return instance, nil
+}
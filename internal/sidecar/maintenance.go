@@ -0,0 +1,57 @@
+package sidecar
+
+import (
+	"context"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// maintenanceSource lists the maintenance operations in progress from the
+// pg_stat_progress views, which exist since PostgreSQL 13, and the pg_dump
+// sessions in pg_stat_activity. Autovacuum is told apart from a manual VACUUM
+// or ANALYZE by the backend type of the worker. The kinds match the
+// activity.Maintenance constants.
+type maintenanceSource struct{}
+
+func (maintenanceSource) Name() string {
+	return SourceMaintenance
+}
+
+func (maintenanceSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `WITH operations AS (
+	SELECT CASE WHEN a.backend_type = 'autovacuum worker' THEN 'autovacuum' ELSE 'vacuum' END AS kind, p.datname
+	FROM pg_stat_progress_vacuum p LEFT JOIN pg_stat_activity a ON a.pid = p.pid
+	UNION ALL
+	SELECT CASE WHEN a.backend_type = 'autovacuum worker' THEN 'autovacuum' ELSE 'analyze' END, p.datname
+	FROM pg_stat_progress_analyze p LEFT JOIN pg_stat_activity a ON a.pid = p.pid
+	UNION ALL
+	SELECT 'create_index', datname FROM pg_stat_progress_create_index
+	UNION ALL
+	SELECT 'cluster', datname FROM pg_stat_progress_cluster
+	UNION ALL
+	SELECT 'base_backup', NULL FROM pg_stat_progress_basebackup
+	UNION ALL
+	SELECT 'dump', datname FROM pg_stat_activity
+	WHERE application_name IN ('pg_dump', 'pg_dumpall') AND state IS NOT NULL AND pid != pg_backend_pid()
+)
+SELECT kind, COALESCE(datname, ''), COUNT(*)
+FROM operations
+GROUP BY 1, 2
+ORDER BY 1, 2;`
+
+	rows, err := querier.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var operation activity.MaintenanceOperation
+		if err := rows.Scan(&operation.Kind, &operation.Database, &operation.Count); err != nil {
+			return err
+		}
+		report.Maintenance = append(report.Maintenance, operation)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,136 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	queryAttribute       = "query"
+	stateAttribute       = "state"
+	resultAttribute      = "result"
+	resultSuccess        = "success"
+	resultError          = "error"
+	queryInstance        = "instance"
+	queryOpenConnections = "open-connections"
+	queryReadiness       = "readiness"
+	queryTerminate       = "terminate"
+)
+
+// probeMetrics records the sidecar's own behavior. A nil *probeMetrics
+// records nothing, so probes built without a meter still work.
+type probeMetrics struct {
+	queryDuration     metric.Float64Histogram
+	queryErrors       metric.Int64Counter
+	reinitializations metric.Int64Counter
+}
+
+// newProbeMetrics creates the sidecar instruments. stats returns the
+// statistics of the probe's connection pool, or nil when it has none.
+func newProbeMetrics(meter metric.Meter, stats func() *pgxpool.Stat) (*probeMetrics, error) {
+	queryDuration, err := meter.Float64Histogram(
+		"cnpg_scale_to_zero_sidecar_query_duration",
+		metric.WithDescription("Duration of PostgreSQL queries run by the sidecar"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create query duration histogram: %w", err)
+	}
+	queryErrors, err := meter.Int64Counter(
+		"cnpg_scale_to_zero_sidecar_query_errors",
+		metric.WithDescription("Number of failed PostgreSQL queries run by the sidecar"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create query errors counter: %w", err)
+	}
+	reinitializations, err := meter.Int64Counter(
+		"cnpg_scale_to_zero_sidecar_reinitializations",
+		metric.WithDescription("Number of PostgreSQL connection pool reinitializations after a refused connection"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create reinitializations counter: %w", err)
+	}
+
+	poolConnections, err := meter.Int64ObservableGauge(
+		"cnpg_scale_to_zero_sidecar_pool_connections",
+		metric.WithDescription("Number of connections in the sidecar connection pool"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create pool connections gauge: %w", err)
+	}
+	poolMaxConnections, err := meter.Int64ObservableGauge(
+		"cnpg_scale_to_zero_sidecar_pool_max_connections",
+		metric.WithDescription("Maximum number of connections in the sidecar connection pool"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create pool max connections gauge: %w", err)
+	}
+	poolAcquires, err := meter.Int64ObservableCounter(
+		"cnpg_scale_to_zero_sidecar_pool_acquires",
+		metric.WithDescription("Number of connections acquired from the sidecar connection pool"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create pool acquires counter: %w", err)
+	}
+	poolEmptyAcquires, err := meter.Int64ObservableCounter(
+		"cnpg_scale_to_zero_sidecar_pool_empty_acquires",
+		metric.WithDescription("Number of acquires that waited for a connection because the pool had no idle one"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create pool empty acquires counter: %w", err)
+	}
+	if _, err := meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		stat := stats()
+		if stat == nil {
+			return nil
+		}
+		observer.ObserveInt64(poolConnections, int64(stat.IdleConns()), metric.WithAttributes(attribute.String(stateAttribute, "idle")))
+		observer.ObserveInt64(poolConnections, int64(stat.AcquiredConns()), metric.WithAttributes(attribute.String(stateAttribute, "acquired")))
+		observer.ObserveInt64(poolConnections, int64(stat.ConstructingConns()), metric.WithAttributes(attribute.String(stateAttribute, "constructing")))
+		observer.ObserveInt64(poolMaxConnections, int64(stat.MaxConns()))
+		observer.ObserveInt64(poolAcquires, stat.AcquireCount())
+		observer.ObserveInt64(poolEmptyAcquires, stat.EmptyAcquireCount())
+		return nil
+	}, poolConnections, poolMaxConnections, poolAcquires, poolEmptyAcquires); err != nil {
+		return nil, fmt.Errorf("register pool statistics callback: %w", err)
+	}
+
+	return &probeMetrics{
+		queryDuration:     queryDuration,
+		queryErrors:       queryErrors,
+		reinitializations: reinitializations,
+	}, nil
+}
+
+// measure runs a query and records its duration, and its failure.
+func (m *probeMetrics) measure(ctx context.Context, query string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	if m == nil {
+		return err
+	}
+
+	attributes := metric.WithAttributes(attribute.String(queryAttribute, query))
+	m.queryDuration.Record(ctx, time.Since(start).Seconds(), attributes)
+	if err != nil {
+		m.queryErrors.Add(ctx, 1, attributes)
+	}
+	return err
+}
+
+func (m *probeMetrics) reinitialized(ctx context.Context, err error) {
+	if m == nil {
+		return
+	}
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	m.reinitializations.Add(ctx, 1, metric.WithAttributes(attribute.String(resultAttribute, result)))
+}
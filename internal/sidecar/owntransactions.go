@@ -0,0 +1,81 @@
+package sidecar
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// ownStatementInterval spaces the statements the sidecar runs in application
+// databases. PostgreSQL 15 and later publish the statistics of a backend
+// when it goes idle, unless it did less than a second before, and older
+// versions send them to the statistics collector at most every 500ms. The
+// transactions of statements further apart are therefore counted in
+// pg_stat_database before the next counters are read.
+const ownStatementInterval = 2 * time.Second
+
+// counterExcludedDatabases are left out of the transaction counters, see
+// countersSource.
+var counterExcludedDatabases = []string{"postgres", "template0", "template1"}
+
+// ownTransactions counts the transactions the sidecar runs itself on its
+// connections to application databases, such as the custom activity query.
+// They advance pg_stat_database like the transactions of clients, so the
+// counters source subtracts them, and holds its previous counters back until
+// the latest ones are visible.
+//
+// Each connection runs a single statement per report, which is one
+// transaction with postgres.Conn, and no more often than
+// ownStatementInterval. A statement that fails without reaching PostgreSQL
+// leaves the count unknown, which shows as one advance of the counters.
+type ownTransactions struct {
+	mu       sync.Mutex
+	counters activity.Counters
+	latest   time.Time
+	now      func() time.Time
+}
+
+func newOwnTransactions() *ownTransactions {
+	return &ownTransactions{now: time.Now}
+}
+
+// record counts the transaction of a statement that ran in database and
+// returned err. PostgreSQL rolls the transaction back when it returns an
+// error.
+func (o *ownTransactions) record(database string, err error) {
+	if slices.Contains(counterExcludedDatabases, database) {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.latest = o.now()
+
+	var pgErr *pgconn.PgError
+	switch {
+	case err == nil || errors.Is(err, postgres.ErrNoRows):
+		o.counters.XactCommit++
+	case errors.As(err, &pgErr):
+		o.counters.XactRollback++
+	}
+}
+
+// due reports whether a connection whose previous statement ran at previous
+// may run another one.
+func (o *ownTransactions) due(previous time.Time) bool {
+	return previous.IsZero() || o.now().Sub(previous) >= ownStatementInterval
+}
+
+// settled returns the transactions counted so far, and whether the latest of
+// them had time to reach pg_stat_database.
+func (o *ownTransactions) settled() (activity.Counters, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.counters, o.latest.IsZero() || o.now().Sub(o.latest) >= ownStatementInterval
+}
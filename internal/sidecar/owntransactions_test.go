@@ -0,0 +1,138 @@
+package sidecar
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+func TestOwnTransactionsDoNotAdvanceCounters(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sources []string
+	}{
+		{name: "custom query", sources: []string{SourceCounters, SourceCustomQuery}},
+		{name: "hold table", sources: []string{SourceCounters, SourceHolds}},
+		{name: "hold table and custom query", sources: []string{SourceCounters, SourceHolds, SourceCustomQuery}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			stats := &databaseStats{}
+			cfg := Config{
+				ActivitySources: tt.sources,
+				ActivityQuery:   ActivityQuery{Name: "jobs/pending", SQL: "SELECT false", Database: "jobs", User: "app"},
+				HoldDatabase:    "app",
+				ApplicationUser: "app",
+			}
+			p := newTestOwnTransactionsProbe(t, stats, cfg, func(_ context.Context, url string) (postgres.Querier, error) {
+				if strings.Contains(url, "dbname='jobs'") {
+					return &customQuerier{value: ptr.To("false"), committed: stats.commit}, nil
+				}
+				return committingQuerier{Querier: mockQuerier{tableHolds: []activity.Hold{}}, committed: stats.commit}, nil
+			})
+
+			samples := []struct {
+				name     string
+				at       time.Duration
+				clients  int64
+				advanced bool
+			}{
+				{name: "sample"},
+				{name: "idle sample", at: defaultSampleInterval},
+				{name: "scrape right after the sample", at: defaultSampleInterval + 500*time.Millisecond},
+				{name: "next idle sample", at: 2 * defaultSampleInterval},
+				{name: "client transaction", at: 3 * defaultSampleInterval, clients: 1, advanced: true},
+				{name: "idle again", at: 4 * defaultSampleInterval},
+			}
+
+			var previous *activity.Counters
+			for _, sample := range samples {
+				p.now = p.start.Add(sample.at)
+				stats.clients += sample.clients
+				report, err := p.activity(context.Background())
+				require.NoError(t, err, sample.name)
+				require.NotNil(t, report.Counters, sample.name)
+				if previous != nil {
+					require.Equal(t, sample.advanced, report.Counters.AdvancedSince(*previous), sample.name)
+				}
+				previous = report.Counters
+			}
+			require.Positive(t, stats.own)
+		})
+	}
+}
+
+// testOwnTransactionsProbe is a probe whose counters source reads stats, at a
+// time set by the test.
+type testOwnTransactionsProbe struct {
+	*probe
+	start time.Time
+	now   time.Time
+}
+
+func newTestOwnTransactionsProbe(t *testing.T, stats *databaseStats, cfg Config, connect querierFactory) *testOwnTransactionsProbe {
+	t.Helper()
+
+	p := &testOwnTransactionsProbe{start: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	p.now = p.start
+	p.probe = &probe{
+		pgQuerier: statsQuerier{stats: stats},
+		sources:   newActivitySources(context.Background(), cfg, connect),
+	}
+	counters, ok := p.sources[0].(*countersSource)
+	require.True(t, ok)
+	counters.own.now = func() time.Time { return p.now }
+	return p
+}
+
+// databaseStats stands for pg_stat_database, where the transactions of the
+// sidecar are counted along with those of clients.
+type databaseStats struct {
+	clients int64
+	own     int64
+}
+
+func (s *databaseStats) commit() {
+	s.own++
+}
+
+// statsQuerier is the probe's querier, reading the counters from stats.
+type statsQuerier struct {
+	mockQuerier
+	stats *databaseStats
+}
+
+func (q statsQuerier) QueryRow(ctx context.Context, query string, args ...any) postgres.Row {
+	if !strings.Contains(query, "pg_stat_database") {
+		return q.mockQuerier.QueryRow(ctx, query, args...)
+	}
+	return mockCountersRow{counters: activity.Counters{XactCommit: 100 + q.stats.clients + q.stats.own}}
+}
+
+// committingQuerier counts the transaction of every statement it runs.
+type committingQuerier struct {
+	postgres.Querier
+	committed func()
+}
+
+func (q committingQuerier) QueryRow(ctx context.Context, query string, args ...any) postgres.Row {
+	q.committed()
+	return q.Querier.QueryRow(ctx, query, args...)
+}
+
+func (q committingQuerier) Query(ctx context.Context, query string, args ...any) (postgres.Rows, error) {
+	q.committed()
+	return q.Querier.Query(ctx, query, args...)
+}
@@ -6,30 +6,115 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/mtls"
+	pluginmetrics "github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/metrics"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/errgroup"
 )
 
 const defaultListenAddress = ":9188"
 
+// Timeouts of the probe's own connection. A probe query never waits long for
+// a lock or runs longer than a scrape may take, so a stuck query cannot keep
+// the probe from answering.
+const (
+	connectTimeout   = 5 * time.Second
+	statementTimeout = 5 * time.Second
+	lockTimeout      = time.Second
+)
+
 type Config struct {
-	ListenAddress string
+	ListenAddress  string
+	SampleInterval time.Duration
+	// Exclusions describe sessions that never count as activity
+	Exclusions activity.Exclusions
+	// IdleSessionTimeout is how long an idle session counts as activity after
+	// its last state change. Zero counts idle sessions regardless of age.
+	IdleSessionTimeout time.Duration
+	// TerminateIdleAfter is the shortest idle time of the sessions the
+	// sidecar terminates on request. Zero refuses every termination request,
+	// for clusters that did not opt in.
+	TerminateIdleAfter time.Duration
+	ActivityQuery      ActivityQuery
+	// ActivitySources lists the enabled activity sources. Empty enables the
+	// default ones.
+	ActivitySources []string
+	// PostgresPort is the TCP port PostgreSQL listens on.
+	PostgresPort int
+	// HoldDatabase is the database of the hold table. The table is not read
+	// when empty.
+	HoldDatabase string
+	// ApplicationUser and ApplicationPassword authenticate the owner of the
+	// application database, which reads the hold table.
+	ApplicationUser     string
+	ApplicationPassword string
+	// TLSCertDir holds the tls.crt, tls.key and ca.crt files of the server
+	// certificate. The sidecar serves plain HTTP when empty.
+	TLSCertDir string
+	// HealthListenAddress serves the health, readiness and metrics endpoints
+	// in plain HTTP on their own address when set.
+	HealthListenAddress string
+	// Push makes the sidecar push its reports to the plugin when its URL is
+	// set.
+	Push PushConfig
 }
 
 type probe struct {
-	pgQuerier        postgres.Querier
-	pgQuerierFactory func(ctx context.Context, url string) (postgres.Querier, error)
+	// mu serializes queries from the HTTP handlers and the sampler, which may
+	// both replace the querier.
+	mu                 sync.Mutex
+	pgQuerier          postgres.Querier
+	pgQuerierFactory   querierFactory
+	tracker            activityTracker
+	sources            []ActivitySource
+	exclusions         activity.Exclusions
+	idleSessionTimeout time.Duration
+	terminateIdleAfter time.Duration
+	// pool is the querier when it is a connection pool, for its statistics.
+	pool           atomic.Pointer[postgres.Pool]
+	connection     connectionTracker
+	metrics        *probeMetrics
+	metricsHandler http.Handler
+	// requireClientCertificate restricts the activity endpoints to clients
+	// with a verified certificate.
+	requireClientCertificate bool
 }
 
-func newProbe(ctx context.Context) (*probe, error) {
+func newProbe(ctx context.Context, cfg Config, meter metric.Meter) (*probe, error) {
+	cfg.Exclusions = validExclusions(ctx, cfg.Exclusions)
 	p := &probe{
+		exclusions:         cfg.Exclusions,
+		idleSessionTimeout: cfg.IdleSessionTimeout,
+		terminateIdleAfter: cfg.TerminateIdleAfter,
 		pgQuerierFactory: func(ctx context.Context, url string) (postgres.Querier, error) {
 			return postgres.NewConnPool(ctx, url)
 		},
 	}
+	p.sources = newActivitySources(ctx, cfg, func(ctx context.Context, url string) (postgres.Querier, error) {
+		return postgres.NewConn(ctx, url)
+	})
+
+	metrics, err := newProbeMetrics(meter, func() *pgxpool.Stat {
+		if pool := p.pool.Load(); pool != nil {
+			return pool.Stat()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.metrics = metrics
 
 	if err := p.initQuerier(ctx); err != nil {
 		return nil, fmt.Errorf("initialize PostgreSQL querier: %w", err)
@@ -39,6 +124,13 @@ func newProbe(ctx context.Context) (*probe, error) {
 }
 
 func (p *probe) close(ctx context.Context) {
+	for _, source := range p.sources {
+		if closer, ok := source.(interface{ Close(context.Context) error }); ok {
+			if err := closer.Close(ctx); err != nil {
+				log.FromContext(ctx).Error(err, "activity source close error", "source", source.Name())
+			}
+		}
+	}
 	if p.pgQuerier == nil {
 		return
 	}
@@ -58,45 +150,173 @@ func (p *probe) initQuerier(ctx context.Context) error {
 	}
 
 	p.pgQuerier = querier
+	pool, _ := querier.(*postgres.Pool)
+	p.pool.Store(pool)
 	return nil
 }
 
+// probeApplicationName identifies the connections of the probe pool. The pool
+// holds up to two connections, so the filter must exclude the other one by
+// name as well as the current one by pid.
+const probeApplicationName = "scale-to-zero"
+
 func postgresConnString() string {
-	return "user=postgres dbname=postgres sslmode=disable application_name=scale-to-zero"
+	return fmt.Sprintf(
+		"user=postgres dbname=postgres sslmode=disable application_name=%s connect_timeout=%d statement_timeout=%d lock_timeout=%d",
+		probeApplicationName,
+		int(connectTimeout.Seconds()),
+		statementTimeout.Milliseconds(),
+		lockTimeout.Milliseconds(),
+	)
 }
 
 func (p *probe) connections(ctx context.Context) (int, error) {
-	openConns, err := p.openConnections(ctx)
+	var openConns int
+	err := p.withReinitialization(ctx, func(ctx context.Context) error {
+		return p.metrics.measure(ctx, queryOpenConnections, func() error {
+			var err error
+			openConns, err = p.openConnections(ctx)
+			return err
+		})
+	})
 	if err != nil {
-		if !errors.Is(err, syscall.ECONNREFUSED) {
-			return 0, fmt.Errorf("query open connections: %w", err)
-		}
+		return 0, fmt.Errorf("query open connections: %w", err)
+	}
+
+	return openConns, nil
+}
 
-		if err := p.initQuerier(ctx); err != nil {
-			return 0, fmt.Errorf("reinitialize PostgreSQL querier: %w", err)
+func (p *probe) activity(ctx context.Context) (activity.Report, error) {
+	var report activity.Report
+	err := p.withReinitialization(ctx, func(ctx context.Context) error {
+		report = activity.Report{Version: activity.ReportVersion}
+		if err := p.metrics.measure(ctx, queryInstance, func() error {
+			instance, err := instanceIdentity(ctx, p.pgQuerier)
+			report.Instance = &instance
+			return err
+		}); err != nil {
+			return fmt.Errorf("instance: %w", err)
 		}
-		openConns, err = p.openConnections(ctx)
-		if err != nil {
-			return 0, fmt.Errorf("query open connections after reinitialization: %w", err)
+		for _, source := range p.sources {
+			if err := p.metrics.measure(ctx, source.Name(), func() error {
+				return source.Collect(ctx, p.pgQuerier, &report)
+			}); err != nil {
+				return fmt.Errorf("%s: %w", source.Name(), err)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return activity.Report{}, fmt.Errorf("collect activity: %w", err)
 	}
 
-	return openConns, nil
+	return report, nil
+}
+
+// currentReport collects a report and adds when the sampler last saw
+// activity.
+func (p *probe) currentReport(ctx context.Context) (activity.Report, error) {
+	report, err := p.activity(ctx)
+	if err != nil {
+		return activity.Report{}, err
+	}
+	report.GeneratedAt = time.Now()
+	if lastActive, sampling := p.tracker.observe(report.GeneratedAt, report); sampling {
+		report.LastActive = &lastActive
+	}
+	return report, nil
+}
+
+// withReinitialization runs fn again with a new querier when the connection
+// to PostgreSQL failed, which happens while the server restarts. Failed
+// reconnections are retried with exponential backoff, and fn fails without
+// a reconnection until the backoff elapsed.
+func (p *probe) withReinitialization(ctx context.Context, fn func(context.Context) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := fn(ctx)
+	if !postgres.IsConnectionError(err) {
+		p.connection.succeeded()
+		return err
+	}
+	now := time.Now()
+	if !p.connection.reconnectDue(now) {
+		return fmt.Errorf("waiting to reconnect to PostgreSQL: %w", err)
+	}
+
+	err = p.initQuerier(ctx)
+	p.metrics.reinitialized(ctx, err)
+	if err != nil {
+		p.connection.failed(now, err)
+		return fmt.Errorf("reinitialize PostgreSQL querier: %w", err)
+	}
+	if err := fn(ctx); err != nil {
+		if postgres.IsConnectionError(err) {
+			p.connection.failed(now, err)
+		} else {
+			p.connection.succeeded()
+		}
+		return fmt.Errorf("after reinitialization: %w", err)
+	}
+	p.connection.succeeded()
+	return nil
+}
+
+// ready checks that PostgreSQL accepts connections on its socket and answers
+// queries.
+func (p *probe) ready(ctx context.Context) error {
+	return p.withReinitialization(ctx, func(ctx context.Context) error {
+		return p.metrics.measure(ctx, queryReadiness, func() error {
+			var one int
+			return p.pgQuerier.QueryRow(ctx, `SELECT 1;`).Scan(&one)
+		})
+	})
 }
 
 func (p *probe) openConnections(ctx context.Context) (int, error) {
-	const query = `SELECT COUNT(*) FROM pg_stat_activity WHERE state IN ('active', 'idle', 'idle in transaction') AND pg_backend_pid() != pg_stat_activity.pid AND usename != 'streaming_replica';`
+	const query = `SELECT COUNT(*) FROM pg_stat_activity WHERE ` + clientSessionsFilter + `;`
 	var count int
-	if err := p.pgQuerier.QueryRow(ctx, query).Scan(&count); err != nil {
-		return 0, fmt.Errorf("query open connections: %w", err)
+	if err := p.pgQuerier.QueryRow(ctx, query, filterArgs(p.exclusions, p.idleSessionTimeout)...).Scan(&count); err != nil {
+		return 0, err
 	}
 
 	return count, nil
 }
 
-func (p *probe) handler(ctx context.Context) http.Handler {
+// healthHandler serves the endpoints that reveal nothing about the sessions,
+// which need no client certificate.
+func (p *probe) healthHandler(ctx context.Context) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+	// The sidecar stays live while PostgreSQL is down, so the health
+	// endpoint only reports the connection state.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]connectionStatus{"postgres": p.connection.status()}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.FromContext(ctx).Error(err, "health response encode error")
+		}
+	})
+	// The readiness endpoint follows PostgreSQL. It is left out of the pod's
+	// probes, since a sidecar that is not ready would keep the whole instance
+	// pod out of the Service endpoints.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := p.ready(r.Context()); err != nil {
+			log.FromContext(ctx).Error(err, "PostgreSQL readiness check error")
+			http.Error(w, "PostgreSQL is not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	if p.metricsHandler != nil {
+		mux.Handle("/metrics", p.metricsHandler)
+	}
+	return mux
+}
+
+func (p *probe) handler(ctx context.Context) http.Handler {
+	mux := p.healthHandler(ctx)
+	mux.HandleFunc("/connections", p.authenticated(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -113,41 +333,130 @@ func (p *probe) handler(ctx context.Context) http.Handler {
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			log.FromContext(ctx).Error(err, "connections response encode error")
 		}
-	})
+	}))
+	mux.HandleFunc("/activity", p.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		report, err := p.currentReport(r.Context())
+		if err != nil {
+			log.FromContext(ctx).Error(err, "PostgreSQL activity check error")
+			http.Error(w, "activity probe failed", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.FromContext(ctx).Error(err, "activity response encode error")
+		}
+	}))
+
+	mux.HandleFunc("/terminate", p.authenticated(p.handleTerminate(ctx)))
 
 	return mux
 }
 
+// authenticated rejects requests without a verified client certificate when
+// the sidecar serves TLS.
+func (p *probe) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.requireClientCertificate && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func serve(ctx context.Context, cfg Config) error {
 	if cfg.ListenAddress == "" {
 		cfg.ListenAddress = defaultListenAddress
 	}
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = defaultSampleInterval
+	}
+	if cfg.Push.Interval <= 0 {
+		cfg.Push.Interval = defaultPushInterval
+	}
 
-	p, err := newProbe(ctx)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	meterProvider, err := pluginmetrics.NewProvider(registry)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := meterProvider.Shutdown(context.WithoutCancel(ctx)); err != nil {
+			log.FromContext(ctx).Error(err, "meter provider shutdown error")
+		}
+	}()
+
+	p, err := newProbe(ctx, cfg, meterProvider.Meter("github.com/xataio/cnpg-i-scale-to-zero/internal/sidecar"))
 	if err != nil {
 		return err
 	}
 	defer p.close(ctx)
+	p.metricsHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	p.requireClientCertificate = cfg.TLSCertDir != ""
+	go p.sample(ctx, cfg.SampleInterval)
+	if cfg.Push.URL != "" {
+		go p.push(ctx, cfg.Push)
+	}
 
 	server := &http.Server{
 		Addr:              cfg.ListenAddress,
 		Handler:           p.handler(ctx),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
+	if cfg.TLSCertDir != "" {
+		server.TLSConfig = mtls.ServerConfig(mtls.NewFiles(cfg.TLSCertDir))
+	}
 
+	group, ctx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		log.FromContext(ctx).Info("starting connections probe", "address", cfg.ListenAddress, "tls", server.TLSConfig != nil)
+		return listenAndServe(ctx, server)
+	})
+	if cfg.HealthListenAddress != "" {
+		healthServer := &http.Server{
+			Addr:              cfg.HealthListenAddress,
+			Handler:           p.healthHandler(ctx),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		group.Go(func() error {
+			log.FromContext(ctx).Info("starting health server", "address", cfg.HealthListenAddress)
+			return listenAndServe(ctx, healthServer)
+		})
+	}
+
+	return group.Wait()
+}
+
+// listenAndServe runs server until the context is done, with TLS when the
+// server has a TLS configuration.
+func listenAndServe(ctx context.Context, server *http.Server) error {
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 		defer cancel()
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.FromContext(ctx).Error(err, "connections probe server stop error")
+			log.FromContext(ctx).Error(err, "connections probe server stop error", "address", server.Addr)
 		}
 	}()
 
-	log.FromContext(ctx).Info("starting connections probe", "address", cfg.ListenAddress)
-	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
-
 	return nil
 }
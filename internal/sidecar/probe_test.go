@@ -2,15 +2,30 @@ package sidecar
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	pluginmetrics "github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/metrics"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+	"k8s.io/utils/ptr"
 )
 
 func TestProbeConnections(t *testing.T) {
@@ -50,10 +65,122 @@ func TestProbeConnections(t *testing.T) {
 	}
 }
 
+func TestProbeActivity(t *testing.T) {
+	t.Parallel()
+
+	older := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	counters := activity.Counters{XactCommit: 10, XactRollback: 2, WALPosition: 4096}
+	instance := activity.Instance{Timeline: 3, SystemIdentifier: "7412345678901234567"}
+	tests := []struct {
+		name        string
+		sessions    []mockSessionGroup
+		maintenance []activity.MaintenanceOperation
+		replication activity.LogicalReplication
+		prepared    int
+		slots       []activity.ReplicationSlot
+		expected    activity.Report
+	}{
+		{
+			name: "grouped sessions",
+			sessions: []mockSessionGroup{
+				{
+					group:       activity.SessionGroup{Database: "app", User: "app", ApplicationName: "api", State: "idle", BackendType: "client backend", Count: 3, LastStateChange: &newer},
+					stateChange: newer,
+				},
+				{
+					group:       activity.SessionGroup{Database: "app", User: "admin", ApplicationName: "psql", State: "active", BackendType: "client backend", Count: 1, LastStateChange: &older},
+					stateChange: older,
+				},
+			},
+			expected: activity.Report{
+				Version:     activity.ReportVersion,
+				Instance:    &instance,
+				Connections: 4,
+				Sessions: []activity.SessionGroup{
+					{Database: "app", User: "app", ApplicationName: "api", State: "idle", BackendType: "client backend", Count: 3, LastStateChange: &newer},
+					{Database: "app", User: "admin", ApplicationName: "psql", State: "active", BackendType: "client backend", Count: 1, LastStateChange: &older},
+				},
+				OldestStateChange: &older,
+				Counters:          &counters,
+			},
+		},
+		{
+			name: "no sessions",
+			expected: activity.Report{
+				Version:  activity.ReportVersion,
+				Instance: &instance,
+				Counters: &counters,
+			},
+		},
+		{
+			name: "maintenance without sessions",
+			maintenance: []activity.MaintenanceOperation{
+				{Kind: activity.MaintenanceAutovacuum, Database: "app", Count: 1},
+				{Kind: activity.MaintenanceBaseBackup, Count: 1},
+			},
+			expected: activity.Report{
+				Version:  activity.ReportVersion,
+				Instance: &instance,
+				Maintenance: []activity.MaintenanceOperation{
+					{Kind: activity.MaintenanceAutovacuum, Database: "app", Count: 1},
+					{Kind: activity.MaintenanceBaseBackup, Count: 1},
+				},
+				Counters: &counters,
+			},
+		},
+		{
+			name:        "logical replication",
+			replication: activity.LogicalReplication{Walsenders: 1, Workers: 2, ApplyingWorkers: 1},
+			expected: activity.Report{
+				Version:            activity.ReportVersion,
+				Instance:           &instance,
+				LogicalReplication: activity.LogicalReplication{Walsenders: 1, Workers: 2, ApplyingWorkers: 1},
+				Counters:           &counters,
+			},
+		},
+		{
+			name:     "external dependencies",
+			prepared: 2,
+			slots:    []activity.ReplicationSlot{{Name: "debezium", Database: "app", Active: true, LagBytes: 128}},
+			expected: activity.Report{
+				Version:              activity.ReportVersion,
+				Instance:             &instance,
+				PreparedTransactions: 2,
+				ReplicationSlots:     []activity.ReplicationSlot{{Name: "debezium", Database: "app", Active: true, LagBytes: 128}},
+				Counters:             &counters,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &probe{
+				sources:   newActivitySources(context.Background(), Config{}, nil),
+				pgQuerier: mockQuerier{sessions: tc.sessions, maintenance: tc.maintenance, replication: tc.replication, prepared: tc.prepared, slots: tc.slots, counters: counters, instance: instance},
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/activity", nil)
+			p.handler(context.Background()).ServeHTTP(recorder, request)
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var response activity.Report
+			require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+			require.False(t, response.GeneratedAt.IsZero())
+			response.GeneratedAt = time.Time{}
+			require.Equal(t, tc.expected, response)
+		})
+	}
+}
+
 func TestProbePostgresErrorReturnsNonOK(t *testing.T) {
 	t.Parallel()
 
 	p := &probe{
+		sources:   newActivitySources(context.Background(), Config{}, nil),
 		pgQuerier: mockQuerier{err: errors.New("query failed")},
 	}
 
@@ -64,6 +191,12 @@ func TestProbePostgresErrorReturnsNonOK(t *testing.T) {
 	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
 	var response int
 	require.Error(t, json.NewDecoder(recorder.Body).Decode(&response))
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/activity", nil)
+	p.handler(context.Background()).ServeHTTP(recorder, request)
+
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
 }
 
 func TestProbeConnectionRefusedReinitializesPool(t *testing.T) {
@@ -84,13 +217,341 @@ func TestProbeConnectionRefusedReinitializesPool(t *testing.T) {
 	require.Equal(t, 2, response)
 }
 
+func TestProbeReconnectBackoff(t *testing.T) {
+	t.Parallel()
+
+	attempts := 0
+	p := &probe{
+		pgQuerier: mockQuerier{err: syscall.ECONNREFUSED},
+		pgQuerierFactory: func(ctx context.Context, url string) (postgres.Querier, error) {
+			attempts++
+			return mockQuerier{err: syscall.ECONNREFUSED}, nil
+		},
+	}
+
+	_, err := p.connections(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+	status := p.connection.status()
+	require.Equal(t, connectionDisconnected, status.State)
+	require.Equal(t, 1, status.ConsecutiveFailures)
+	require.NotNil(t, status.NextReconnect)
+
+	// The next reconnection waits for the backoff.
+	_, err = p.connections(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+
+	p.connection.retryAt = time.Now().Add(-time.Second)
+	p.pgQuerierFactory = func(ctx context.Context, url string) (postgres.Querier, error) {
+		attempts++
+		return mockQuerier{count: 2}, nil
+	}
+	count, err := p.connections(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, connectionStatus{State: connectionConnected}, p.connection.status())
+
+	recorder := httptest.NewRecorder()
+	p.handler(context.Background()).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"postgres":{"state":"connected"}}`, recorder.Body.String())
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, time.Second, reconnectBackoff(1))
+	require.Equal(t, 2*time.Second, reconnectBackoff(2))
+	require.Equal(t, 16*time.Second, reconnectBackoff(5))
+	require.Equal(t, maxReconnectBackoff, reconnectBackoff(6))
+	require.Equal(t, maxReconnectBackoff, reconnectBackoff(100))
+}
+
+func TestProbeHealth(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		path     string
+		querier  mockQuerier
+		expected int
+	}{
+		{
+			name:     "live",
+			path:     "/healthz",
+			querier:  mockQuerier{err: errors.New("connection refused")},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "ready",
+			path:     "/readyz",
+			querier:  mockQuerier{count: 1},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "not ready",
+			path:     "/readyz",
+			querier:  mockQuerier{err: errors.New("no such file or directory")},
+			expected: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &probe{pgQuerier: tc.querier}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			p.handler(context.Background()).ServeHTTP(recorder, request)
+
+			require.Equal(t, tc.expected, recorder.Code)
+		})
+	}
+}
+
+func TestProbeRequiresClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	p := &probe{
+		sources:                  newActivitySources(context.Background(), Config{}, nil),
+		pgQuerier:                mockQuerier{count: 1},
+		requireClientCertificate: true,
+	}
+
+	tests := []struct {
+		path     string
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{path: "/connections", expected: http.StatusUnauthorized},
+		{path: "/activity", tls: &tls.ConnectionState{}, expected: http.StatusUnauthorized},
+		{path: "/connections", tls: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}, expected: http.StatusOK},
+		{path: "/healthz", expected: http.StatusOK},
+		{path: "/readyz", expected: http.StatusOK},
+	}
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		request.TLS = tc.tls
+		p.handler(context.Background()).ServeHTTP(recorder, request)
+
+		require.Equal(t, tc.expected, recorder.Code, tc.path)
+	}
+}
+
+func TestProbeMetrics(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	provider, err := pluginmetrics.NewProvider(registry)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, provider.Shutdown(context.Background()))
+	})
+	metrics, err := newProbeMetrics(provider.Meter("test"), func() *pgxpool.Stat { return nil })
+	require.NoError(t, err)
+
+	p := &probe{
+		sources:   newActivitySources(context.Background(), Config{ActivitySources: []string{SourceCounters}}, nil),
+		pgQuerier: mockQuerier{err: syscall.ECONNREFUSED},
+		pgQuerierFactory: func(ctx context.Context, url string) (postgres.Querier, error) {
+			return mockQuerier{count: 1}, nil
+		},
+		metrics:        metrics,
+		metricsHandler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}
+	require.NoError(t, p.ready(context.Background()))
+	p.pgQuerier = mockQuerier{err: errors.New("query failed")}
+	_, err = p.activity(context.Background())
+	require.Error(t, err)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	p.handler(context.Background()).ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	metricFamilies := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		metricFamilies[family.GetName()] = family
+	}
+
+	durations := metricFamilies["cnpg_scale_to_zero_sidecar_query_duration_seconds"]
+	require.NotNil(t, durations)
+	counts := make(map[string]uint64)
+	for _, current := range durations.Metric {
+		counts[labelValue(current, queryAttribute)] = current.GetHistogram().GetSampleCount()
+	}
+	require.Equal(t, map[string]uint64{queryReadiness: 2, queryInstance: 1}, counts)
+
+	queryErrors := metricFamilies["cnpg_scale_to_zero_sidecar_query_errors_total"]
+	require.NotNil(t, queryErrors)
+	errorCounts := make(map[string]float64)
+	for _, current := range queryErrors.Metric {
+		errorCounts[labelValue(current, queryAttribute)] = current.GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{queryReadiness: 1, queryInstance: 1}, errorCounts)
+
+	reinitializations := metricFamilies["cnpg_scale_to_zero_sidecar_reinitializations_total"]
+	require.NotNil(t, reinitializations)
+	require.Len(t, reinitializations.Metric, 1)
+	require.Equal(t, resultSuccess, labelValue(reinitializations.Metric[0], resultAttribute))
+	require.Equal(t, float64(1), reinitializations.Metric[0].GetCounter().GetValue())
+}
+
+func labelValue(current *dto.Metric, name string) string {
+	for _, label := range current.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
 type mockQuerier struct {
-	count int
-	err   error
+	count       int
+	sessions    []mockSessionGroup
+	counters    activity.Counters
+	terminated  []activity.TerminatedSession
+	maintenance []activity.MaintenanceOperation
+	replication activity.LogicalReplication
+	prepared    int
+	slots       []activity.ReplicationSlot
+	clients     []netip.AddrPort
+	// cronJobs are listed when not nil, as if pg_cron was installed in
+	// cronDatabase, postgres by default.
+	cronJobs     []activity.ScheduledJob
+	cronDatabase string
+	cronTimezone string
+	// lockHolds hold the advisory lock, and tableHolds are listed from the
+	// hold table when not nil, which is missing otherwise.
+	lockHolds  []activity.Hold
+	tableHolds []activity.Hold
+	instance   activity.Instance
+	err        error
 }
 
 func (m mockQuerier) QueryRow(ctx context.Context, query string, args ...any) postgres.Row {
-	return mockRow(m)
+	if strings.Contains(query, "pg_stat_database") {
+		return mockCountersRow{counters: m.counters, err: m.err}
+	}
+	if strings.Contains(query, "pg_prepared_xacts") {
+		return mockRow{count: m.prepared, err: m.err}
+	}
+	if strings.Contains(query, "pg_control_system") {
+		rows := &mockRows{values: [][]any{{m.instance.InRecovery, m.instance.Timeline, m.instance.SystemIdentifier}}}
+		rows.Next()
+		return mockErrRow{row: rows, err: m.err}
+	}
+	if strings.Contains(query, "cron.database_name") {
+		var database *string
+		if m.cronJobs != nil {
+			database = ptr.To("postgres")
+		}
+		if m.cronDatabase != "" {
+			database = ptr.To(m.cronDatabase)
+		}
+		timezone := m.cronTimezone
+		if timezone == "" {
+			timezone = "GMT"
+		}
+		rows := &mockRows{values: [][]any{{database, timezone}}}
+		rows.Next()
+		return mockErrRow{row: rows, err: m.err}
+	}
+	if strings.Contains(query, "COUNT(*) FILTER") {
+		rows := &mockRows{values: [][]any{{m.replication.Walsenders, m.replication.Workers, m.replication.ApplyingWorkers}}}
+		rows.Next()
+		return mockErrRow{row: rows, err: m.err}
+	}
+	return mockRow{count: m.count, err: m.err}
+}
+
+func (m mockQuerier) Query(ctx context.Context, query string, args ...any) (postgres.Rows, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if strings.Contains(query, "pg_terminate_backend") {
+		rows := &mockRows{}
+		for _, session := range m.terminated {
+			rows.values = append(rows.values, []any{
+				session.PID,
+				session.Database,
+				session.User,
+				session.ApplicationName,
+				session.State,
+				session.StateChange,
+			})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "pg_locks") {
+		rows := &mockRows{}
+		for _, hold := range m.lockHolds {
+			rows.values = append(rows.values, []any{hold.Database, hold.Holder})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "scale_to_zero.holds") {
+		if m.tableHolds == nil {
+			return nil, &pgconn.PgError{Code: "42P01"}
+		}
+		rows := &mockRows{}
+		for _, hold := range m.tableHolds {
+			rows.values = append(rows.values, []any{hold.Holder, hold.Reason, hold.ExpiresAt})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "cron.job") {
+		if m.cronJobs == nil {
+			return nil, &pgconn.PgError{Code: "42P01"}
+		}
+		rows := &mockRows{}
+		for _, job := range m.cronJobs {
+			rows.values = append(rows.values, []any{job.ID, job.Name, job.Schedule})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "client_port") {
+		rows := &mockRows{}
+		for _, client := range m.clients {
+			rows.values = append(rows.values, []any{client.Addr().String(), int(client.Port())})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "pg_replication_slots") {
+		rows := &mockRows{}
+		for _, slot := range m.slots {
+			rows.values = append(rows.values, []any{slot.Name, slot.Database, slot.Active, slot.LagBytes})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "pg_stat_progress") {
+		rows := &mockRows{}
+		for _, operation := range m.maintenance {
+			rows.values = append(rows.values, []any{operation.Kind, operation.Database, operation.Count})
+		}
+		return rows, nil
+	}
+	rows := &mockRows{}
+	for _, session := range m.sessions {
+		rows.values = append(rows.values, []any{
+			session.group.Database,
+			session.group.User,
+			session.group.ApplicationName,
+			session.group.State,
+			session.group.BackendType,
+			session.group.Count,
+			&session.stateChange,
+			session.group.LastStateChange,
+		})
+	}
+	return rows, nil
 }
 
 func (m mockQuerier) Close(ctx context.Context) error {
@@ -113,3 +574,134 @@ func (m mockRow) Scan(dest ...any) error {
 	*count = m.count
 	return nil
 }
+
+type mockErrRow struct {
+	row postgres.Row
+	err error
+}
+
+func (m mockErrRow) Scan(dest ...any) error {
+	if m.err != nil {
+		return m.err
+	}
+	return m.row.Scan(dest...)
+}
+
+type mockCountersRow struct {
+	counters activity.Counters
+	err      error
+}
+
+func (m mockCountersRow) Scan(dest ...any) error {
+	if m.err != nil {
+		return m.err
+	}
+	if len(dest) != 3 {
+		return fmt.Errorf("expected 3 destinations, got %d", len(dest))
+	}
+	for i, value := range []int64{m.counters.XactCommit, m.counters.XactRollback, m.counters.WALPosition} {
+		counter, ok := dest[i].(*int64)
+		if !ok {
+			return errors.New("expected *int64")
+		}
+		*counter = value
+	}
+	return nil
+}
+
+type mockSessionGroup struct {
+	group       activity.SessionGroup
+	stateChange time.Time
+}
+
+// mockRows returns one row per entry of values, scanning each value into the
+// destination at the same position.
+type mockRows struct {
+	values  [][]any
+	current int
+}
+
+func (m *mockRows) Next() bool {
+	m.current++
+	return m.current <= len(m.values)
+}
+
+func (m *mockRows) Scan(dest ...any) error {
+	values := m.values[m.current-1]
+	if len(dest) != len(values) {
+		return fmt.Errorf("expected %d destinations, got %d", len(values), len(dest))
+	}
+	for i, value := range values {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func (m *mockRows) Err() error {
+	return nil
+}
+
+func (m *mockRows) Close() {}
+
+func TestActivityTracker(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		reports  []activity.Report
+		expected time.Time
+	}{
+		{
+			name: "idle since start",
+			reports: []activity.Report{
+				{Counters: &activity.Counters{XactCommit: 1}},
+				{Counters: &activity.Counters{XactCommit: 1}},
+			},
+			expected: start,
+		},
+		{
+			name: "open connections",
+			reports: []activity.Report{
+				{Connections: 1},
+				{},
+			},
+			expected: start.Add(time.Second),
+		},
+		{
+			name: "maintenance",
+			reports: []activity.Report{
+				{Maintenance: []activity.MaintenanceOperation{{Kind: activity.MaintenanceVacuum, Database: "app", Count: 1}}},
+				{},
+			},
+			expected: start.Add(time.Second),
+		},
+		{
+			name: "counters advanced",
+			reports: []activity.Report{
+				{Counters: &activity.Counters{XactCommit: 1}},
+				{Counters: &activity.Counters{XactCommit: 2}},
+				{Counters: &activity.Counters{XactCommit: 2}},
+			},
+			expected: start.Add(2 * time.Second),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var tracker activityTracker
+			_, sampling := tracker.observe(start, activity.Report{})
+			require.False(t, sampling)
+
+			tracker.start(start)
+			var lastActive time.Time
+			for i, report := range tc.reports {
+				lastActive, sampling = tracker.observe(start.Add(time.Duration(i+1)*time.Second), report)
+				require.True(t, sampling)
+			}
+			require.Equal(t, tc.expected, lastActive)
+		})
+	}
+}
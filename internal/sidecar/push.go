@@ -0,0 +1,153 @@
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
+)
+
+const (
+	defaultPushInterval = time.Minute
+	// pushTimeout bounds a single push, so a slow plugin does not delay the
+	// next report.
+	pushTimeout = 5 * time.Second
+)
+
+// PushConfig defines where the sidecar pushes its reports and how it
+// identifies itself.
+type PushConfig struct {
+	// URL is the ingestion endpoint of the plugin. When its host resolves to
+	// several addresses, such as a headless Service of a plugin with several
+	// replicas, the report is sent to each of them.
+	URL string
+	// Key signs the reports. It is derived from the plugin secret for the
+	// cluster.
+	Key      []byte
+	Interval time.Duration
+	// Namespace, Cluster and Pod name the instance in the pushed reports.
+	Namespace string
+	Cluster   string
+	Pod       string
+}
+
+// hostResolver resolves the host of the ingestion endpoint, as
+// net.DefaultResolver does.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// push sends a report every interval, starting right away so the plugin does
+// not have to wait for the first one after a restart.
+func (p *probe) push(ctx context.Context, cfg PushConfig) {
+	client := &http.Client{Timeout: pushTimeout}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		envelope := push.Envelope{Namespace: cfg.Namespace, Cluster: cfg.Cluster, Pod: cfg.Pod}
+		report, err := p.currentReport(ctx)
+		if err != nil {
+			// The plugin treats the error like a failed scrape instead of
+			// waiting for the report to be late.
+			log.FromContext(ctx).Error(err, "PostgreSQL activity check error")
+			envelope.Error = err.Error()
+		} else {
+			envelope.Report = report
+		}
+		if err := sendReport(ctx, client, net.DefaultResolver, cfg, envelope); err != nil {
+			log.FromContext(ctx).Error(err, "activity report push error", "url", cfg.URL)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendReport(ctx context.Context, client *http.Client, resolver hostResolver, cfg PushConfig, envelope push.Envelope) error {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil {
+		return err
+	}
+	targets, err := pushTargets(ctx, resolver, endpoint)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, target := range targets {
+		if err := sendReportTo(ctx, client, target, endpoint.Host, cfg.Key, now, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sendReportTo(ctx context.Context, client *http.Client, target, host string, key []byte, now time.Time, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(push.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(push.SignatureHeader, push.Sign(key, now, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("plugin returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pushTargets returns one URL for each address the endpoint host resolves
+// to. Every plugin replica keeps the reports it receives, so the replica
+// that takes over the scraper already has the latest ones.
+func pushTargets(ctx context.Context, resolver hostResolver, endpoint *url.URL) ([]string, error) {
+	host := endpoint.Hostname()
+	if net.ParseIP(host) != nil {
+		return []string{endpoint.String()}, nil
+	}
+	addresses, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve plugin address: %w", err)
+	}
+
+	port := endpoint.Port()
+	if port == "" {
+		port = "80"
+		if endpoint.Scheme == "https" {
+			port = "443"
+		}
+	}
+	targets := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		target := *endpoint
+		target.Host = net.JoinHostPort(address, port)
+		targets = append(targets, target.String())
+	}
+	return targets, nil
+}
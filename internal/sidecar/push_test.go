@@ -0,0 +1,154 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/push"
+)
+
+func TestProbePush(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		querier          mockQuerier
+		expectedCounters *activity.Counters
+		wantErr          bool
+	}{
+		{
+			name:             "report",
+			querier:          mockQuerier{counters: activity.Counters{XactCommit: 3}},
+			expectedCounters: &activity.Counters{XactCommit: 3},
+		},
+		{
+			name:    "collection error",
+			querier: mockQuerier{err: errors.New("query failed")},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			key := push.Key([]byte("secret"), "default", "cluster")
+			envelopes := make(chan push.Envelope, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				if _, err := push.Verify(key, r.Header.Get(push.TimestampHeader), r.Header.Get(push.SignatureHeader), body, time.Now(), time.Minute); err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				var envelope push.Envelope
+				require.NoError(t, json.Unmarshal(body, &envelope))
+				select {
+				case envelopes <- envelope:
+				default:
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			t.Cleanup(server.Close)
+
+			p := &probe{
+				sources:   newActivitySources(context.Background(), Config{ActivitySources: []string{SourceCounters}}, nil),
+				pgQuerier: tc.querier,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			go p.push(ctx, PushConfig{
+				URL:       server.URL + push.Path,
+				Key:       key,
+				Interval:  time.Hour,
+				Namespace: "default",
+				Cluster:   "cluster",
+				Pod:       "cluster-1",
+			})
+
+			envelope := <-envelopes
+			require.Equal(t, "default", envelope.Namespace)
+			require.Equal(t, "cluster", envelope.Cluster)
+			require.Equal(t, "cluster-1", envelope.Pod)
+			if tc.wantErr {
+				require.NotEmpty(t, envelope.Error)
+				return
+			}
+			require.Empty(t, envelope.Error)
+			require.Equal(t, tc.expectedCounters, envelope.Report.Counters)
+			require.False(t, envelope.Report.GeneratedAt.IsZero())
+		})
+	}
+}
+
+func TestPushTargets(t *testing.T) {
+	t.Parallel()
+
+	resolver := fakeResolver{"scale-to-zero-reports.cnpg-system.svc": {"10.0.0.1", "fd00::1"}}
+
+	tests := []struct {
+		name     string
+		url      string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "address",
+			url:      "http://10.0.0.9:9190/reports",
+			expected: []string{"http://10.0.0.9:9190/reports"},
+		},
+		{
+			name:     "host name",
+			url:      "http://scale-to-zero-reports.cnpg-system.svc:9190/reports",
+			expected: []string{"http://10.0.0.1:9190/reports", "http://[fd00::1]:9190/reports"},
+		},
+		{
+			name:     "default port",
+			url:      "https://scale-to-zero-reports.cnpg-system.svc/reports",
+			expected: []string{"https://10.0.0.1:443/reports", "https://[fd00::1]:443/reports"},
+		},
+		{
+			name:    "unresolved host",
+			url:     "http://unknown.cnpg-system.svc:9190/reports",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			endpoint, err := url.Parse(tc.url)
+			require.NoError(t, err)
+			targets, err := pushTargets(context.Background(), resolver, endpoint)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, targets)
+		})
+	}
+}
+
+// fakeResolver resolves the host names it holds, and no other.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addresses, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,78 @@
+package sidecar
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+const defaultSampleInterval = 5 * time.Second
+
+// activityTracker keeps the time activity was last seen across samples. The
+// timestamp is only meaningful while the sampler runs, because it is what
+// covers the time between two scrapes.
+type activityTracker struct {
+	mu         sync.Mutex
+	started    bool
+	lastActive time.Time
+	counters   *activity.Counters
+}
+
+// start marks the beginning of sampling. Nothing is known about the time
+// before, so it counts as activity.
+func (t *activityTracker) start(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = true
+	t.lastActive = now
+}
+
+// observe records a successful sample. It returns the updated timestamp and
+// whether the sampler is running.
+func (t *activityTracker) observe(now time.Time, report activity.Report) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	advanced := report.Counters != nil && t.counters != nil && report.Counters.AdvancedSince(*t.counters)
+	if report.Active() || report.CustomQueryActive() || report.SocketsActive() || report.Held() || report.InMaintenance() || advanced {
+		t.lastActive = now
+	}
+	if report.Counters != nil {
+		counters := *report.Counters
+		t.counters = &counters
+	}
+	return t.lastActive, t.started
+}
+
+// markUnknown treats a failed sample as activity, because nothing can be said
+// about the sessions that ran while PostgreSQL could not be queried.
+func (t *activityTracker) markUnknown(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastActive = now
+}
+
+func (p *probe) sample(ctx context.Context, interval time.Duration) {
+	p.tracker.start(time.Now())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := p.activity(ctx)
+			if err != nil {
+				log.FromContext(ctx).Debug("activity sample failed", "error", err.Error())
+				p.tracker.markUnknown(time.Now())
+				continue
+			}
+			p.tracker.observe(time.Now(), report)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	// The sidecar image has no time zone database, and pg_cron schedules
+	// follow cron.timezone.
+	_ "time/tzdata"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/cron"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// unreadableScheduledJob stands for the jobs of a pg_cron installation whose
+// cron.job table cannot be read. Its next run is unknown, so it is due.
+var unreadableScheduledJob = activity.ScheduledJob{Name: "cron.job unreadable"}
+
+// scheduledJobsSource lists the active pg_cron jobs with their next run. The
+// cron.job table only exists in the database named by cron.database_name,
+// which pg_cron defines once it is loaded. Outside the probe's postgres
+// database, the table is read on its own connection, created on first use,
+// at most every ownStatementInterval. Nothing is reported when pg_cron is not
+// loaded or its extension was not created, and a table that cannot be read is
+// reported as a due job rather than risking a missed run. Jobs that can never
+// run again, such as @reboot ones, are left out because hibernation cannot
+// make them miss a run.
+type scheduledJobsSource struct {
+	now     func() time.Time
+	connect querierFactory
+	own     *ownTransactions
+	// database is the cron database querier is connected to, read is when
+	// its jobs were last read, and jobs what it listed.
+	database string
+	querier  postgres.Querier
+	read     time.Time
+	jobs     []activity.ScheduledJob
+}
+
+func (*scheduledJobsSource) Name() string {
+	return SourceScheduledJobs
+}
+
+func (s *scheduledJobsSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const settingsQuery = `SELECT current_setting('cron.database_name', true), COALESCE(current_setting('cron.timezone', true), 'GMT');`
+
+	var (
+		database *string
+		timezone string
+	)
+	if err := querier.QueryRow(ctx, settingsQuery).Scan(&database, &timezone); err != nil {
+		return err
+	}
+	if database == nil || *database == "" {
+		return nil
+	}
+
+	jobs, err := s.cronJobs(ctx, querier, *database)
+	if err != nil && *database == "postgres" && postgres.IsConnectionError(err) {
+		// The probe replaces its connection when a source fails with a
+		// connection error.
+		return err
+	}
+	if err != nil {
+		log.FromContext(ctx).Info("cannot read pg_cron jobs, considering one due", "database", *database, "error", err.Error())
+		report.ScheduledJobs = append(report.ScheduledJobs, unreadableScheduledJob)
+		return nil
+	}
+	// An unknown time zone makes every next run unknown, which keeps the
+	// cluster awake rather than risking a missed job.
+	location, locationErr := time.LoadLocation(timezone)
+
+	now := s.now()
+	for _, job := range jobs {
+		schedule, err := cron.Parse(job.Schedule)
+		if err == nil && locationErr == nil {
+			next, err := schedule.Next(now, location)
+			if errors.Is(err, cron.ErrNoRun) {
+				continue
+			}
+			job.NextRun = &next
+		}
+		report.ScheduledJobs = append(report.ScheduledJobs, job)
+	}
+	return nil
+}
+
+// cronJobs reads the active jobs from cron.job in database, on the probe's
+// querier when it is the postgres database and on the source's connection
+// otherwise. A missing table lists no jobs.
+func (s *scheduledJobsSource) cronJobs(ctx context.Context, querier postgres.Querier, database string) ([]activity.ScheduledJob, error) {
+	if database == "postgres" {
+		jobs, err := activeCronJobs(ctx, querier)
+		if postgres.IsUndefinedTable(err) {
+			return nil, nil
+		}
+		return jobs, err
+	}
+
+	if database != s.database {
+		_ = s.Close(ctx)
+		s.database, s.querier, s.read, s.jobs = database, nil, time.Time{}, nil
+	}
+	if !s.read.IsZero() && !s.own.due(s.read) {
+		return s.jobs, nil
+	}
+	if s.querier == nil {
+		querier, err := s.connect(ctx, readOnlyConnString(database, defaultActivityQueryTimeout))
+		if err != nil {
+			return nil, fmt.Errorf("connect cron database %q: %w", database, err)
+		}
+		s.querier = querier
+	}
+
+	jobs, err := activeCronJobs(ctx, s.querier)
+	s.own.record(database, err)
+	if err != nil && !postgres.IsUndefinedTable(err) {
+		// The connection is replaced on the next collection, in case it is
+		// the reason for the failure.
+		_ = s.querier.Close(ctx)
+		s.querier = nil
+		return nil, err
+	}
+	s.read = s.own.now()
+	s.jobs = jobs
+	return jobs, nil
+}
+
+// Close closes the cron database connection.
+func (s *scheduledJobsSource) Close(ctx context.Context) error {
+	if s.querier == nil {
+		return nil
+	}
+	return s.querier.Close(ctx)
+}
+
+// activeCronJobs lists the active jobs of cron.job in a single statement.
+func activeCronJobs(ctx context.Context, querier postgres.Querier) ([]activity.ScheduledJob, error) {
+	const query = `SELECT jobid, COALESCE(jobname, ''), schedule FROM cron.job WHERE active ORDER BY jobid;`
+
+	rows, err := querier.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []activity.ScheduledJob
+	for rows.Next() {
+		var job activity.ScheduledJob
+		if err := rows.Scan(&job.ID, &job.Name, &job.Schedule); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,164 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+func TestScheduledJobsSource(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		querier     mockQuerier
+		cronQuerier mockQuerier
+		connectErr  error
+		expected    []activity.ScheduledJob
+	}{
+		{
+			name: "pg_cron not installed",
+		},
+		{
+			name:    "no jobs",
+			querier: mockQuerier{cronJobs: []activity.ScheduledJob{}},
+		},
+		{
+			name: "next runs",
+			querier: mockQuerier{cronJobs: []activity.ScheduledJob{
+				{ID: 1, Name: "vacuum", Schedule: "0 3 * * *"},
+				{ID: 2, Schedule: "*/5 * * * *"},
+			}},
+			expected: []activity.ScheduledJob{
+				{ID: 1, Name: "vacuum", Schedule: "0 3 * * *", NextRun: ptr.To(time.Date(2025, 1, 16, 3, 0, 0, 0, time.UTC))},
+				{ID: 2, Schedule: "*/5 * * * *", NextRun: ptr.To(time.Date(2025, 1, 15, 10, 25, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name: "cron time zone",
+			querier: mockQuerier{cronTimezone: "Europe/Berlin", cronJobs: []activity.ScheduledJob{
+				{ID: 1, Schedule: "0 3 * * *"},
+			}},
+			expected: []activity.ScheduledJob{
+				{ID: 1, Schedule: "0 3 * * *", NextRun: ptr.To(time.Date(2025, 1, 16, 2, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name: "unknown time zone",
+			querier: mockQuerier{cronTimezone: "Mars/Olympus", cronJobs: []activity.ScheduledJob{
+				{ID: 1, Schedule: "0 3 * * *"},
+			}},
+			expected: []activity.ScheduledJob{{ID: 1, Schedule: "0 3 * * *"}},
+		},
+		{
+			name: "jobs that never run again are left out",
+			querier: mockQuerier{cronJobs: []activity.ScheduledJob{
+				{ID: 1, Schedule: "@reboot"},
+				{ID: 2, Schedule: "0 0 30 2 *"},
+				{ID: 3, Schedule: "every tuesday"},
+			}},
+			expected: []activity.ScheduledJob{{ID: 3, Schedule: "every tuesday"}},
+		},
+		{
+			name:    "cron database",
+			querier: mockQuerier{cronDatabase: "app"},
+			cronQuerier: mockQuerier{cronJobs: []activity.ScheduledJob{
+				{ID: 1, Name: "vacuum", Schedule: "0 3 * * *"},
+			}},
+			expected: []activity.ScheduledJob{
+				{ID: 1, Name: "vacuum", Schedule: "0 3 * * *", NextRun: ptr.To(time.Date(2025, 1, 16, 3, 0, 0, 0, time.UTC))},
+			},
+		},
+		{
+			name:    "extension not created in the cron database",
+			querier: mockQuerier{cronDatabase: "app"},
+		},
+		{
+			name:        "unreadable jobs are due",
+			querier:     mockQuerier{cronDatabase: "app"},
+			cronQuerier: mockQuerier{cronJobs: []activity.ScheduledJob{}, err: errors.New("permission denied")},
+			expected:    []activity.ScheduledJob{unreadableScheduledJob},
+		},
+		{
+			name:       "unreachable cron database",
+			querier:    mockQuerier{cronDatabase: "app"},
+			connectErr: errors.New("database does not exist"),
+			expected:   []activity.ScheduledJob{unreadableScheduledJob},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var connString string
+			source := &scheduledJobsSource{
+				now: func() time.Time { return now },
+				connect: func(_ context.Context, url string) (postgres.Querier, error) {
+					connString = url
+					return tc.cronQuerier, tc.connectErr
+				},
+				own: newOwnTransactions(),
+			}
+			var report activity.Report
+			require.NoError(t, source.Collect(context.Background(), tc.querier, &report))
+			for i := range report.ScheduledJobs {
+				if next := report.ScheduledJobs[i].NextRun; next != nil {
+					report.ScheduledJobs[i].NextRun = ptr.To(next.UTC())
+				}
+			}
+			require.Equal(t, tc.expected, report.ScheduledJobs)
+			if tc.querier.cronDatabase != "" {
+				require.Contains(t, connString, "dbname='app'")
+			} else {
+				require.Empty(t, connString)
+			}
+		})
+	}
+}
+
+func TestScheduledJobsSourceSpacesCronDatabaseReads(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)
+	own := newOwnTransactions()
+	own.now = func() time.Time { return now }
+	reads := 0
+	source := &scheduledJobsSource{
+		now: func() time.Time { return now },
+		connect: func(context.Context, string) (postgres.Querier, error) {
+			return committingQuerier{
+				Querier:   mockQuerier{cronJobs: []activity.ScheduledJob{{ID: 1, Schedule: "*/5 * * * *"}}},
+				committed: func() { reads++ },
+			}, nil
+		},
+		own: own,
+	}
+
+	for _, sample := range []struct {
+		at      time.Duration
+		nextRun time.Time
+	}{
+		{nextRun: time.Date(2025, 1, 15, 10, 25, 0, 0, time.UTC)},
+		{at: time.Second, nextRun: time.Date(2025, 1, 15, 10, 25, 0, 0, time.UTC)},
+		{at: 6 * time.Minute, nextRun: time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)},
+	} {
+		now = time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC).Add(sample.at)
+		var report activity.Report
+		require.NoError(t, source.Collect(context.Background(), mockQuerier{cronDatabase: "app"}, &report))
+		require.Len(t, report.ScheduledJobs, 1)
+		require.Equal(t, sample.nextRun, report.ScheduledJobs[0].NextRun.UTC())
+	}
+	require.Equal(t, 2, reads)
+
+	counters, _ := own.settled()
+	require.Equal(t, activity.Counters{XactCommit: 2}, counters)
+}
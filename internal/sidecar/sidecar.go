@@ -2,10 +2,13 @@ package sidecar
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 
 	"github.com/cloudnative-pg/machinery/pkg/log"
 	"github.com/spf13/viper"
 
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 	"github.com/xataio/cnpg-i-scale-to-zero/pkg/metadata"
 )
 
@@ -14,10 +17,52 @@ func Start(ctx context.Context) error {
 	setupLog := log.FromContext(ctx)
 
 	listenAddress := viper.GetString("listen-address")
+	sampleInterval := viper.GetDuration("sample-interval")
+	exclusions := activity.Exclusions{
+		Users:            activity.ParseList(viper.GetString("exclude-users")),
+		Databases:        activity.ParseList(viper.GetString("exclude-databases")),
+		ApplicationNames: activity.ParseList(viper.GetString("exclude-application-names")),
+		ClientCIDRs:      activity.ParseList(viper.GetString("exclude-client-cidrs")),
+		BackendTypes:     activity.ParseList(viper.GetString("exclude-backend-types")),
+	}
+	idleSessionTimeout := viper.GetDuration("idle-session-timeout")
+	activityQuery := ActivityQuery{
+		Name:     viper.GetString("activity-query-name"),
+		SQL:      viper.GetString("activity-query"),
+		Database: viper.GetString("activity-query-database"),
+		Timeout:  viper.GetDuration("activity-query-timeout"),
+		User:     viper.GetString("application-user"),
+		Password: viper.GetString("application-password"),
+	}
+	activitySources := activity.ParseList(viper.GetString("activity-sources"))
+	pushKey, err := hex.DecodeString(viper.GetString("push-key"))
+	if err != nil {
+		return fmt.Errorf("decode push key: %w", err)
+	}
 
 	setupLog.Info("starting scale to zero sidecar", "version", metadata.Data.Version)
 
 	return serve(ctx, Config{
-		ListenAddress: listenAddress,
+		ListenAddress:       listenAddress,
+		SampleInterval:      sampleInterval,
+		Exclusions:          exclusions,
+		IdleSessionTimeout:  idleSessionTimeout,
+		TerminateIdleAfter:  viper.GetDuration("terminate-idle-after"),
+		ActivityQuery:       activityQuery,
+		ActivitySources:     activitySources,
+		PostgresPort:        viper.GetInt("postgres-port"),
+		HoldDatabase:        viper.GetString("hold-database"),
+		ApplicationUser:     viper.GetString("application-user"),
+		ApplicationPassword: viper.GetString("application-password"),
+		TLSCertDir:          viper.GetString("tls-cert-dir"),
+		HealthListenAddress: viper.GetString("health-listen-address"),
+		Push: PushConfig{
+			URL:       viper.GetString("push-url"),
+			Key:       pushKey,
+			Interval:  viper.GetDuration("push-interval"),
+			Namespace: viper.GetString("pod-namespace"),
+			Cluster:   viper.GetString("cluster-name"),
+			Pod:       viper.GetString("pod-name"),
+		},
 	})
 }
@@ -0,0 +1,145 @@
+//go:build linux
+
+package sidecar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// Layout of the sock_diag netlink messages, from linux/sock_diag.h,
+// linux/inet_diag.h and linux/tcp.h.
+const (
+	// sockDiagByFamily is SOCK_DIAG_BY_FAMILY.
+	sockDiagByFamily = 20
+	// inetDiagInfo is INET_DIAG_INFO, the attribute carrying struct tcp_info.
+	inetDiagInfo = 2
+	// inetDiagReqV2Size and inetDiagMsgSize are the sizes of struct
+	// inet_diag_req_v2 and struct inet_diag_msg.
+	inetDiagReqV2Size = 56
+	inetDiagMsgSize   = 72
+	// The tcpi_bytes_acked and tcpi_bytes_received fields of struct tcp_info,
+	// available since Linux 4.1.
+	tcpInfoBytesAcked    = 120
+	tcpInfoBytesReceived = 128
+)
+
+// readTCPBytes returns the bytes received and acknowledged so far on the
+// established TCP sockets on port, keyed by remote address. The kernel keeps
+// these counters in tcp_info, which it only exposes through the sock_diag
+// netlink interface.
+func readTCPBytes(port uint16) (map[netip.AddrPort]int64, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	counters := make(map[netip.AddrPort]int64)
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		if err := dumpTCPBytes(fd, family, port, counters); err != nil {
+			return nil, err
+		}
+	}
+	return counters, nil
+}
+
+// dumpTCPBytes requests the established TCP sockets of family with their
+// tcp_info, and adds the counters of those on port.
+func dumpTCPBytes(fd int, family uint8, port uint16, counters map[netip.AddrPort]int64) error {
+	request := make([]byte, syscall.NLMSG_HDRLEN+inetDiagReqV2Size)
+	binary.NativeEndian.PutUint32(request[0:4], uint32(len(request)))
+	binary.NativeEndian.PutUint16(request[4:6], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(request[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(request[8:12], uint32(family))
+	payload := request[syscall.NLMSG_HDRLEN:]
+	payload[0] = family
+	payload[1] = syscall.IPPROTO_TCP
+	payload[2] = 1 << (inetDiagInfo - 1)
+	binary.NativeEndian.PutUint32(payload[4:8], 1<<tcpEstablished)
+
+	if err := syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("parse sock_diag response: %w", err)
+		}
+		for _, message := range messages {
+			switch message.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return errors.New("truncated sock_diag error")
+				}
+				errno := syscall.Errno(-int32(binary.NativeEndian.Uint32(message.Data[0:4])))
+				if errno == syscall.ENOENT && family == syscall.AF_INET6 {
+					// IPv6 is disabled.
+					return nil
+				}
+				return os.NewSyscallError("sock_diag", errno)
+			case sockDiagByFamily:
+				remote, bytes, ok := parseInetDiagMsg(message.Data, port)
+				if ok {
+					counters[remote] = bytes
+				}
+			}
+		}
+	}
+}
+
+// parseInetDiagMsg reads the remote address of a socket on port and the
+// bytes it received and had acknowledged. Sockets on other ports, and kernels
+// without the counters, are skipped.
+func parseInetDiagMsg(data []byte, port uint16) (netip.AddrPort, int64, bool) {
+	if len(data) < inetDiagMsgSize {
+		return netip.AddrPort{}, 0, false
+	}
+	// struct inet_diag_sockid starts at offset 4 with the source and
+	// destination ports and addresses, in network byte order.
+	if binary.BigEndian.Uint16(data[4:6]) != port {
+		return netip.AddrPort{}, 0, false
+	}
+	remotePort := binary.BigEndian.Uint16(data[6:8])
+	var remote netip.Addr
+	if data[0] == syscall.AF_INET {
+		remote = netip.AddrFrom4([4]byte(data[24:28]))
+	} else {
+		remote = netip.AddrFrom16([16]byte(data[24:40])).Unmap()
+	}
+
+	attributes := data[inetDiagMsgSize:]
+	for len(attributes) >= syscall.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(attributes[0:2]))
+		kind := binary.NativeEndian.Uint16(attributes[2:4])
+		if length < syscall.SizeofRtAttr || length > len(attributes) {
+			break
+		}
+		if kind == inetDiagInfo {
+			info := attributes[syscall.SizeofRtAttr:length]
+			if len(info) < tcpInfoBytesReceived+8 {
+				break
+			}
+			bytes := binary.NativeEndian.Uint64(info[tcpInfoBytesAcked:]) + binary.NativeEndian.Uint64(info[tcpInfoBytesReceived:])
+			return netip.AddrPortFrom(remote, remotePort), int64(bytes), true
+		}
+		aligned := (length + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if aligned > len(attributes) {
+			break
+		}
+		attributes = attributes[aligned:]
+	}
+	return netip.AddrPort{}, 0, false
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package sidecar
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTCPBytes(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	_, err = client.Write(make([]byte, 100))
+	require.NoError(t, err)
+	_, err = io.ReadFull(server, make([]byte, 100))
+	require.NoError(t, err)
+	_, err = server.Write(make([]byte, 20))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 20))
+	require.NoError(t, err)
+
+	counters, err := readTCPBytes(port)
+	require.NoError(t, err)
+	remote := netip.MustParseAddrPort(client.LocalAddr().String())
+	require.Contains(t, counters, remote)
+	require.Equal(t, int64(120), counters[remote])
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sidecar
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// readTCPBytes is only implemented on Linux, where the sidecar runs.
+func readTCPBytes(uint16) (map[netip.AddrPort]int64, error) {
+	return nil, errors.New("socket byte counters are only available on Linux")
+}
@@ -0,0 +1,234 @@
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+const (
+	defaultProcNetDir   = "/proc/net"
+	defaultPostgresPort = 5432
+	// tcpEstablished is TCP_ESTABLISHED in the st column of /proc/net/tcp.
+	tcpEstablished = 0x01
+)
+
+// socketsSource inspects the TCP sockets of the pod network namespace, which
+// the sidecar shares with PostgreSQL. Connections in the TLS or authentication
+// handshake have a socket but no pg_stat_activity entry yet, so they are only
+// visible here. /proc/net/tcp has no cumulative byte counters, so the bytes
+// each connection received and had acknowledged are read with readBytes and
+// reported as the difference to the previous collection.
+type socketsSource struct {
+	procNetDir string
+	port       uint16
+	readBytes  func(port uint16) (map[netip.AddrPort]int64, error)
+	// previous holds the byte counters of the previous collection, keyed by
+	// remote address.
+	previous map[netip.AddrPort]int64
+}
+
+func newSocketsSource(port int) *socketsSource {
+	if port <= 0 || port > 0xffff {
+		port = defaultPostgresPort
+	}
+	return &socketsSource{procNetDir: defaultProcNetDir, port: uint16(port), readBytes: readTCPBytes}
+}
+
+func (*socketsSource) Name() string {
+	return SourceSockets
+}
+
+func (s *socketsSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	// Sockets are listed before the sessions, so a session that starts in
+	// between is matched rather than counted as unattached.
+	sockets, err := s.inboundSockets()
+	if err != nil {
+		return err
+	}
+	totals, err := s.readBytes(s.port)
+	if err != nil {
+		return fmt.Errorf("read socket byte counters: %w", err)
+	}
+	backends, err := clientBackends(ctx, querier)
+	if err != nil {
+		return err
+	}
+
+	result := &activity.SocketActivity{Established: len(sockets)}
+	peers := make(map[netip.Addr]struct{})
+	for _, socket := range sockets {
+		peers[socket.remote.Addr()] = struct{}{}
+		seen := bytesSeen(totals, s.previous, socket.remote)
+		result.BytesSeen += seen
+		if _, attached := backends[socket.remote]; !attached {
+			result.Unattached++
+			result.UnattachedBytesSeen += seen
+		}
+	}
+	result.Peers = len(peers)
+	s.previous = totals
+	report.Sockets = result
+	return nil
+}
+
+// bytesSeen returns the bytes a connection moved since the previous
+// collection. A connection that was not seen then, or whose counters went
+// back because its address was reused, counts from its start.
+func bytesSeen(totals, previous map[netip.AddrPort]int64, remote netip.AddrPort) int64 {
+	total := totals[remote]
+	if before, seen := previous[remote]; seen && before <= total {
+		return total - before
+	}
+	return total
+}
+
+type tcpSocket struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+	state  int
+}
+
+// inboundSockets lists the established sockets on the PostgreSQL port from
+// /proc/net/tcp and /proc/net/tcp6. The latter is missing when IPv6 is
+// disabled.
+func (s *socketsSource) inboundSockets() ([]tcpSocket, error) {
+	var inbound []tcpSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		sockets, err := readTCPSockets(filepath.Join(s.procNetDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, socket := range sockets {
+			if socket.state == tcpEstablished && socket.local.Port() == s.port {
+				inbound = append(inbound, socket)
+			}
+		}
+	}
+	return inbound, nil
+}
+
+// clientBackends returns the client address and port of every backend,
+// regardless of the session exclusions, which only decide whether a session
+// counts as activity.
+func clientBackends(ctx context.Context, querier postgres.Querier) (map[netip.AddrPort]struct{}, error) {
+	const query = `SELECT host(client_addr), client_port FROM pg_stat_activity WHERE client_port > 0;`
+
+	rows, err := querier.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backends := make(map[netip.AddrPort]struct{})
+	for rows.Next() {
+		var (
+			host string
+			port int
+		)
+		if err := rows.Scan(&host, &port); err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		backends[netip.AddrPortFrom(addr.Unmap(), uint16(port))] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return backends, nil
+}
+
+// readTCPSockets parses a /proc/net/tcp or /proc/net/tcp6 file.
+func readTCPSockets(path string) ([]tcpSocket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sockets []tcpSocket
+	scanner := bufio.NewScanner(file)
+	// The first line is the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		socket, err := parseTCPSocket(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		sockets = append(sockets, socket)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return sockets, nil
+}
+
+// parseTCPSocket parses a line such as
+//
+//	0: 0100007F:1538 0100007F:D2A4 01 00000000:00000010 00:00000000 00000000 26 0 12345 ...
+//
+// with the local and remote addresses and the state.
+func parseTCPSocket(line string) (tcpSocket, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return tcpSocket{}, fmt.Errorf("unexpected socket line %q", line)
+	}
+
+	local, err := parseProcAddrPort(fields[1])
+	if err != nil {
+		return tcpSocket{}, err
+	}
+	remote, err := parseProcAddrPort(fields[2])
+	if err != nil {
+		return tcpSocket{}, err
+	}
+	state, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return tcpSocket{}, fmt.Errorf("invalid socket state %q: %w", fields[3], err)
+	}
+
+	return tcpSocket{local: local, remote: remote, state: int(state)}, nil
+}
+
+// parseProcAddrPort parses an address in the kernel's notation: the address
+// as 32-bit words in host byte order, which is little endian on the platforms
+// the sidecar is built for, followed by the port.
+func parseProcAddrPort(value string) (netip.AddrPort, error) {
+	address, portValue, found := strings.Cut(value, ":")
+	if !found {
+		return netip.AddrPort{}, fmt.Errorf("invalid socket address %q", value)
+	}
+	raw, err := hex.DecodeString(address)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid socket address %q", value)
+	}
+	for word := 0; word < len(raw); word += 4 {
+		raw[word], raw[word+1], raw[word+2], raw[word+3] = raw[word+3], raw[word+2], raw[word+1], raw[word]
+	}
+	port, err := strconv.ParseUint(portValue, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid socket port %q: %w", value, err)
+	}
+
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
@@ -0,0 +1,171 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000    26        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0200000A:1538 0300000A:D2A4 01 00000000:00000000 00:00000000 00000000    26        0 1002 1 0000000000000000 20 4 30 10 -1
+   2: 0200000A:1538 0300000A:D2A6 01 00000000:00000200 00:00000000 00000000    26        0 1003 1 0000000000000000 20 4 30 10 -1
+   3: 0200000A:1538 0400000A:E001 06 00000000:00000000 00:00000000 00000000     0        0 0 3 0000000000000000
+   4: 0200000A:23D4 0500000A:C000 01 00000000:00000000 00:00000000 00000000    26        0 1004 1 0000000000000000 20 4 30 10 -1
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:1538 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000    26        0 2001 1 0000000000000000 100 0 0 10 0
+   1: 0000000000000000FFFF00000200000A:1538 0000000000000000FFFF00000600000A:C350 01 00000010:00000000 00:00000000 00000000    26        0 2002 1 0000000000000000 20 4 30 10 -1
+   2: B80D0120000000000000000001000000:1538 B80D0120000000000000000002000000:C351 01 00000000:00000000 00:00000000 00000000    26        0 2003 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestSocketsSource(t *testing.T) {
+	t.Parallel()
+
+	bytes := map[netip.AddrPort]int64{
+		netip.MustParseAddrPort("10.0.0.3:53924"):      100,
+		netip.MustParseAddrPort("10.0.0.3:53926"):      0x200,
+		netip.MustParseAddrPort("10.0.0.6:50000"):      0x10,
+		netip.MustParseAddrPort("[2001:db8::2]:50001"): 50,
+		netip.MustParseAddrPort("10.0.0.5:49152"):      1000,
+	}
+	tests := []struct {
+		name     string
+		files    map[string]string
+		clients  []netip.AddrPort
+		expected *activity.SocketActivity
+	}{
+		{
+			name:  "all attached",
+			files: map[string]string{"tcp": procNetTCP, "tcp6": procNetTCP6},
+			clients: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.3:53924"),
+				netip.MustParseAddrPort("10.0.0.3:53926"),
+				netip.MustParseAddrPort("10.0.0.6:50000"),
+				netip.MustParseAddrPort("[2001:db8::2]:50001"),
+			},
+			expected: &activity.SocketActivity{Established: 4, Peers: 3, BytesSeen: 0x2a6},
+		},
+		{
+			name:  "handshakes",
+			files: map[string]string{"tcp": procNetTCP, "tcp6": procNetTCP6},
+			clients: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.3:53924"),
+				netip.MustParseAddrPort("[2001:db8::2]:50001"),
+			},
+			expected: &activity.SocketActivity{Established: 4, Peers: 3, Unattached: 2, BytesSeen: 0x2a6, UnattachedBytesSeen: 0x210},
+		},
+		{
+			name:     "IPv6 disabled",
+			files:    map[string]string{"tcp": procNetTCP},
+			expected: &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 2, BytesSeen: 0x264, UnattachedBytesSeen: 0x264},
+		},
+		{
+			name:     "no sockets",
+			files:    map[string]string{"tcp": procNetTCP[:strings.Index(procNetTCP, "\n")+1]},
+			expected: &activity.SocketActivity{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+			}
+			source := newSocketsSource(5432)
+			source.procNetDir = dir
+			source.readBytes = func(port uint16) (map[netip.AddrPort]int64, error) {
+				require.Equal(t, uint16(5432), port)
+				return bytes, nil
+			}
+
+			var report activity.Report
+			require.NoError(t, source.Collect(context.Background(), mockQuerier{clients: tc.clients}, &report))
+			require.Equal(t, tc.expected, report.Sockets)
+		})
+	}
+}
+
+func TestSocketsSourceBytesSeen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tcp"), []byte(procNetTCP), 0o600))
+	attached := netip.MustParseAddrPort("10.0.0.3:53924")
+	handshake := netip.MustParseAddrPort("10.0.0.3:53926")
+
+	source := newSocketsSource(5432)
+	source.procNetDir = dir
+	samples := []struct {
+		name     string
+		bytes    map[netip.AddrPort]int64
+		expected *activity.SocketActivity
+	}{
+		{
+			name:     "first collection counts from the start",
+			bytes:    map[netip.AddrPort]int64{attached: 1000, handshake: 300},
+			expected: &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 1, BytesSeen: 1300, UnattachedBytesSeen: 300},
+		},
+		{
+			name:     "idle",
+			bytes:    map[netip.AddrPort]int64{attached: 1000, handshake: 300},
+			expected: &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 1},
+		},
+		{
+			name:     "handshake progress",
+			bytes:    map[netip.AddrPort]int64{attached: 1200, handshake: 350},
+			expected: &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 1, BytesSeen: 250, UnattachedBytesSeen: 50},
+		},
+		{
+			name:     "reused address",
+			bytes:    map[netip.AddrPort]int64{attached: 1200, handshake: 20},
+			expected: &activity.SocketActivity{Established: 2, Peers: 1, Unattached: 1, BytesSeen: 20, UnattachedBytesSeen: 20},
+		},
+	}
+	for _, sample := range samples {
+		source.readBytes = func(uint16) (map[netip.AddrPort]int64, error) { return sample.bytes, nil }
+		var report activity.Report
+		require.NoError(t, source.Collect(context.Background(), mockQuerier{clients: []netip.AddrPort{attached}}, &report), sample.name)
+		require.Equal(t, sample.expected, report.Sockets, sample.name)
+	}
+}
+
+func TestSocketsSourceByteCountersError(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tcp"), []byte(procNetTCP), 0o600))
+	source := newSocketsSource(5432)
+	source.procNetDir = dir
+	source.readBytes = func(uint16) (map[netip.AddrPort]int64, error) { return nil, errors.New("permission denied") }
+
+	var report activity.Report
+	require.Error(t, source.Collect(context.Background(), mockQuerier{}, &report))
+	require.Nil(t, report.Sockets)
+}
+
+func TestParseTCPSocketRejectsMalformedLines(t *testing.T) {
+	t.Parallel()
+
+	for _, line := range []string{
+		"0: 0200000A:1538",
+		"0: 0200000A:1538 0300000A 01 00000000:00000000",
+		"0: 0200000A:1538 0300000A:D2A4 ZZ 00000000:00000000",
+		"0: 02000A:1538 0300000A:D2A4 01 00000000:00000000",
+	} {
+		_, err := parseTCPSocket(line)
+		require.Error(t, err, line)
+	}
+}
@@ -0,0 +1,201 @@
+package sidecar
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/postgres"
+)
+
+// ActivitySource contributes one kind of activity to the report. Sources run
+// in registration order while the probe holds its lock, on the probe's
+// PostgreSQL querier.
+type ActivitySource interface {
+	Name() string
+	Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error
+}
+
+type querierFactory func(ctx context.Context, url string) (postgres.Querier, error)
+
+// Names of the built-in activity sources, as listed in ACTIVITY_SOURCES.
+const (
+	SourceCounters           = "counters"
+	SourceMaintenance        = "maintenance"
+	SourceLogicalReplication = "logical-replication"
+	SourceDependencies       = "dependencies"
+	SourceHolds              = "holds"
+	SourceScheduledJobs      = "scheduled-jobs"
+	SourceCustomQuery        = "custom-query"
+	SourceConnections        = "connections"
+	SourceSockets            = "sockets"
+
+	// defaultActivitySources stands for every source enabled by default in
+	// ACTIVITY_SOURCES, so optional sources can be added to them.
+	defaultActivitySources = "default"
+)
+
+type activitySourceRegistration struct {
+	name string
+	// new creates the source. connect opens the sidecar's own connections to
+	// application databases, whose transactions are counted in own.
+	new func(cfg Config, connect querierFactory, own *ownTransactions) ActivitySource
+	// optional sources are only enabled when listed by name.
+	optional bool
+}
+
+// activitySources registers the available sources in the order they run.
+// Counters run first so the report never misses work that ended while the
+// sessions were being listed.
+var activitySources = []activitySourceRegistration{
+	{name: SourceCounters, new: func(_ Config, _ querierFactory, own *ownTransactions) ActivitySource {
+		return &countersSource{own: own}
+	}},
+	{name: SourceMaintenance, new: func(Config, querierFactory, *ownTransactions) ActivitySource { return maintenanceSource{} }},
+	{name: SourceLogicalReplication, new: func(Config, querierFactory, *ownTransactions) ActivitySource { return logicalReplicationSource{} }},
+	{name: SourceDependencies, new: func(Config, querierFactory, *ownTransactions) ActivitySource { return dependenciesSource{} }},
+	{name: SourceHolds, new: func(cfg Config, connect querierFactory, own *ownTransactions) ActivitySource {
+		return &holdsSource{
+			database: cfg.HoldDatabase,
+			user:     cfg.ApplicationUser,
+			password: cfg.ApplicationPassword,
+			connect:  connect,
+			own:      own,
+		}
+	}},
+	{name: SourceScheduledJobs, new: func(_ Config, connect querierFactory, own *ownTransactions) ActivitySource {
+		return &scheduledJobsSource{now: time.Now, connect: connect, own: own}
+	}},
+	{name: SourceCustomQuery, new: func(cfg Config, connect querierFactory, own *ownTransactions) ActivitySource {
+		return &customQuerySource{query: cfg.ActivityQuery, connect: connect, own: own}
+	}},
+	{name: SourceConnections, new: func(cfg Config, _ querierFactory, _ *ownTransactions) ActivitySource {
+		return connectionsSource{exclusions: cfg.Exclusions, idleSessionTimeout: cfg.IdleSessionTimeout}
+	}},
+	{name: SourceSockets, optional: true, new: func(cfg Config, _ querierFactory, _ *ownTransactions) ActivitySource {
+		return newSocketsSource(cfg.PostgresPort)
+	}},
+}
+
+// newActivitySources creates the sources enabled by the configuration, or
+// the default ones when none is listed. Unknown names are logged and ignored,
+// so a typo never keeps the sidecar from reporting the remaining activity.
+func newActivitySources(ctx context.Context, cfg Config, connect querierFactory) []ActivitySource {
+	enabled := cfg.ActivitySources
+	if len(enabled) == 0 {
+		enabled = []string{defaultActivitySources}
+	}
+	for _, name := range enabled {
+		if name != defaultActivitySources && !slices.ContainsFunc(activitySources, func(registration activitySourceRegistration) bool {
+			return registration.name == name
+		}) {
+			log.FromContext(ctx).Info("ignoring unknown activity source", "source", name)
+		}
+	}
+
+	own := newOwnTransactions()
+	var sources []ActivitySource
+	for _, registration := range activitySources {
+		if slices.Contains(enabled, registration.name) ||
+			(!registration.optional && slices.Contains(enabled, defaultActivitySources)) {
+			sources = append(sources, registration.new(cfg, connect, own))
+		}
+	}
+	return sources
+}
+
+// countersSource reports the transaction and WAL counters, which reveal work
+// done by sessions that ended between two reports. The transactions the
+// sidecar runs itself in application databases are left out, see
+// ownTransactions.
+type countersSource struct {
+	own *ownTransactions
+	// latest holds the counters of the previous report, reported again until
+	// the latest own transactions are visible.
+	latest *activity.Counters
+}
+
+func (*countersSource) Name() string {
+	return SourceCounters
+}
+
+func (s *countersSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `SELECT COALESCE(SUM(xact_commit), 0)::bigint, COALESCE(SUM(xact_rollback), 0)::bigint,
+	(CASE WHEN pg_is_in_recovery() THEN COALESCE(pg_last_wal_replay_lsn(), '0/0'::pg_lsn) ELSE pg_current_wal_insert_lsn() END - '0/0'::pg_lsn)::bigint
+FROM pg_stat_database
+WHERE datname IS NOT NULL AND datname NOT IN ('postgres', 'template0', 'template1');`
+
+	own, settled := s.own.settled()
+	if !settled && s.latest != nil {
+		// Counters only ever show work late, so the work done since is
+		// reported with the next ones.
+		counters := *s.latest
+		report.Counters = &counters
+		return nil
+	}
+
+	var counters activity.Counters
+	if err := querier.QueryRow(ctx, query).Scan(&counters.XactCommit, &counters.XactRollback, &counters.WALPosition); err != nil {
+		return err
+	}
+	counters.XactCommit -= own.XactCommit
+	counters.XactRollback -= own.XactRollback
+
+	s.latest = &counters
+	latest := counters
+	report.Counters = &latest
+	return nil
+}
+
+// connectionsSource reports the counted client sessions, grouped by database,
+// user, application, state and backend type.
+type connectionsSource struct {
+	exclusions         activity.Exclusions
+	idleSessionTimeout time.Duration
+}
+
+func (connectionsSource) Name() string {
+	return SourceConnections
+}
+
+func (s connectionsSource) Collect(ctx context.Context, querier postgres.Querier, report *activity.Report) error {
+	const query = `SELECT COALESCE(datname, ''), COALESCE(usename, ''), application_name, state, COALESCE(backend_type, ''), COUNT(*), MIN(state_change), MAX(state_change)
+FROM pg_stat_activity
+WHERE ` + clientSessionsFilter + `
+GROUP BY 1, 2, 3, 4, 5
+ORDER BY 6 DESC;`
+
+	rows, err := querier.Query(ctx, query, filterArgs(s.exclusions, s.idleSessionTimeout)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			group       activity.SessionGroup
+			stateChange *time.Time
+		)
+		if err := rows.Scan(
+			&group.Database,
+			&group.User,
+			&group.ApplicationName,
+			&group.State,
+			&group.BackendType,
+			&group.Count,
+			&stateChange,
+			&group.LastStateChange,
+		); err != nil {
+			return err
+		}
+
+		report.Connections += group.Count
+		report.Sessions = append(report.Sessions, group)
+		if stateChange != nil && (report.OldestStateChange == nil || stateChange.Before(*report.OldestStateChange)) {
+			report.OldestStateChange = stateChange
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,149 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+func TestActivitySources(t *testing.T) {
+	t.Parallel()
+
+	stateChange := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		source   ActivitySource
+		querier  mockQuerier
+		expected activity.Report
+		wantErr  bool
+	}{
+		{
+			name:     "counters",
+			source:   &countersSource{own: newOwnTransactions()},
+			querier:  mockQuerier{counters: activity.Counters{XactCommit: 3, XactRollback: 1, WALPosition: 512}},
+			expected: activity.Report{Counters: &activity.Counters{XactCommit: 3, XactRollback: 1, WALPosition: 512}},
+		},
+		{
+			name:   "connections",
+			source: connectionsSource{},
+			querier: mockQuerier{sessions: []mockSessionGroup{
+				{group: activity.SessionGroup{Database: "app", User: "app", State: "active", Count: 2, LastStateChange: &stateChange}, stateChange: stateChange},
+			}},
+			expected: activity.Report{
+				Connections:       2,
+				Sessions:          []activity.SessionGroup{{Database: "app", User: "app", State: "active", Count: 2, LastStateChange: &stateChange}},
+				OldestStateChange: &stateChange,
+			},
+		},
+		{
+			name:     "maintenance",
+			source:   maintenanceSource{},
+			querier:  mockQuerier{maintenance: []activity.MaintenanceOperation{{Kind: activity.MaintenanceAnalyze, Database: "app", Count: 1}}},
+			expected: activity.Report{Maintenance: []activity.MaintenanceOperation{{Kind: activity.MaintenanceAnalyze, Database: "app", Count: 1}}},
+		},
+		{
+			name:     "logical replication",
+			source:   logicalReplicationSource{},
+			querier:  mockQuerier{replication: activity.LogicalReplication{Walsenders: 2}},
+			expected: activity.Report{LogicalReplication: activity.LogicalReplication{Walsenders: 2}},
+		},
+		{
+			name:    "dependencies",
+			source:  dependenciesSource{},
+			querier: mockQuerier{prepared: 1, slots: []activity.ReplicationSlot{{Name: "cdc", Database: "app"}}},
+			expected: activity.Report{
+				PreparedTransactions: 1,
+				ReplicationSlots:     []activity.ReplicationSlot{{Name: "cdc", Database: "app"}},
+			},
+		},
+		{
+			name:    "query error",
+			source:  maintenanceSource{},
+			querier: mockQuerier{err: errors.New("query failed")},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var report activity.Report
+			err := tc.source.Collect(context.Background(), tc.querier, &report)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, report)
+		})
+	}
+}
+
+func TestNewActivitySources(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		enabled  []string
+		expected []string
+	}{
+		{
+			name: "all by default",
+			expected: []string{
+				SourceCounters,
+				SourceMaintenance,
+				SourceLogicalReplication,
+				SourceDependencies,
+				SourceHolds,
+				SourceScheduledJobs,
+				SourceCustomQuery,
+				SourceConnections,
+			},
+		},
+		{
+			name:     "registration order",
+			enabled:  []string{SourceConnections, SourceCounters},
+			expected: []string{SourceCounters, SourceConnections},
+		},
+		{
+			name:    "optional sources added to the defaults",
+			enabled: []string{"default", SourceSockets},
+			expected: []string{
+				SourceCounters,
+				SourceMaintenance,
+				SourceLogicalReplication,
+				SourceDependencies,
+				SourceHolds,
+				SourceScheduledJobs,
+				SourceCustomQuery,
+				SourceConnections,
+				SourceSockets,
+			},
+		},
+		{
+			name:     "unknown sources ignored",
+			enabled:  []string{"netstat", SourceConnections},
+			expected: []string{SourceConnections},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			sources := newActivitySources(context.Background(), Config{ActivitySources: tc.enabled}, nil)
+
+			var names []string
+			for _, source := range sources {
+				names = append(names, source.Name())
+			}
+			require.Equal(t, tc.expected, names)
+		})
+	}
+}
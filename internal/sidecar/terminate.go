@@ -0,0 +1,109 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudnative-pg/machinery/pkg/log"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+// terminateIdleSessions terminates the counted client sessions that have been
+// idle, or idle in transaction, for at least idleFor. The idle session
+// timeout does not apply, because sessions it hides from the report are the
+// ones most likely to need terminating. Sessions that changed state since the
+// caller's report no longer match and are left alone. The sessions are
+// selected in a materialized CTE, since an inlined one would let the planner
+// call pg_terminate_backend before every exclusion has been applied.
+func (p *probe) terminateIdleSessions(ctx context.Context, idleFor time.Duration) (activity.TerminationResult, error) {
+	const query = `WITH stale AS MATERIALIZED (
+	SELECT pid, COALESCE(datname, '') AS datname, COALESCE(usename, '') AS usename, application_name, state, state_change
+	FROM pg_stat_activity
+	WHERE ` + clientSessionsFilter + `
+	AND state = ANY($7::text[])
+	AND state_change < now() - make_interval(secs => $8::double precision)
+)
+SELECT pid, datname, usename, application_name, state, state_change
+FROM stale
+WHERE pg_terminate_backend(pid);`
+
+	result := activity.TerminationResult{Sessions: []activity.TerminatedSession{}}
+	err := p.withReinitialization(ctx, func(ctx context.Context) error {
+		return p.metrics.measure(ctx, queryTerminate, func() error {
+			args := append(filterArgs(p.exclusions, 0), activity.IdleSessionStates, idleFor.Seconds())
+			rows, err := p.pgQuerier.Query(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var session activity.TerminatedSession
+				if err := rows.Scan(
+					&session.PID,
+					&session.Database,
+					&session.User,
+					&session.ApplicationName,
+					&session.State,
+					&session.StateChange,
+				); err != nil {
+					return err
+				}
+				result.Sessions = append(result.Sessions, session)
+			}
+			return rows.Err()
+		})
+	})
+	if err != nil {
+		return activity.TerminationResult{}, fmt.Errorf("terminate idle sessions: %w", err)
+	}
+
+	return result, nil
+}
+
+func (p *probe) handleTerminate(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if p.terminateIdleAfter <= 0 {
+			http.Error(w, "idle session termination is not enabled", http.StatusForbidden)
+			return
+		}
+
+		var request activity.TerminationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.IdleSeconds <= 0 {
+			http.Error(w, "idle_seconds must be positive", http.StatusBadRequest)
+			return
+		}
+		if request.IdleSeconds < p.terminateIdleAfter.Seconds() {
+			http.Error(w, fmt.Sprintf("idle_seconds must be at least %g", p.terminateIdleAfter.Seconds()), http.StatusBadRequest)
+			return
+		}
+
+		result, err := p.terminateIdleSessions(r.Context(), time.Duration(request.IdleSeconds*float64(time.Second)))
+		if err != nil {
+			log.FromContext(ctx).Error(err, "PostgreSQL idle session termination error")
+			http.Error(w, "idle session termination failed", http.StatusServiceUnavailable)
+			return
+		}
+		for _, session := range result.Sessions {
+			log.FromContext(ctx).Info("terminated idle session",
+				"pid", session.PID,
+				"database", session.Database,
+				"user", session.User,
+				"applicationName", session.ApplicationName,
+				"state", session.State,
+				"stateChange", session.StateChange)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.FromContext(ctx).Error(err, "termination response encode error")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
+)
+
+func TestProbeTerminate(t *testing.T) {
+	t.Parallel()
+
+	stateChange := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	terminated := []activity.TerminatedSession{
+		{PID: 42, Database: "app", User: "app", ApplicationName: "api", State: "idle in transaction", StateChange: stateChange},
+	}
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		querier        mockQuerier
+		disabled       bool
+		expectedStatus int
+		expected       activity.TerminationResult
+	}{
+		{
+			name:           "terminated sessions",
+			method:         http.MethodPost,
+			body:           `{"idle_seconds": 3600}`,
+			querier:        mockQuerier{terminated: terminated},
+			expectedStatus: http.StatusOK,
+			expected:       activity.TerminationResult{Sessions: terminated},
+		},
+		{
+			name:           "no sessions",
+			method:         http.MethodPost,
+			body:           `{"idle_seconds": 3600}`,
+			expectedStatus: http.StatusOK,
+			expected:       activity.TerminationResult{Sessions: []activity.TerminatedSession{}},
+		},
+		{
+			name:           "missing age",
+			method:         http.MethodPost,
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "shorter than the configured idle time",
+			method:         http.MethodPost,
+			body:           `{"idle_seconds": 60}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "not enabled",
+			method:         http.MethodPost,
+			body:           `{"idle_seconds": 3600}`,
+			querier:        mockQuerier{terminated: terminated},
+			disabled:       true,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "query error",
+			method:         http.MethodPost,
+			body:           `{"idle_seconds": 3600}`,
+			querier:        mockQuerier{err: errors.New("query failed")},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &probe{pgQuerier: tc.querier, terminateIdleAfter: 30 * time.Minute}
+			if tc.disabled {
+				p.terminateIdleAfter = 0
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(tc.method, "/terminate", strings.NewReader(tc.body))
+			p.handler(context.Background()).ServeHTTP(recorder, request)
+
+			require.Equal(t, tc.expectedStatus, recorder.Code)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var response activity.TerminationResult
+			require.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+			require.Equal(t, tc.expected, response)
+		})
+	}
+}
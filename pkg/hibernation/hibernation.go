@@ -2,6 +2,7 @@ package hibernation
 
 import (
 	"context"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -12,6 +13,9 @@ type Target struct {
 	Key             types.NamespacedName
 	UID             types.UID
 	OwnerReferences []metav1.OwnerReference
+	// NextScheduledRun is when the next scheduled job of the cluster is due,
+	// if it has any.
+	NextScheduledRun *time.Time
 }
 
 // Hibernator applies the mutations required to hibernate a target.
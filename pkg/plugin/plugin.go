@@ -23,14 +23,20 @@ import (
 	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/activity"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/config"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/identity"
 	lifecycleimpl "github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/lifecycle"
 	pluginmetrics "github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/metrics"
 	"github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/scraper"
+	"github.com/xataio/cnpg-i-scale-to-zero/internal/plugin/shard"
 	"github.com/xataio/cnpg-i-scale-to-zero/pkg/hibernation"
 )
 
+// leaderElectionID names the Lease the plugin replicas elect the scraper
+// with.
+const leaderElectionID = "cnpg-i-scale-to-zero.xata.io"
+
 // Target identifies the cluster whose owning resource should be hibernated.
 type Target = hibernation.Target
 
@@ -98,15 +104,42 @@ func bindEnvironment() {
 	_ = viper.BindEnv("sidecar-cpu-limit", "SIDECAR_CPU_LIMIT")
 	_ = viper.BindEnv("sidecar-memory-request", "SIDECAR_MEMORY_REQUEST")
 	_ = viper.BindEnv("sidecar-memory-limit", "SIDECAR_MEMORY_LIMIT")
+	_ = viper.BindEnv("sidecar-sample-interval", "SIDECAR_SAMPLE_INTERVAL")
+	_ = viper.BindEnv("sidecar-activity-query-timeout", "SIDECAR_ACTIVITY_QUERY_TIMEOUT")
+	_ = viper.BindEnv("sidecar-activity-sources", "SIDECAR_ACTIVITY_SOURCES")
+	_ = viper.BindEnv("sidecar-exclude-users", "SIDECAR_EXCLUDE_USERS")
+	_ = viper.BindEnv("sidecar-exclude-databases", "SIDECAR_EXCLUDE_DATABASES")
+	_ = viper.BindEnv("sidecar-exclude-application-names", "SIDECAR_EXCLUDE_APPLICATION_NAMES")
+	_ = viper.BindEnv("sidecar-exclude-client-cidrs", "SIDECAR_EXCLUDE_CLIENT_CIDRS")
+	_ = viper.BindEnv("sidecar-exclude-backend-types", "SIDECAR_EXCLUDE_BACKEND_TYPES")
 	_ = viper.BindEnv("scraper-interval", "SCRAPER_INTERVAL")
 	_ = viper.BindEnv("scraper-timeout", "SCRAPER_TIMEOUT")
 	_ = viper.BindEnv("scraper-concurrency", "SCRAPER_CONCURRENCY")
 	_ = viper.BindEnv("sidecar-scrape-port", "SIDECAR_SCRAPE_PORT")
+	_ = viper.BindEnv("sidecar-tls-secret", "SIDECAR_TLS_SECRET")
+	_ = viper.BindEnv("sidecar-tls-server-name", "SIDECAR_TLS_SERVER_NAME")
+	_ = viper.BindEnv("sidecar-health-port", "SIDECAR_HEALTH_PORT")
+	_ = viper.BindEnv("scraper-tls-cert-dir", "SCRAPER_TLS_CERT_DIR")
+	_ = viper.BindEnv("push-url", "PUSH_URL")
+	_ = viper.BindEnv("push-listen-address", "PUSH_LISTEN_ADDRESS")
+	_ = viper.BindEnv("push-secret", "PUSH_SECRET")
+	_ = viper.BindEnv("push-interval", "PUSH_INTERVAL")
+	_ = viper.BindEnv("leader-election", "LEADER_ELECTION")
+	_ = viper.BindEnv("leader-election-namespace", "LEADER_ELECTION_NAMESPACE")
+	_ = viper.BindEnv("sharding", "SHARDING")
+	_ = viper.BindEnv("pod-namespace", "POD_NAMESPACE")
+	_ = viper.BindEnv("pod-name", "POD_NAME")
 }
 
 func newPluginCommand(options options) *cobra.Command {
 	cmd := http.CreateMainCmd(identity.Implementation{}, func(server *grpc.Server) error {
-		lifecycle.RegisterOperatorLifecycleServer(server, lifecycleimpl.NewImplementation(newConfig()))
+		// The lifecycle hook reads and writes the push key Secrets directly,
+		// rather than through a cache that would hold every Secret.
+		kubeClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{})
+		if err != nil {
+			return err
+		}
+		lifecycle.RegisterOperatorLifecycleServer(server, lifecycleimpl.NewImplementation(newConfig(), kubeClient))
 		return nil
 	})
 
@@ -146,23 +179,56 @@ func runPlugin(
 }
 
 func newConfig() *config.Config {
-	return config.New(
-		viper.GetString("sidecar-image"),
-		viper.GetString("log-level"),
-		viper.GetString("metrics-address"),
-		&config.ResourceConfig{
+	return config.New(config.Options{
+		SidecarImage:   viper.GetString("sidecar-image"),
+		LogLevel:       viper.GetString("log-level"),
+		MetricsAddress: viper.GetString("metrics-address"),
+		SidecarResources: &config.ResourceConfig{
 			CPURequest:    viper.GetString("sidecar-cpu-request"),
 			CPULimit:      viper.GetString("sidecar-cpu-limit"),
 			MemoryRequest: viper.GetString("sidecar-memory-request"),
 			MemoryLimit:   viper.GetString("sidecar-memory-limit"),
 		},
-		config.NewScraperConfig(
+		Sidecar: config.NewSidecarConfig(
+			viper.GetString("sidecar-sample-interval"),
+			viper.GetString("sidecar-activity-query-timeout"),
+			activity.Exclusions{
+				Users:            activity.ParseList(viper.GetString("sidecar-exclude-users")),
+				Databases:        activity.ParseList(viper.GetString("sidecar-exclude-databases")),
+				ApplicationNames: activity.ParseList(viper.GetString("sidecar-exclude-application-names")),
+				ClientCIDRs:      activity.ParseList(viper.GetString("sidecar-exclude-client-cidrs")),
+				BackendTypes:     activity.ParseList(viper.GetString("sidecar-exclude-backend-types")),
+			},
+			activity.ParseList(viper.GetString("sidecar-activity-sources")),
+		),
+		Scraper: config.NewScraperConfig(
 			viper.GetString("scraper-interval"),
 			viper.GetString("scraper-timeout"),
 			viper.GetString("scraper-concurrency"),
 			viper.GetString("sidecar-scrape-port"),
 		),
-	)
+		TLS: config.NewTLSConfig(
+			viper.GetString("sidecar-tls-secret"),
+			viper.GetString("scraper-tls-cert-dir"),
+			viper.GetString("sidecar-tls-server-name"),
+			viper.GetString("sidecar-health-port"),
+		),
+		Push: config.NewPushConfig(
+			viper.GetString("push-url"),
+			viper.GetString("push-listen-address"),
+			viper.GetString("push-secret"),
+			viper.GetString("push-interval"),
+		),
+		LeaderElection: config.NewLeaderElectionConfig(
+			viper.GetString("leader-election"),
+			viper.GetString("leader-election-namespace"),
+		),
+		Sharding: config.NewShardingConfig(
+			viper.GetString("sharding"),
+			viper.GetString("pod-namespace"),
+			viper.GetString("pod-name"),
+		),
+	})
 }
 
 func newScraperManager(
@@ -186,8 +252,14 @@ func newScraperManager(
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:  scheme,
-		Metrics: server.Options{BindAddress: metricsAddress},
+		Scheme:                  scheme,
+		Metrics:                 server.Options{BindAddress: metricsAddress},
+		LeaderElection:          cfg.LeaderElection.Enabled && !cfg.Sharding.Enabled,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: cfg.LeaderElection.Namespace,
+		// The manager waits for the scraper to stop before releasing the
+		// Lease, so the next leader never overlaps with a cycle in progress.
+		LeaderElectionReleaseOnCancel: true,
 	})
 	if err != nil {
 		return nil, err
@@ -202,7 +274,19 @@ func newScraperManager(
 		}
 	}
 
-	var scraperOptions []scraper.Option
+	scraperOptions := []scraper.Option{
+		scraper.WithEventRecorder(mgr.GetEventRecorderFor("cnpg-i-scale-to-zero")),
+	}
+	if cfg.Sharding.Enabled {
+		if cfg.Sharding.Namespace == "" || cfg.Sharding.Identity == "" {
+			return nil, errors.New("sharding requires POD_NAMESPACE and POD_NAME")
+		}
+		membership := shard.New(mgr.GetClient(), mgr.GetAPIReader(), cfg.Sharding.Namespace, cfg.Sharding.Identity)
+		if err := mgr.Add(managerRunnable{fn: membership.Start}); err != nil {
+			return nil, err
+		}
+		scraperOptions = append(scraperOptions, scraper.WithShard(membership))
+	}
 	if options.hibernatorFactory != nil {
 		hibernator := options.hibernatorFactory(mgr.GetClient(), mgr.GetAPIReader())
 		if hibernator == nil {
@@ -220,9 +304,17 @@ func newScraperManager(
 	if err != nil {
 		return nil, err
 	}
-	if err := mgr.Add(managerRunnable{fn: s.Start}); err != nil {
+	// Only the leader scrapes and hibernates, unless every replica processes
+	// its own shard. Every replica accepts pushed reports, so a new leader or
+	// shard owner does not wait for the next push.
+	if err := s.SetupWithManager(mgr); err != nil {
 		return nil, err
 	}
+	if cfg.Push.Enabled() {
+		if err := mgr.Add(managerRunnable{fn: s.ServeReports}); err != nil {
+			return nil, err
+		}
+	}
 	if err := mgr.Add(managerRunnable{fn: func(ctx context.Context) error {
 		<-ctx.Done()
 		return meterProvider.Shutdown(context.WithoutCancel(ctx))
@@ -240,3 +332,9 @@ type managerRunnable struct {
 func (r managerRunnable) Start(ctx context.Context) error {
 	return r.fn(ctx)
 }
+
+// NeedLeaderElection runs the runnable on every replica, like the gRPC
+// server.
+func (r managerRunnable) NeedLeaderElection() bool {
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 func TestRunPluginStopsServerWhenScraperStops(t *testing.T) {
@@ -29,3 +30,10 @@ func TestRunPluginStopsServerWhenScraperStops(t *testing.T) {
 	require.ErrorIs(t, err, scraperErr)
 	require.True(t, serverStopped)
 }
+
+func TestManagerRunnableLeaderElection(t *testing.T) {
+	t.Parallel()
+
+	var runnable manager.LeaderElectionRunnable = managerRunnable{}
+	require.False(t, runnable.NeedLeaderElection())
+}